@@ -0,0 +1,368 @@
+// Package client a client of the qnet servers, it connects to an agent server
+// or a game server directly, and sends the requests by the mid and aid.
+//
+// The packets are encrypted by packet.XORCrypto without a handshake, so the
+// secrets must be set the same as the server's, see packet.SetCryptoSecret
+// and packet.SetSignSecret.
+package client
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/overtalk/qnet/packet"
+)
+
+// error definitions
+var (
+	ErrClosed       = errors.New("client: closed")
+	ErrDisconnected = errors.New("client: disconnected")
+	ErrTimeout      = errors.New("client: request timeout")
+	// ErrResumeUnsupported the server doesn't resume the sessions, see OptionResume
+	ErrResumeUnsupported = errors.New("client: resume unsupported")
+)
+
+// Message a response or a message pushed by the server, the data is
+// decrypted and decompressed.
+type Message struct {
+	MID    uint8
+	AID    uint8
+	Ver    uint8
+	Seq    uint32
+	HasSeq bool
+	Data   []byte
+}
+
+// newMessage create a Message from a decrypted and reassembled packet
+func newMessage(pack packet.Packet) (*Message, error) {
+	header, _, err := packet.Parse(pack)
+	if err != nil {
+		return nil, err
+	}
+	data, err := packet.Decompress(pack)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		MID:    header.MID,
+		AID:    header.AID,
+		Ver:    header.Ver,
+		Seq:    header.Seq,
+		HasSeq: header.HasSeq,
+		Data:   data,
+	}, nil
+}
+
+// callResult the result of a request
+type callResult struct {
+	msg *Message
+	err error
+}
+
+// Client a client of a server, its requests are pipelined by the sequence
+// numbers, and it's concurrent safely.
+type Client struct {
+	network string
+	addr    string
+	opts    *options
+
+	seq     uint32 // the last sequence number
+	conn    *conn  // nil if disconnected
+	pending map[uint32]chan callResult
+	lock    sync.Mutex
+	// the resume state shared by the connections, nil without OptionResume
+	resume *resumeState
+
+	closed   int32
+	sigClose chan struct{}
+	done     chan struct{}
+}
+
+// Dial connect to a server, eg: Dial("tcp", "127.0.0.1:9000"), the
+// handshakes set by the options are done before it returns.
+func Dial(network, addr string, opts ...OptionFunc) (*Client, error) {
+	o := newOptions(opts)
+	var resume *resumeState
+	if o.resume {
+		resume = &resumeState{}
+	}
+	c, err := dial(network, addr, o, resume)
+	if err != nil {
+		return nil, err
+	}
+	cli := &Client{
+		network:  network,
+		addr:     addr,
+		opts:     o,
+		conn:     c,
+		resume:   resume,
+		pending:  map[uint32]chan callResult{},
+		sigClose: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go cli.serve(c)
+	return cli, nil
+}
+
+// serve read the messages of the connections until closed
+func (cli *Client) serve(c *conn) {
+	defer close(cli.done)
+	for {
+		if cli.opts.onState != nil {
+			cli.opts.onState(true, nil)
+		}
+		err := cli.serveConn(c)
+		cli.disconnect(c)
+		if cli.opts.onState != nil {
+			cli.opts.onState(false, err)
+		}
+		if !cli.opts.reconnect {
+			return
+		}
+		if c = cli.redial(); c == nil {
+			return
+		}
+	}
+}
+
+// serveConn read the messages of a connection until an error occurs
+func (cli *Client) serveConn(c *conn) error {
+	c.startHeartbeat()
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			cli.dispatch(msg)
+		}
+	}
+}
+
+// dispatch deliver a response to its request, or push a message to the handler
+func (cli *Client) dispatch(msg *Message) {
+	if msg.HasSeq {
+		cli.lock.Lock()
+		ch, ok := cli.pending[msg.Seq]
+		delete(cli.pending, msg.Seq)
+		cli.lock.Unlock()
+		if ok {
+			ch <- callResult{msg: msg}
+			return
+		}
+	}
+	if cli.opts.onPush != nil {
+		cli.opts.onPush(msg)
+	}
+}
+
+// disconnect close a connection and fail its pending requests,
+// they are kept if the session may be resumed.
+func (cli *Client) disconnect(c *conn) {
+	c.close()
+	c.reader.Free()
+	cli.lock.Lock()
+	if cli.conn == c {
+		cli.conn = nil
+	}
+	if cli.resume != nil && cli.opts.reconnect && !cli.IsClosed() {
+		cli.lock.Unlock()
+		return
+	}
+	cli.failPending()
+}
+
+// failPending fail the pending requests, it releases the held lock
+func (cli *Client) failPending() {
+	pending := cli.pending
+	cli.pending = map[uint32]chan callResult{}
+	cli.lock.Unlock()
+	for _, ch := range pending {
+		ch <- callResult{err: ErrDisconnected}
+	}
+}
+
+// redial reconnect to the server by the binary exponential backoff,
+// it returns nil if the client is closed.
+func (cli *Client) redial() *conn {
+	delay := minReconnectDelay
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-cli.sigClose:
+			timer.Stop()
+			return nil
+		}
+		c, err := dial(cli.network, cli.addr, cli.opts, cli.resume)
+		if err == nil {
+			cli.lock.Lock()
+			if cli.IsClosed() {
+				cli.lock.Unlock()
+				c.close()
+				c.reader.Free()
+				return nil
+			}
+			cli.conn = c
+			if cli.resume != nil && !c.resumed {
+				// the responses of the pending requests are lost
+				cli.failPending()
+				return c
+			}
+			cli.lock.Unlock()
+			return c
+		}
+		if delay *= 2; delay > cli.opts.maxReconnectDelay {
+			delay = cli.opts.maxReconnectDelay
+		}
+	}
+}
+
+// nextSeq get a new sequence number, it's never 0
+func (cli *Client) nextSeq() uint32 {
+	for {
+		if seq := atomic.AddUint32(&cli.seq, 1); seq != 0 {
+			return seq
+		}
+	}
+}
+
+// getConn get the current connection
+func (cli *Client) getConn() (*conn, error) {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	if cli.IsClosed() {
+		return nil, ErrClosed
+	}
+	if cli.conn == nil {
+		return nil, ErrDisconnected
+	}
+	return cli.conn, nil
+}
+
+// Send send a request without waiting for its response, the response is
+// handled as a pushed message if any.
+func (cli *Client) Send(mid, aid uint8, data []byte) error {
+	c, err := cli.getConn()
+	if err != nil {
+		return err
+	}
+	return c.write(mid, aid, false, 0, data)
+}
+
+// Request send a request and wait for its response in the default timeout
+func (cli *Client) Request(mid, aid uint8, data []byte) (*Message, error) {
+	return cli.RequestTimeout(mid, aid, data, cli.opts.requestTimeout)
+}
+
+// RequestTimeout send a request and wait for its response in the timeout,
+// it fails if disconnected before the response arrives.
+func (cli *Client) RequestTimeout(mid, aid uint8, data []byte, timeout time.Duration) (*Message, error) {
+	c, err := cli.getConn()
+	if err != nil {
+		return nil, err
+	}
+	seq := cli.nextSeq()
+	ch := make(chan callResult, 1)
+	cli.lock.Lock()
+	cli.pending[seq] = ch
+	cli.lock.Unlock()
+	if err = c.write(mid, aid, true, seq, data); err != nil {
+		cli.removePending(seq)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-ch:
+		return result.msg, result.err
+	case <-timer.C:
+		cli.removePending(seq)
+		return nil, ErrTimeout
+	case <-cli.sigClose:
+		return nil, ErrClosed
+	}
+}
+
+func (cli *Client) removePending(seq uint32) {
+	cli.lock.Lock()
+	delete(cli.pending, seq)
+	cli.lock.Unlock()
+}
+
+// PendingNum get the number of the requests waiting for the responses
+func (cli *Client) PendingNum() int {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	return len(cli.pending)
+}
+
+// IsConnected check whether it's connected to the server
+func (cli *Client) IsConnected() bool {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	return cli.conn != nil
+}
+
+// SessionKeys get the session keys of the current connection,
+// it's nil without a handshake or if disconnected.
+func (cli *Client) SessionKeys() *packet.SessionKeys {
+	c, err := cli.getConn()
+	if err != nil {
+		return nil
+	}
+	return c.keys
+}
+
+// IsResumed check whether the session is resumed by the current connection,
+// see OptionResume.
+func (cli *Client) IsResumed() bool {
+	c, err := cli.getConn()
+	if err != nil {
+		return false
+	}
+	return c.resumed
+}
+
+// RTT get the measured round-trip time of the current connection,
+// it's 0 if disconnected or the server never replies the pings.
+func (cli *Client) RTT() time.Duration {
+	c, err := cli.getConn()
+	if err != nil {
+		return 0
+	}
+	return c.heartbeat.RTT()
+}
+
+// CompressAlg get the negotiated compression algorithm of the current connection
+func (cli *Client) CompressAlg() packet.CompressAlg {
+	c, err := cli.getConn()
+	if err != nil {
+		return packet.CompressNone
+	}
+	return c.compressAlg
+}
+
+// IsClosed check whether the client is closed
+func (cli *Client) IsClosed() bool {
+	return atomic.LoadInt32(&cli.closed) == 1
+}
+
+// Close close the client and wait for its goroutine exiting,
+// the pending requests fail.
+func (cli *Client) Close() {
+	if !atomic.CompareAndSwapInt32(&cli.closed, 0, 1) {
+		return
+	}
+	close(cli.sigClose)
+	cli.lock.Lock()
+	c := cli.conn
+	cli.lock.Unlock()
+	if c != nil {
+		c.close()
+	}
+	<-cli.done
+}
@@ -0,0 +1,347 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/session"
+	"github.com/overtalk/qnet/tunnel"
+)
+
+// the actions of the test server
+const (
+	actEcho  = 1
+	actDrop  = 2 // never respond
+	actClose = 3 // close the connections
+	// close the connections, and echo after the connections are closed
+	actCloseEcho = 4
+)
+
+type testAction struct {
+	aid    uint8
+	handle func(*session.Request) common.IOutProtocol
+}
+
+func (a *testAction) GetAID() uint8 { return a.aid }
+func (a *testAction) Handle(r common.IRequest) common.IOutProtocol {
+	return a.handle(r.(*session.Request))
+}
+
+// testServer a game server serving the clients by session.ClientService
+type testServer struct {
+	t        *testing.T
+	l        net.Listener
+	accepted int32
+	signed   int32        // the number of the verified signatures
+	keys     atomic.Value // the client's session keys verifying the signatures
+	session  atomic.Value // the session of the last echoed request
+
+	conns []net.Conn
+	lock  sync.Mutex
+}
+
+// initPools init the pools once, the servers of a test share them
+var initPools sync.Once
+
+func newTestServer(t *testing.T, opts ...session.ClientOptionFunc) *testServer {
+	initPools.Do(tunnel.InitFrontendPool)
+	s := &testServer{t: t}
+	router := common.NewRouter()
+	err := router.Register(common.NewModule(1,
+		&testAction{aid: actEcho, handle: s.echo},
+		&testAction{aid: actDrop, handle: func(*session.Request) common.IOutProtocol { return nil }},
+		&testAction{aid: actClose, handle: s.closeConns},
+		&testAction{aid: actCloseEcho, handle: func(req *session.Request) common.IOutProtocol {
+			s.closeConns(req)
+			time.Sleep(50 * time.Millisecond)
+			return s.echo(req)
+		}},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]session.ClientOptionFunc{session.OptionClientCompress(0, packet.CompressLZ4)}, opts...)
+	cs := session.NewClientService(router, opts...)
+	if s.l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the connections closed by the test
+	var serving sync.WaitGroup
+	t.Cleanup(func() {
+		s.l.Close()
+		serving.Wait()
+	})
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		for {
+			nc, err := s.l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepted, 1)
+			s.lock.Lock()
+			s.conns = append(s.conns, nc)
+			s.lock.Unlock()
+			serving.Add(1)
+			go func() {
+				defer serving.Done()
+				cs.Serve(nc)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *testServer) addr() string { return s.l.Addr().String() }
+
+// echo reply the data, the signature is verified by the client's session keys
+func (s *testServer) echo(req *session.Request) common.IOutProtocol {
+	if keys, _ := s.keys.Load().(*packet.SessionKeys); keys != nil && len(req.Sign) > 0 {
+		err := packet.VerifySign(keys.NewSignature(), []byte("token"), packet.SeqSignData(req.Seq, req.Data), req.Sign)
+		if err != nil {
+			s.t.Errorf("server: %v", err)
+			return nil
+		}
+		atomic.AddInt32(&s.signed, 1)
+	}
+	s.session.Store(session.FromRequest(req))
+	return common.BytesOutProtocol(req.Data)
+}
+
+func (s *testServer) closeConns(*session.Request) common.IOutProtocol {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, nc := range s.conns {
+		nc.Close()
+	}
+	return nil
+}
+
+func TestRequest(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	s := newTestServer(t)
+	pushed := make(chan *Message, 1)
+	cli, err := Dial("tcp", s.addr(), OptionProtoVersion(3),
+		OptionPushHandler(func(msg *Message) { pushed <- msg }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	msg, err := cli.Request(1, actEcho, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MID != 1 || msg.AID != actEcho || msg.Ver != 3 || !msg.HasSeq || string(msg.Data) != "hello" {
+		t.Errorf("response: %+v", msg)
+	}
+
+	// the response of a request without a sequence number is pushed
+	if err := cli.Send(1, actEcho, []byte("push")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-pushed:
+		if msg.HasSeq || string(msg.Data) != "push" {
+			t.Errorf("pushed: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no pushed message")
+	}
+
+	if _, err := cli.RequestTimeout(1, actDrop, nil, 50*time.Millisecond); err != ErrTimeout {
+		t.Errorf("got %v, expected %v", err, ErrTimeout)
+	}
+	if n := cli.PendingNum(); n != 0 {
+		t.Errorf("%d pending requests", n)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	packet.InitCompressPool(4)
+	s := newTestServer(t)
+	cli, err := Dial("tcp", s.addr(), OptionHandshake(),
+		OptionCompress(64, packet.CompressLZ4, packet.CompressZlib),
+		OptionSign(nil, []byte("token")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.SessionKeys() == nil || cli.CompressAlg() != packet.CompressLZ4 {
+		t.Fatalf("keys: %v, compression: %v", cli.SessionKeys(), cli.CompressAlg())
+	}
+	s.keys.Store(cli.SessionKeys())
+
+	// an oversized request and response are fragmented
+	for _, data := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("0123456789"), 10000)} {
+		msg, err := cli.Request(1, actEcho, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.Data, data) {
+			t.Errorf("response %d bytes, expected %d", len(msg.Data), len(data))
+		}
+	}
+	if n := atomic.LoadInt32(&s.signed); n != 2 {
+		t.Errorf("%d signed requests, expected 2", n)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	s := newTestServer(t)
+	states := make(chan bool, 4)
+	cli, err := Dial("tcp", s.addr(), OptionReconnect(time.Second),
+		OptionStateHandler(func(connected bool, _ error) { states <- connected }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if _, err := cli.Request(1, actClose, nil); err != ErrDisconnected {
+		t.Errorf("got %v, expected %v", err, ErrDisconnected)
+	}
+	for _, expected := range []bool{true, false, true} {
+		select {
+		case connected := <-states:
+			if connected != expected {
+				t.Fatalf("connected: %v, expected %v", connected, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no reconnection")
+		}
+	}
+	if msg, err := cli.Request(1, actEcho, []byte("again")); err != nil || string(msg.Data) != "again" {
+		t.Errorf("response: %v %v", msg, err)
+	}
+	if n := atomic.LoadInt32(&s.accepted); n != 2 {
+		t.Errorf("%d connections, expected 2", n)
+	}
+
+	cli.Close()
+	if _, err := cli.Request(1, actEcho, nil); err != ErrClosed {
+		t.Errorf("got %v, expected %v", err, ErrClosed)
+	}
+}
+
+func TestPing(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	s := newTestServer(t)
+	cli, err := Dial("tcp", s.addr(), OptionPing(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	// the echoed pings keep the connection alive
+	time.Sleep(200 * time.Millisecond)
+	if !cli.IsConnected() {
+		t.Fatal("disconnected by the echoed pings")
+	}
+
+	// a dead server never echoes the pings
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if nc, err := l.Accept(); err == nil {
+			defer nc.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	dead, err := Dial("tcp", l.Addr().String(), OptionPing(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	time.Sleep(200 * time.Millisecond)
+	if dead.IsConnected() {
+		t.Fatal("connected to a dead server")
+	}
+}
+
+func TestResume(t *testing.T) {
+	resumer := tunnel.NewResumer(time.Second, 16)
+	s := newTestServer(t, session.OptionClientResumer(resumer))
+	pushed := make(chan *Message, 4)
+	cli, err := Dial("tcp", s.addr(), OptionResume(2), OptionReconnect(100*time.Millisecond),
+		OptionPushHandler(func(msg *Message) { pushed <- msg }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.IsResumed() || resumer.Len() != 1 {
+		t.Fatalf("resumed: %v, %d resumable", cli.IsResumed(), resumer.Len())
+	}
+	if _, err := cli.Request(1, actEcho, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	state := s.session.Load().(*session.Session)
+
+	// the response written after the connection is closed is resent after
+	// resumed, and the pending request is kept
+	msg, err := cli.Request(1, actCloseEcho, []byte("late"))
+	if err != nil || string(msg.Data) != "late" {
+		t.Fatalf("response: %v %v", msg, err)
+	}
+	if !cli.IsResumed() || atomic.LoadInt32(&s.accepted) != 2 {
+		t.Fatalf("resumed: %v, %d connections", cli.IsResumed(), atomic.LoadInt32(&s.accepted))
+	}
+	if _, err := cli.Request(1, actEcho, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if s.session.Load() != state || state.Push(1, actEcho, common.BytesOutProtocol("pushed")) != nil {
+		t.Fatal("the session isn't resumed")
+	}
+	select {
+	case msg := <-pushed:
+		if string(msg.Data) != "pushed" {
+			t.Errorf("pushed: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no pushed message")
+	}
+
+	// the session expires after the grace period
+	cli.Close()
+	for i := 0; resumer.Len() != 0; i++ {
+		if i == 30 {
+			t.Fatalf("%d resumable sessions after closed", resumer.Len())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestResumeExpired(t *testing.T) {
+	resumer := tunnel.NewResumer(10*time.Millisecond, 16)
+	s := newTestServer(t, session.OptionClientResumer(resumer))
+	if _, err := Dial("tcp", newTestServer(t).addr(), OptionResume(0)); err != ErrResumeUnsupported {
+		t.Errorf("got %v, expected %v", err, ErrResumeUnsupported)
+	}
+
+	cli, err := Dial("tcp", s.addr(), OptionResume(0), OptionReconnect(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// the pending request fails after the session expires
+	if _, err := cli.Request(1, actClose, nil); err != ErrDisconnected {
+		t.Errorf("got %v, expected %v", err, ErrDisconnected)
+	}
+	if msg, err := cli.Request(1, actEcho, []byte("again")); err != nil || string(msg.Data) != "again" {
+		t.Errorf("response: %v %v", msg, err)
+	}
+	if cli.IsResumed() || resumer.Len() != 1 {
+		t.Errorf("resumed: %v, %d resumable", cli.IsResumed(), resumer.Len())
+	}
+}
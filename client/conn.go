@@ -0,0 +1,295 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/pool"
+)
+
+// ErrUnexpectedCmd the server replies an unexpected cmd while connecting
+var ErrUnexpectedCmd = errors.New("client: unexpected cmd")
+
+// bufReaders the buffered readers of the connections
+var bufReaders = pool.NewBufReaderPool(16, 4*1024)
+
+// resumeState the resume state of a client, it's shared by the connections
+// and accessed by the reading goroutine only.
+type resumeState struct {
+	token []byte
+	// the keys of the connection the token is issued to, they prove it
+	keys *packet.SessionKeys
+	// the number of the messages received in the session,
+	// and the acknowledged ones
+	count uint32
+	acked uint32
+}
+
+// conn a connection to the server, a Client creates a new one after
+// reconnected, and the session state isn't shared between them unless
+// the session is resumed, see OptionResume.
+type conn struct {
+	opts   *options
+	base   *common.BaseConn
+	reader *pool.BufReader
+	writer *common.BatchWriter
+
+	crypto      packet.ICrypto
+	signature   packet.ISignature
+	keys        *packet.SessionKeys
+	compressAlg packet.CompressAlg
+	reassembler *packet.Reassembler
+	// the resume state of the client, it's nil without resuming
+	resume  *resumeState
+	resumed bool
+
+	// ping the server, measure the RTT and detect a dead server
+	heartbeat *common.HeartbeatState
+
+	closeOnce sync.Once
+	sigClose  chan struct{}
+}
+
+// dial connect to the server and negotiate the session
+func dial(network, addr string, o *options, resume *resumeState) (*conn, error) {
+	nc, err := net.DialTimeout(network, addr, o.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufReaders.Get(nc)
+	base := common.NewBaseConn(nc, reader)
+	base.SetTimeout(o.dialTimeout)
+	c := &conn{
+		opts:        o,
+		base:        base,
+		reader:      reader,
+		crypto:      packet.XORCrypto,
+		signature:   packet.HMACSha1Signature,
+		reassembler: packet.NewReassembler(packet.DefaultMaxReassembledSize),
+		resume:      resume,
+		heartbeat:   common.NewHeartbeatState(o.heartbeat),
+		sigClose:    make(chan struct{}),
+	}
+	if err = c.negotiate(); err != nil {
+		base.Close()
+		reader.Free()
+		return nil, err
+	}
+	if o.signature != nil {
+		c.signature = o.signature
+	}
+
+	// the connection is long-lived, the timeouts are the heartbeat's ones
+	// after the negotiation
+	c.heartbeat.Apply(base)
+	nc.SetReadDeadline(time.Time{})
+	c.writer = common.NewFramedBatchWriter(base, o.writeQueue, 0, o.framer)
+	return c, nil
+}
+
+// negotiate do the handshake and the compression negotiation in order,
+// the cmd packets are written and read synchronously before serving.
+func (c *conn) negotiate() error {
+	if c.opts.handshake {
+		kx, err := packet.NewKeyExchange(true)
+		if err != nil {
+			return err
+		}
+		reply, err := c.roundTrip(packet.NewHandshakeCmd(0, kx.PublicKey()), packet.CmdHandshake)
+		if err != nil {
+			return err
+		}
+		if c.keys, err = kx.SessionKeys(reply.GetCmdData()); err != nil {
+			return err
+		}
+		if c.crypto, err = c.keys.NewCrypto(); err != nil {
+			return err
+		}
+		c.signature = c.keys.NewSignature()
+	}
+	if len(c.opts.compressAlgs) > 0 {
+		mask := packet.CompressAlgMask(c.opts.compressAlgs...)
+		reply, err := c.roundTrip(packet.NewCompressCmd(0, mask), packet.CmdCompress)
+		if err != nil {
+			return err
+		}
+		if data := reply.GetCmdData(); len(data) > 0 {
+			c.compressAlg = packet.CompressAlg(data[0])
+		}
+	}
+	if c.resume != nil {
+		return c.negotiateResume()
+	}
+	return nil
+}
+
+// negotiateResume ask for a resume token, or resume the session by the token
+// proved by the keys of the session and the connection. The server proves the
+// new token if the session is resumed, otherwise it's a new session.
+func (c *conn) negotiateResume() error {
+	rs := c.resume
+	var proof []byte
+	if rs.token != nil {
+		proof = packet.NewResumeProof(rs.keys, c.keys, rs.token, rs.count)
+	}
+	reply, err := c.roundTrip(packet.NewResumeCmd(0, rs.count, rs.token, proof), packet.CmdResume)
+	if err != nil {
+		return err
+	}
+	count, token, proof, err := packet.ParseResumeCmd(reply)
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return ErrResumeUnsupported
+	}
+	if proof != nil {
+		if rs.token == nil || count != rs.count {
+			return packet.ErrInvalidResume
+		}
+		if err = packet.VerifyResumeProof(rs.keys, c.keys, token, count, proof); err != nil {
+			return err
+		}
+		c.resumed = true
+	} else {
+		rs.count = 0
+	}
+	rs.token = append([]byte{}, token...)
+	rs.keys, rs.acked = c.keys, rs.count
+	return nil
+}
+
+// roundTrip write a cmd packet and read the reply of the cmd, the pings
+// from the server are skipped.
+func (c *conn) roundTrip(req packet.Packet, cmd uint16) (packet.Packet, error) {
+	frame, err := common.AppendPacketFrame(c.opts.framer, nil, req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.base.Write(frame); err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if !reply.IsCmdProto() {
+			return nil, ErrUnexpectedCmd
+		}
+		switch reply.GetCmd() {
+		case cmd:
+			return reply, nil
+		case packet.CmdPing, packet.CmdPong:
+		default:
+			return nil, ErrUnexpectedCmd
+		}
+	}
+}
+
+// readPacket read a frame of a packet, it's never reused by the buffer
+func (c *conn) readPacket() (packet.Packet, error) {
+	buffer := common.NewFramedPacketBuffer(packet.MaxPacketSize, nil, c.opts.framer)
+	if err := c.base.ReadPacket(buffer); err != nil {
+		return nil, err
+	}
+	pack := packet.Packet(buffer.Bytes())
+	if !pack.IsValid() {
+		return nil, packet.ErrInvalidSize
+	}
+	c.heartbeat.Touch(pack)
+	return pack, nil
+}
+
+// readMessage read a message, it's nil if the packet is a cmd or an
+// incomplete fragment.
+func (c *conn) readMessage() (*Message, error) {
+	pack, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	// a cmd packet is never encrypted, eg: a ping echoed by the server,
+	// it keeps the connection alive, and a pong updates the RTT
+	if len(pack) < 2+packet.OptSizeData || pack.IsCmd() {
+		if pong := c.heartbeat.Handle(pack); pong != nil {
+			_, err = c.writer.Write(pong)
+		}
+		return nil, err
+	}
+	if pack, err = pack.Decrypt(c.crypto); err != nil {
+		return nil, err
+	}
+	if pack.IsFragment() {
+		if pack, err = c.reassembler.Add(pack); err != nil || pack == nil {
+			return nil, err
+		}
+	}
+	if c.resume != nil {
+		if err = c.ack(); err != nil {
+			return nil, err
+		}
+	}
+	return newMessage(pack)
+}
+
+// ack count a received message of a resumable session, and acknowledge the
+// received ones every opts.ackEvery messages.
+func (c *conn) ack() error {
+	rs := c.resume
+	rs.count++
+	if rs.count-rs.acked < uint32(c.opts.ackEvery) {
+		return nil
+	}
+	rs.acked = rs.count
+	_, err := c.writer.Write(packet.NewAckCmd(0, rs.count))
+	return err
+}
+
+// write build a request packet and write it by fragments if oversized
+func (c *conn) write(mid, aid uint8, hasSeq bool, seq uint32, data []byte) error {
+	builder := packet.NewBuilder(mid, aid).Version(c.opts.version).Data(data)
+	if hasSeq {
+		builder.Seq(seq)
+	}
+	if c.compressAlg != packet.CompressNone {
+		builder.Compress(packet.NewCompresser(c.compressAlg, c.opts.compressMin))
+	}
+	if c.opts.sign {
+		builder.SignWith(c.signature, c.opts.token)
+	}
+	pack, err := builder.Build()
+	if err != nil {
+		return err
+	}
+	for _, fragment := range packet.Fragment(pack) {
+		if fragment, err = fragment.Encrypt(c.crypto); err != nil {
+			return err
+		}
+		if _, err = c.writer.Write(fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startHeartbeat ping the server by the heartbeat policy until closed, the
+// server is dead if nothing is received in the DeadTimeout.
+func (c *conn) startHeartbeat() {
+	c.heartbeat.Run(func(ping packet.Packet) error {
+		_, err := c.writer.Write(ping)
+		return err
+	}, c.close, c.sigClose)
+}
+
+// close close the connection, the reading goroutine gets an error
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.sigClose)
+		c.writer.Close()
+		c.base.Close()
+	})
+}
@@ -0,0 +1,217 @@
+package client
+
+import (
+	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+)
+
+const (
+	defaultDialTimeout    = 10 * time.Second
+	defaultRequestTimeout = 10 * time.Second
+	defaultWriteQueue     = 64
+	// the server is dead if nothing is received in the ping intervals
+	deadPings = 3
+	// the first delay of reconnecting, it's doubled after each failure
+	minReconnectDelay = 100 * time.Millisecond
+	// acknowledge the messages of a resumable session after received them
+	defaultAckEvery = 8
+)
+
+// the default heartbeat of a client, the server is dead if nothing is
+// received in 3 ping intervals.
+var defaultHeartbeat = common.Heartbeat{
+	PingInterval: 18 * time.Second,
+	DeadTimeout:  deadPings * 18 * time.Second,
+	WriteTimeout: 10 * time.Second,
+}
+
+// PushHandler handle a message pushed by the server, it's called in the
+// reading goroutine, so it mustn't block.
+type PushHandler func(*Message)
+
+// StateHandler handle a state change of the connection, err is the cause
+// of the disconnection, eg: connected is false and err is io.EOF.
+type StateHandler func(connected bool, err error)
+
+// options the options of a Client
+type options struct {
+	dialTimeout    time.Duration
+	requestTimeout time.Duration
+	heartbeat      common.Heartbeat
+	writeQueue     int
+	version        uint8
+	framer         common.IFramer
+
+	// derive the session keys by a handshake after connected
+	handshake bool
+	// negotiate the compression algorithm of the responses and the requests,
+	// the requests larger than compressMin are compressed
+	compressAlgs []packet.CompressAlg
+	compressMin  int
+	// sign the requests by the signature and the token
+	sign      bool
+	signature packet.ISignature
+	token     []byte
+
+	// reconnect after disconnected, the delay is at most maxReconnectDelay
+	reconnect         bool
+	maxReconnectDelay time.Duration
+	// resume the session after reconnected, and acknowledge the received
+	// messages every ackEvery ones
+	resume   bool
+	ackEvery int
+
+	onPush  PushHandler
+	onState StateHandler
+}
+
+// OptionFunc set the Client's option
+type OptionFunc func(*options)
+
+// OptionDialTimeout set the timeout of dialing and the handshakes,
+// it's 10 seconds by default.
+func OptionDialTimeout(timeout time.Duration) OptionFunc {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+// OptionRequestTimeout set the default timeout of waiting for a response,
+// it's 10 seconds by default.
+func OptionRequestTimeout(timeout time.Duration) OptionFunc {
+	return func(o *options) {
+		o.requestTimeout = timeout
+	}
+}
+
+// OptionPing set the interval of sending a ping, the client never pings
+// if interval is 0, it's 18 seconds by default. The connection is closed
+// if nothing is received from the server in 3 intervals, a server echoes
+// the pings. It sets the PingInterval and the DeadTimeout of the heartbeat,
+// see OptionHeartbeat.
+func OptionPing(interval time.Duration) OptionFunc {
+	return func(o *options) {
+		o.heartbeat.PingInterval = interval
+		o.heartbeat.DeadTimeout = deadPings * interval
+	}
+}
+
+// OptionHeartbeat set the heartbeat policy after connected, the client pings
+// every 18 seconds and the server is dead in 3 intervals by default. A server
+// replies the pings carrying the sending time to measure the RTT, see
+// Client.RTT.
+func OptionHeartbeat(heartbeat common.Heartbeat) OptionFunc {
+	return func(o *options) {
+		o.heartbeat = heartbeat
+	}
+}
+
+// OptionWriteQueue set the outbound packets queue size
+func OptionWriteQueue(size int) OptionFunc {
+	return func(o *options) {
+		o.writeQueue = size
+	}
+}
+
+// OptionProtoVersion set the proto version of the requests
+func OptionProtoVersion(ver uint8) OptionFunc {
+	return func(o *options) {
+		o.version = ver
+	}
+}
+
+// OptionFramer set the framer of the stream, it's common.DefaultFramer by default
+func OptionFramer(framer common.IFramer) OptionFunc {
+	return func(o *options) {
+		o.framer = framer
+	}
+}
+
+// OptionHandshake derive the session keys by a CmdHandshake after connected,
+// the packets are encrypted by packet.XORCrypto if not set.
+func OptionHandshake() OptionFunc {
+	return func(o *options) {
+		o.handshake = true
+	}
+}
+
+// OptionCompress negotiate the compression algorithm by a CmdCompress after
+// connected, the server chooses one of the algs, and the requests larger than
+// minSize are compressed by it.
+func OptionCompress(minSize int, algs ...packet.CompressAlg) OptionFunc {
+	return func(o *options) {
+		o.compressAlgs = algs
+		o.compressMin = minSize
+	}
+}
+
+// OptionSign sign the requests by the signature and the token, the signature
+// is the session's one if nil, see packet.SessionKeys.NewSignature, or
+// packet.HMACSha1Signature without a handshake.
+func OptionSign(signature packet.ISignature, token []byte) OptionFunc {
+	return func(o *options) {
+		o.sign = true
+		o.signature = signature
+		o.token = append([]byte{}, token...)
+	}
+}
+
+// OptionReconnect reconnect automatically after disconnected, the delay of
+// the binary exponential backoff is at most maxDelay.
+func OptionReconnect(maxDelay time.Duration) OptionFunc {
+	return func(o *options) {
+		o.reconnect = true
+		o.maxReconnectDelay = maxDelay
+	}
+}
+
+// OptionResume ask the server for a resume token after the handshake, and
+// resume the session by it after reconnected, the missed messages are resent
+// by the server, and the pending requests are kept until resumed. The token is
+// proved by the session keys, so it implies OptionHandshake. The received
+// messages are acknowledged every ackEvery ones, it's 8 by default, and it
+// must be less than the server's buffer, see tunnel.NewResumer.
+func OptionResume(ackEvery int) OptionFunc {
+	return func(o *options) {
+		if ackEvery <= 0 {
+			ackEvery = defaultAckEvery
+		}
+		o.handshake = true
+		o.resume = true
+		o.ackEvery = ackEvery
+	}
+}
+
+// OptionPushHandler set the handler of the messages pushed by the server,
+// the pushed messages are dropped if not set.
+func OptionPushHandler(handler PushHandler) OptionFunc {
+	return func(o *options) {
+		o.onPush = handler
+	}
+}
+
+// OptionStateHandler set the handler of the connection state changes
+func OptionStateHandler(handler StateHandler) OptionFunc {
+	return func(o *options) {
+		o.onState = handler
+	}
+}
+
+func newOptions(opts []OptionFunc) *options {
+	o := &options{
+		dialTimeout:    defaultDialTimeout,
+		requestTimeout: defaultRequestTimeout,
+		heartbeat:      defaultHeartbeat,
+		writeQueue:     defaultWriteQueue,
+		framer:         common.DefaultFramer,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.maxReconnectDelay < minReconnectDelay {
+		o.maxReconnectDelay = minReconnectDelay
+	}
+	return o
+}
@@ -83,6 +83,20 @@ func (c *BaseConn) Write(b []byte) (int, error) {
 	return c.netConn.Write(b)
 }
 
+// WriteBuffers write several bytes buffers to the wrapped netconn at once,
+// it's a writev syscall if the netconn supports it.
+func (c *BaseConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	if c.wrTimeout > 0 {
+		c.netConn.SetWriteDeadline(time.Now().Add(c.wrTimeout))
+	}
+	return bufs.WriteTo(c.netConn)
+}
+
+// GetWriteTimeout get the WriteTimeout
+func (c *BaseConn) GetWriteTimeout() time.Duration {
+	return c.wrTimeout
+}
+
 // Close close the wrapped netconn
 func (c *BaseConn) Close() (err error) {
 	return c.netConn.Close()
@@ -0,0 +1,246 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/overtalk/qnet/packet"
+)
+
+// IVersionRouteEnabler enable or disable some routes by the proto version too,
+// a Router prefers it to IRouteEnabler.
+type IVersionRouteEnabler interface {
+	IRouteEnabler
+	EnabledVersion(mid, aid, ver uint8) bool
+}
+
+// RouteRules the disabled routes, it's the json format of a rule file, eg:
+// {"modules": [12], "actions": [[13, 1], [13, 2]], "versions": [1]}
+type RouteRules struct {
+	Modules  []int    `json:"modules,omitempty"`  // disabled modules
+	Actions  [][2]int `json:"actions,omitempty"`  // disabled [mid, aid] pairs
+	Versions []int    `json:"versions,omitempty"` // disabled proto versions
+}
+
+func checkRuleID(kind string, id int) error {
+	if id < 0 || id > 0xFF {
+		return fmt.Errorf("route rules: invalid %s(%d)", kind, id)
+	}
+	return nil
+}
+
+// RuleEnabler a concurrent safely IRouteEnabler whose rules can be changed at
+// runtime, all requests to a disabled route are counted.
+type RuleEnabler struct {
+	lock     sync.RWMutex
+	modules  map[uint8]bool
+	actions  map[uint16]bool
+	versions map[uint8]bool
+
+	hitLock sync.Mutex
+	hits    map[uint16]uint64
+}
+
+var _ IVersionRouteEnabler = (*RuleEnabler)(nil)
+
+// NewRuleEnabler create a RuleEnabler struct, all routes are enabled
+func NewRuleEnabler() *RuleEnabler {
+	return &RuleEnabler{
+		modules:  map[uint8]bool{},
+		actions:  map[uint16]bool{},
+		versions: map[uint8]bool{},
+		hits:     map[uint16]uint64{},
+	}
+}
+
+// Enabled check whether the route is enabled
+func (e *RuleEnabler) Enabled(mid, aid uint8) bool {
+	disabled := e.disabled(mid, aid)
+	if disabled {
+		e.hit(mid, aid)
+	}
+	return !disabled
+}
+
+// disabled check whether the route is disabled without counting a hit
+func (e *RuleEnabler) disabled(mid, aid uint8) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.modules[mid] || e.actions[packet.MakeProtoID(mid, aid)]
+}
+
+// EnabledVersion check whether the route is enabled for the proto version
+func (e *RuleEnabler) EnabledVersion(mid, aid, ver uint8) bool {
+	e.lock.RLock()
+	disabled := e.versions[ver] || e.modules[mid] || e.actions[packet.MakeProtoID(mid, aid)]
+	e.lock.RUnlock()
+	if disabled {
+		e.hit(mid, aid)
+	}
+	return !disabled
+}
+
+func (e *RuleEnabler) hit(mid, aid uint8) {
+	e.hitLock.Lock()
+	e.hits[packet.MakeProtoID(mid, aid)]++
+	e.hitLock.Unlock()
+}
+
+// DisabledHits get the number of the rejected requests for each route,
+// the key is made by packet.MakeProtoID.
+func (e *RuleEnabler) DisabledHits() map[uint16]uint64 {
+	e.hitLock.Lock()
+	hits := make(map[uint16]uint64, len(e.hits))
+	for k, v := range e.hits {
+		hits[k] = v
+	}
+	e.hitLock.Unlock()
+	return hits
+}
+
+// ResetHits clear all counters of the rejected requests
+func (e *RuleEnabler) ResetHits() {
+	e.hitLock.Lock()
+	e.hits = map[uint16]uint64{}
+	e.hitLock.Unlock()
+}
+
+// SetModule enable or disable a module
+func (e *RuleEnabler) SetModule(mid uint8, enabled bool) {
+	e.lock.Lock()
+	if enabled {
+		delete(e.modules, mid)
+	} else {
+		e.modules[mid] = true
+	}
+	e.lock.Unlock()
+}
+
+// SetAction enable or disable an action of a module
+func (e *RuleEnabler) SetAction(mid, aid uint8, enabled bool) {
+	protoID := packet.MakeProtoID(mid, aid)
+	e.lock.Lock()
+	if enabled {
+		delete(e.actions, protoID)
+	} else {
+		e.actions[protoID] = true
+	}
+	e.lock.Unlock()
+}
+
+// SetVersion enable or disable a proto version
+func (e *RuleEnabler) SetVersion(ver uint8, enabled bool) {
+	e.lock.Lock()
+	if enabled {
+		delete(e.versions, ver)
+	} else {
+		e.versions[ver] = true
+	}
+	e.lock.Unlock()
+}
+
+// SetRules replace all rules, the old rules are kept if any rule is invalid
+func (e *RuleEnabler) SetRules(rules RouteRules) error {
+	modules := make(map[uint8]bool, len(rules.Modules))
+	for _, mid := range rules.Modules {
+		if err := checkRuleID("mid", mid); err != nil {
+			return err
+		}
+		modules[uint8(mid)] = true
+	}
+	actions := make(map[uint16]bool, len(rules.Actions))
+	for _, act := range rules.Actions {
+		if err := checkRuleID("mid", act[0]); err != nil {
+			return err
+		}
+		if err := checkRuleID("aid", act[1]); err != nil {
+			return err
+		}
+		actions[packet.MakeProtoID(uint8(act[0]), uint8(act[1]))] = true
+	}
+	versions := make(map[uint8]bool, len(rules.Versions))
+	for _, ver := range rules.Versions {
+		if err := checkRuleID("version", ver); err != nil {
+			return err
+		}
+		versions[uint8(ver)] = true
+	}
+
+	e.lock.Lock()
+	e.modules, e.actions, e.versions = modules, actions, versions
+	e.lock.Unlock()
+	return nil
+}
+
+// Rules get a copy of the current rules
+func (e *RuleEnabler) Rules() RouteRules {
+	var rules RouteRules
+	e.lock.RLock()
+	for mid := range e.modules {
+		rules.Modules = append(rules.Modules, int(mid))
+	}
+	for protoID := range e.actions {
+		mid, aid := packet.SplitProtoID(protoID)
+		rules.Actions = append(rules.Actions, [2]int{int(mid), int(aid)})
+	}
+	for ver := range e.versions {
+		rules.Versions = append(rules.Versions, int(ver))
+	}
+	e.lock.RUnlock()
+	return rules
+}
+
+// LoadFile load the rules from a json file
+func (e *RuleEnabler) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rules RouteRules
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("route rules: parse %s: %v", path, err)
+	}
+	return e.SetRules(rules)
+}
+
+// WatchFile reload the rules once the json file is changed, the file is
+// checked every interval, and the onError is called if failed to reload.
+// Call the returned function to stop watching.
+func (e *RuleEnabler) WatchFile(path string, interval time.Duration, onError func(error)) (stop func()) {
+	sigClose := make(chan struct{})
+	var once sync.Once
+	stop = func() { once.Do(func() { close(sigClose) }) }
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				//TODO : log
+			}
+		}()
+
+		var lastMod time.Time
+		var lastSize int64 = -1
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			info, err := os.Stat(path)
+			if err == nil && (!info.ModTime().Equal(lastMod) || info.Size() != lastSize) {
+				lastMod, lastSize = info.ModTime(), info.Size()
+				err = e.LoadFile(path)
+			}
+			if err != nil && onError != nil {
+				onError(err)
+			}
+			select {
+			case <-ticker.C:
+			case <-sigClose:
+				return
+			}
+		}
+	}()
+	return stop
+}
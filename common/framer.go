@@ -0,0 +1,255 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// error definitions
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrInvalidFrame  = errors.New("invalid frame")
+)
+
+// IFramer split a stream into frames. A frame is read as a whole including its
+// length prefix or delimiter, so that a frame of the default framer is a
+// packet, and the other framers carry a packet as the payload, see
+// FramePacket and AppendPacketFrame.
+type IFramer interface {
+	// ReadFrame read a frame into a buffer allocated by alloc,
+	// alloc returns nil if the size is too large.
+	ReadFrame(r io.Reader, alloc func(size int) []byte) ([]byte, error)
+	// Payload get the payload of a frame
+	Payload(frame []byte) []byte
+	// AppendFrame append a frame of the payload to dst
+	AppendFrame(dst, payload []byte) ([]byte, error)
+}
+
+// DefaultFramer the 2-bytes big-endian length prefix of a packet
+var DefaultFramer IFramer = NewLengthFramer(2, binary.BigEndian)
+
+// lengthFramer a frame is a fixed size length prefix followed by the payload
+type lengthFramer struct {
+	size  int
+	order binary.ByteOrder
+}
+
+// NewLengthFramer create a framer with a 2 or 4 bytes length prefix,
+// the length doesn't count the prefix itself.
+func NewLengthFramer(size int, order binary.ByteOrder) IFramer {
+	if size != 2 && size != 4 {
+		panic(fmt.Sprintf("invalid length prefix size(%d)", size))
+	}
+	return &lengthFramer{size: size, order: order}
+}
+
+func (f *lengthFramer) ReadFrame(r io.Reader, alloc func(int) []byte) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:f.size]); err != nil {
+		return nil, err
+	}
+	var size int
+	if f.size == 2 {
+		size = int(f.order.Uint16(header[:2]))
+	} else {
+		size = int(f.order.Uint32(header[:4]))
+		if size < 0 || size > maxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+	}
+	frame := alloc(f.size + size)
+	if len(frame) == 0 {
+		return nil, ErrFrameTooLarge
+	}
+	copy(frame, header[:f.size])
+	if _, err := io.ReadFull(r, frame[f.size:f.size+size]); err != nil {
+		return nil, err
+	}
+	return frame[:f.size+size], nil
+}
+
+func (f *lengthFramer) Payload(frame []byte) []byte { return frame[f.size:] }
+
+func (f *lengthFramer) AppendFrame(dst, payload []byte) ([]byte, error) {
+	var header [4]byte
+	if f.size == 2 {
+		if len(payload) > 0xFFFF {
+			return dst, ErrFrameTooLarge
+		}
+		f.order.PutUint16(header[:2], uint16(len(payload)))
+	} else {
+		if len(payload) > maxFrameSize {
+			return dst, ErrFrameTooLarge
+		}
+		f.order.PutUint32(header[:4], uint32(len(payload)))
+	}
+	dst = append(dst, header[:f.size]...)
+	return append(dst, payload...), nil
+}
+
+// the maximum size of a frame payload before allocating it
+const maxFrameSize = 1<<31 - 1
+
+// varintFramer a frame is a uvarint length prefix followed by the payload
+type varintFramer struct{}
+
+// VarintFramer a framer with a uvarint length prefix, eg: protobuf delimited
+var VarintFramer IFramer = varintFramer{}
+
+// readByte read a byte by an io.ByteReader if possible
+func readByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+func (varintFramer) ReadFrame(r io.Reader, alloc func(int) []byte) ([]byte, error) {
+	var header [binary.MaxVarintLen32]byte
+	n := 0
+	for {
+		b, err := readByte(r)
+		if err != nil {
+			return nil, err
+		}
+		header[n] = b
+		n++
+		if b < 0x80 {
+			break
+		}
+		if n == len(header) {
+			return nil, ErrInvalidFrame
+		}
+	}
+	size, _ := binary.Uvarint(header[:n])
+	if size > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	frame := alloc(n + int(size))
+	if len(frame) == 0 {
+		return nil, ErrFrameTooLarge
+	}
+	copy(frame, header[:n])
+	if _, err := io.ReadFull(r, frame[n:n+int(size)]); err != nil {
+		return nil, err
+	}
+	return frame[:n+int(size)], nil
+}
+
+func (varintFramer) Payload(frame []byte) []byte {
+	_, n := binary.Uvarint(frame)
+	if n <= 0 {
+		return nil
+	}
+	return frame[n:]
+}
+
+func (varintFramer) AppendFrame(dst, payload []byte) ([]byte, error) {
+	if len(payload) > maxFrameSize {
+		return dst, ErrFrameTooLarge
+	}
+	var header [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(header[:], uint64(len(payload)))
+	dst = append(dst, header[:n]...)
+	return append(dst, payload...), nil
+}
+
+// delimiterFramer a frame is the payload followed by a delimiter
+type delimiterFramer struct {
+	delimiter []byte
+	maxSize   int
+}
+
+// NewDelimiterFramer create a framer ending each frame by a delimiter,
+// eg: "\n" or "\r\n", a frame without the delimiter is at most maxSize bytes.
+// The payload mustn't contain the delimiter.
+func NewDelimiterFramer(delimiter []byte, maxSize int) IFramer {
+	if len(delimiter) == 0 {
+		panic("empty frame delimiter")
+	}
+	return &delimiterFramer{delimiter: append([]byte{}, delimiter...), maxSize: maxSize}
+}
+
+func (f *delimiterFramer) ReadFrame(r io.Reader, alloc func(int) []byte) ([]byte, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, f.delimiter) {
+		if len(line) >= f.maxSize+len(f.delimiter) {
+			return nil, ErrFrameTooLarge
+		}
+		b, err := readByte(r)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	frame := alloc(len(line))
+	if len(frame) == 0 {
+		return nil, ErrFrameTooLarge
+	}
+	return frame[:copy(frame, line)], nil
+}
+
+func (f *delimiterFramer) Payload(frame []byte) []byte {
+	return bytes.TrimSuffix(frame, f.delimiter)
+}
+
+func (f *delimiterFramer) AppendFrame(dst, payload []byte) ([]byte, error) {
+	if len(payload) > f.maxSize {
+		return dst, ErrFrameTooLarge
+	}
+	if bytes.Contains(payload, f.delimiter) {
+		return dst, ErrInvalidFrame
+	}
+	dst = append(dst, payload...)
+	return append(dst, f.delimiter...), nil
+}
+
+// FramePacket get the packet of a frame, it's the frame itself of
+// DefaultFramer, or the payload of the other framers.
+func FramePacket(framer IFramer, frame []byte) []byte {
+	if framer == DefaultFramer {
+		return frame
+	}
+	return framer.Payload(frame)
+}
+
+// AppendPacketFrame append a frame of the packet to dst, see FramePacket
+func AppendPacketFrame(framer IFramer, dst, pack []byte) ([]byte, error) {
+	if framer == DefaultFramer {
+		return append(dst, pack...), nil
+	}
+	return framer.AppendFrame(dst, pack)
+}
+
+// IFramedConn a connection telling the framer of its stream
+type IFramedConn interface {
+	net.Conn
+	Framer() IFramer
+}
+
+type framedConn struct {
+	net.Conn
+	framer IFramer
+}
+
+func (c *framedConn) Framer() IFramer { return c.framer }
+
+// NewFramedConn wrap a connection with the framer of its stream
+func NewFramedConn(nc net.Conn, framer IFramer) net.Conn {
+	return &framedConn{Conn: nc, framer: framer}
+}
+
+// ConnFramer get the framer of a connection, it's DefaultFramer if the
+// connection doesn't tell it.
+func ConnFramer(nc net.Conn) IFramer {
+	if fc, ok := nc.(IFramedConn); ok && fc.Framer() != nil {
+		return fc.Framer()
+	}
+	return DefaultFramer
+}
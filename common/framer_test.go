@@ -0,0 +1,83 @@
+package common_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/slab"
+)
+
+func TestFramers(t *testing.T) {
+	framers := map[string]common.IFramer{
+		"length2-be": common.NewLengthFramer(2, binary.BigEndian),
+		"length2-le": common.NewLengthFramer(2, binary.LittleEndian),
+		"length4-be": common.NewLengthFramer(4, binary.BigEndian),
+		"length4-le": common.NewLengthFramer(4, binary.LittleEndian),
+		"varint":     common.VarintFramer,
+		"delimiter":  common.NewDelimiterFramer([]byte("\r\n"), 1024),
+	}
+	payloads := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), 300)}
+	for name, framer := range framers {
+		var stream []byte
+		for _, payload := range payloads {
+			var err error
+			if stream, err = framer.AppendFrame(stream, payload); err != nil {
+				t.Fatalf("%s: append: %v", name, err)
+			}
+		}
+		for _, r := range []interface{ Read([]byte) (int, error) }{
+			bytes.NewReader(stream), bufio.NewReader(bytes.NewReader(stream)),
+		} {
+			for i, payload := range payloads {
+				buffer := common.NewFramedPacketBuffer(1024, &slab.NoPool{}, framer)
+				if _, err := buffer.ReadFrom(r); err != nil {
+					t.Fatalf("%s: read frame %d: %v", name, i, err)
+				}
+				// the buffer strips the frame
+				if got := buffer.Bytes(); !bytes.Equal(got, payload) {
+					t.Fatalf("%s: frame %d: %q", name, i, got)
+				}
+			}
+		}
+		// the whole frame is limited by the buffer
+		buffer := common.NewFramedPacketBuffer(100, &slab.NoPool{}, framer)
+		frame, _ := framer.AppendFrame(nil, payloads[2])
+		if _, err := buffer.ReadFrom(bytes.NewReader(frame)); err == nil {
+			t.Fatalf("%s: oversized frame", name)
+		}
+	}
+
+	delimiter := common.NewDelimiterFramer([]byte("\n"), 10)
+	if _, err := delimiter.AppendFrame(nil, []byte("a\nb")); err != common.ErrInvalidFrame {
+		t.Fatalf("delimiter in payload: %v", err)
+	}
+	if _, err := common.NewLengthFramer(2, binary.BigEndian).AppendFrame(nil, make([]byte, 70000)); err != common.ErrFrameTooLarge {
+		t.Fatalf("length2 oversized payload: %v", err)
+	}
+}
+
+func TestDefaultFramer(t *testing.T) {
+	pack := packet.NewFromData([]byte("hello"), nil, packet.NoneCompresser)
+	buffer := common.NewPacketBuffer(packet.MaxPacketSize, &slab.NoPool{})
+	if _, err := buffer.ReadFrom(bytes.NewReader(pack)); err != nil || !bytes.Equal(buffer.Bytes(), pack) {
+		t.Fatalf("packet frame: %v", err)
+	}
+	if frame, _ := common.DefaultFramer.AppendFrame(nil, pack[2:]); !bytes.Equal(frame, pack) {
+		t.Fatalf("append packet frame: %v", frame)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if common.ConnFramer(server) != common.DefaultFramer {
+		t.Fatal("default conn framer")
+	}
+	if common.ConnFramer(common.NewFramedConn(server, common.VarintFramer)) != common.VarintFramer {
+		t.Fatal("framed conn")
+	}
+}
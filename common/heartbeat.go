@@ -0,0 +1,145 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/overtalk/qnet/packet"
+)
+
+// Heartbeat the heartbeat policy of a connection, a zero duration disables
+// the feature.
+type Heartbeat struct {
+	// PingInterval send a ping carrying the sending time every interval,
+	// the peer replies a pong to measure the RTT, see packet.NewPingCmd.
+	PingInterval time.Duration
+	// DeadTimeout the peer is dead if nothing is read in the timeout,
+	// the pings and the pongs keep it alive.
+	DeadTimeout time.Duration
+	// IdleTimeout the connection is closed if no packet but the cmds is
+	// read in the timeout, eg: a client only pinging.
+	IdleTimeout time.Duration
+	// WriteTimeout the timeout of writing the packets
+	WriteTimeout time.Duration
+}
+
+// DefaultHeartbeat the default heartbeat policy, a peer pinging every
+// 18 seconds is alive, and it's dead if nothing is read in 20 seconds.
+var DefaultHeartbeat = Heartbeat{
+	PingInterval: 18 * time.Second,
+	DeadTimeout:  20 * time.Second,
+	WriteTimeout: 10 * time.Second,
+}
+
+// tick get the interval of pinging and checking the timeouts
+func (hb Heartbeat) tick() time.Duration {
+	tick := hb.PingInterval
+	for _, timeout := range []time.Duration{hb.DeadTimeout / 2, hb.IdleTimeout / 2} {
+		if timeout > 0 && (tick <= 0 || timeout < tick) {
+			tick = timeout
+		}
+	}
+	return tick
+}
+
+// HeartbeatState the heartbeat state of a connection, it's concurrent safely
+type HeartbeatState struct {
+	policy Heartbeat
+	// the unix nano time of the last read packet, and the last non-cmd one
+	lastRead    int64
+	lastRequest int64
+	lastPing    int64
+	rtt         int64
+	started     int32
+}
+
+// NewHeartbeatState create a HeartbeatState struct of the policy
+func NewHeartbeatState(policy Heartbeat) *HeartbeatState {
+	now := time.Now().UnixNano()
+	return &HeartbeatState{policy: policy, lastRead: now, lastRequest: now}
+}
+
+// Policy get the heartbeat policy
+func (s *HeartbeatState) Policy() Heartbeat { return s.policy }
+
+// Apply set the timeouts of a connection, a read blocks at most DeadTimeout
+func (s *HeartbeatState) Apply(conn *BaseConn) {
+	conn.SetReadTimeout(s.policy.DeadTimeout)
+	conn.SetWriteTimeout(s.policy.WriteTimeout)
+}
+
+// Touch record a packet read from the peer, it may be encrypted, see
+// packet.Packet.IsCmd.
+func (s *HeartbeatState) Touch(pack packet.Packet) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&s.lastRead, now)
+	if pack.IsValid() && !pack.IsCmd() {
+		atomic.StoreInt64(&s.lastRequest, now)
+	}
+}
+
+// RTT get the last measured round-trip time, it's 0 before the first pong
+func (s *HeartbeatState) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// Handle handle a ping or a pong from the peer, it returns the pong of a ping
+// carrying the sending time, or nil. A pong updates the RTT.
+func (s *HeartbeatState) Handle(pack packet.Packet) packet.Packet {
+	sent, ok := packet.ParsePingTime(pack)
+	if !ok {
+		return nil
+	}
+	switch pack.GetCmd() {
+	case packet.CmdPing:
+		return packet.NewPongCmd(pack)
+	case packet.CmdPong:
+		if rtt := time.Since(sent); rtt >= 0 {
+			atomic.StoreInt64(&s.rtt, int64(rtt))
+		}
+	}
+	return nil
+}
+
+// Check check the timeouts, and send a ping by the ping func if it's time to,
+// it returns false if the peer is dead or idle.
+func (s *HeartbeatState) Check(now time.Time, ping func(packet.Packet) error) bool {
+	nano := now.UnixNano()
+	if timeout := s.policy.DeadTimeout; timeout > 0 && nano-atomic.LoadInt64(&s.lastRead) > int64(timeout) {
+		return false
+	}
+	if timeout := s.policy.IdleTimeout; timeout > 0 && nano-atomic.LoadInt64(&s.lastRequest) > int64(timeout) {
+		return false
+	}
+	if interval := s.policy.PingInterval; interval > 0 && nano-atomic.LoadInt64(&s.lastPing) >= int64(interval) {
+		atomic.StoreInt64(&s.lastPing, nano)
+		return ping(packet.NewPingCmd(0, now)) == nil
+	}
+	return true
+}
+
+// Run start a goroutine pinging and checking the timeouts until sigClose is
+// closed, close is called if the peer is dead or idle, or a ping fails. It
+// runs once, and never starts without a timeout or pinging.
+func (s *HeartbeatState) Run(ping func(packet.Packet) error, close func(), sigClose <-chan struct{}) {
+	tick := s.policy.tick()
+	if tick <= 0 || !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return
+	}
+	atomic.StoreInt64(&s.lastPing, time.Now().UnixNano())
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if !s.Check(now, ping) {
+					close()
+					return
+				}
+			case <-sigClose:
+				return
+			}
+		}
+	}()
+}
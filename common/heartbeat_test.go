@@ -0,0 +1,81 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+)
+
+func TestHeartbeatPingPong(t *testing.T) {
+	s := common.NewHeartbeatState(common.Heartbeat{PingInterval: time.Second})
+	var ping packet.Packet
+	if !s.Check(time.Now().Add(time.Second), func(p packet.Packet) error { ping = p; return nil }) || ping == nil {
+		t.Fatal("no ping sent")
+	}
+	if ping.GetCmd() != packet.CmdPing {
+		t.Fatalf("cmd: %d", ping.GetCmd())
+	}
+
+	// the peer echoes the time by a pong
+	pong := common.NewHeartbeatState(common.Heartbeat{}).Handle(ping)
+	if pong == nil || pong.GetCmd() != packet.CmdPong {
+		t.Fatalf("pong: %v", pong)
+	}
+	if reply := s.Handle(packet.NewPongCmd(packet.NewPingCmd(0, time.Now().Add(-50*time.Millisecond)))); reply != nil {
+		t.Fatalf("reply a pong: %v", reply)
+	}
+	if rtt := s.RTT(); rtt < 50*time.Millisecond || rtt > time.Second {
+		t.Errorf("rtt: %v", rtt)
+	}
+	// a ping without the time is never replied
+	if reply := s.Handle(packet.PingPacket); reply != nil {
+		t.Errorf("reply a PingPacket: %v", reply)
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	noPing := func(packet.Packet) error { t.Fatal("unexpected ping"); return nil }
+	s := common.NewHeartbeatState(common.Heartbeat{DeadTimeout: time.Second})
+	now := time.Now()
+	if !s.Check(now, noPing) {
+		t.Fatal("a new peer is dead")
+	}
+	if s.Check(now.Add(1500*time.Millisecond), noPing) {
+		t.Fatal("a dead peer is alive")
+	}
+	// a ping keeps the peer alive
+	s.Touch(packet.PingPacket)
+	if !s.Check(time.Now().Add(900*time.Millisecond), noPing) {
+		t.Fatal("the pinging peer is dead")
+	}
+
+	// the pings don't keep an idle peer
+	s = common.NewHeartbeatState(common.Heartbeat{IdleTimeout: time.Second})
+	s.Touch(packet.PingPacket)
+	if s.Check(time.Now().Add(1500*time.Millisecond), noPing) {
+		t.Fatal("an idle peer is alive")
+	}
+	request, err := packet.NewBuilder(1, 1).Data([]byte("hello")).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.Touch(request)
+	if !s.Check(now.Add(1005*time.Millisecond), noPing) {
+		t.Error("an active peer is idle")
+	}
+
+	// an encrypted request whose MID equals the secret is not a cmd
+	packet.SetCryptoSecret([]byte{0x21, 0x43})
+	request, _ = packet.NewBuilder(0x21, 0x05).Data([]byte("hello")).Build()
+	encrypted, _ := request.Encrypt(packet.XORCrypto)
+	s = common.NewHeartbeatState(common.Heartbeat{IdleTimeout: time.Second})
+	now = time.Now()
+	time.Sleep(10 * time.Millisecond)
+	s.Touch(encrypted)
+	if !s.Check(now.Add(1005*time.Millisecond), noPing) {
+		t.Error("an encrypted request is taken as a cmd")
+	}
+}
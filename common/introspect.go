@@ -0,0 +1,112 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// DuplicatePolicy decide what to do with a duplicate registration
+type DuplicatePolicy uint8
+
+const (
+	// DuplicateError skip the duplicate modules, register the others and
+	// return the ErrDuplicateRoute errors joined, it's the default policy
+	DuplicateError DuplicatePolicy = iota
+	// DuplicatePanic panic with an ErrDuplicateRoute error
+	DuplicatePanic
+)
+
+// IActionLister list all actions of a module,
+// a Router checks the duplicate actions and describes them by it.
+type IActionLister interface {
+	Actions() []IAction
+}
+
+// RouteInfo the description of a registered route
+type RouteInfo struct {
+	MID     uint8  `json:"mid"`
+	AID     uint8  `json:"aid"`
+	MinVer  uint8  `json:"min_ver"`
+	MaxVer  uint8  `json:"max_ver"`
+	Handler string `json:"handler"`
+	Enabled bool   `json:"enabled"`
+	Timeout string `json:"timeout,omitempty"`
+	// Opaque the module doesn't list its actions, AID is meaningless
+	Opaque bool `json:"opaque,omitempty"`
+}
+
+// handlerName get the type name of an action
+func handlerName(act IAction) string {
+	if va, ok := act.(*versionAction); ok {
+		return fmt.Sprintf("%T", va.IAction)
+	}
+	return fmt.Sprintf("%T", act)
+}
+
+// routeEnabled check whether a route is enabled for the introspection,
+// a RuleEnabler doesn't count it as a hit.
+func (router *Router) routeEnabled(mid, aid uint8) bool {
+	if e, ok := router.enabler.(*RuleEnabler); ok {
+		return !e.disabled(mid, aid)
+	}
+	return router.enabler.Enabled(mid, aid)
+}
+
+// Routes list all registered routes ordered by the mid, aid and proto version
+func (router *Router) Routes() []RouteInfo {
+	var timeout string
+	if router.timeout != nil {
+		timeout = router.timeout.Timeout().String()
+	}
+
+	var routes []RouteInfo
+	for mid, m := range router.modules {
+		lister, ok := m.(IActionLister)
+		if !ok {
+			routes = append(routes, RouteInfo{
+				MID:     mid,
+				MinVer:  0,
+				MaxVer:  0xFF,
+				Handler: fmt.Sprintf("%T", m),
+				Enabled: router.routeEnabled(mid, 0),
+				Timeout: timeout,
+				Opaque:  true,
+			})
+			continue
+		}
+		for _, act := range lister.Actions() {
+			aid := act.GetAID()
+			minVer, maxVer := actionVersion(act)
+			routes = append(routes, RouteInfo{
+				MID:     mid,
+				AID:     aid,
+				MinVer:  minVer,
+				MaxVer:  maxVer,
+				Handler: handlerName(act),
+				Enabled: router.routeEnabled(mid, aid),
+				Timeout: timeout,
+			})
+		}
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.MID != b.MID {
+			return a.MID < b.MID
+		}
+		if a.AID != b.AID {
+			return a.AID < b.AID
+		}
+		return a.MinVer < b.MinVer
+	})
+	return routes
+}
+
+// DumpRoutes write all registered routes as an indented json array
+func (router *Router) DumpRoutes(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(router.Routes())
+}
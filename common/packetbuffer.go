@@ -23,74 +23,67 @@ type IPacketBuffer interface {
 // A basePacketBuffer with a buffer and valid size
 type basePacketBuffer struct {
 	data    []byte
+	packet  []byte // the packet of the frame
 	maxSize int
 	pool    slab.Pool
+	framer  IFramer
 }
 
 var _ IPacketBuffer = (*basePacketBuffer)(nil)
 
 // NewPacketBuffer create a IPacketBuffer interface
 func NewPacketBuffer(maxSize int, pool slab.Pool) IPacketBuffer {
-	return &basePacketBuffer{data: nil, maxSize: maxSize, pool: pool}
+	return NewFramedPacketBuffer(maxSize, pool, DefaultFramer)
+}
+
+// NewFramedPacketBuffer create a IPacketBuffer interface reading a frame of
+// the framer, maxSize limits the whole frame, and Bytes gets its packet,
+// see FramePacket.
+func NewFramedPacketBuffer(maxSize int, pool slab.Pool, framer IFramer) IPacketBuffer {
+	return &basePacketBuffer{data: nil, maxSize: maxSize, pool: pool, framer: framer}
 }
 
 // Alloc get the underlying buffer
-func (buf *basePacketBuffer) alloc(size int) {
+func (buf *basePacketBuffer) alloc(size int) []byte {
 	if size > buf.maxSize {
-		return
+		return nil
 	}
 	if buf.pool != nil {
 		buf.data = buf.pool.Alloc(size)
 	} else {
 		buf.data = make([]byte, size)
 	}
+	return buf.data
 }
 
 // ReadPacket read a packet of data from a Reader
 func (buf *basePacketBuffer) ReadFrom(r io.Reader) (int, error) {
-	var sizeHeader [2]byte
-	// read data length(2 bytes)
-	nn, err := io.ReadFull(r, sizeHeader[:2])
+	frame, err := buf.framer.ReadFrame(r, buf.alloc)
 	if err != nil {
+		if err == ErrFrameTooLarge {
+			return 0, fmt.Errorf("invalid packet size(>%d)", buf.maxSize)
+		}
 		return 0, err
 	}
-	if nn != 2 {
-		return 0, fmt.Errorf("read packet size, invalid size(%d!=2)", nn)
-	}
-
-	// read payload(N bytes)
-	size := int(sizeHeader[0])<<8 + int(sizeHeader[1])
-	buf.alloc(2 + size)
-	if len(buf.data) == 0 {
-		return 0, fmt.Errorf("invalid packet size(%d>%d)", size, buf.maxSize-2)
-	}
-
-	buf.data[0], buf.data[1] = sizeHeader[0], sizeHeader[1]
-	nn, err = io.ReadFull(r, buf.data[2:2+size])
-	if err != nil {
-		return 0, err
-	}
-
-	if nn != size {
-		return 0, fmt.Errorf("read packet, invalid size(%d!=%d)", nn, size)
-	}
-	return 2 + nn, nil
+	buf.data = frame
+	buf.packet = FramePacket(buf.framer, frame)
+	return len(frame), nil
 }
 
 // Bytes get the real data bytes
 func (buf *basePacketBuffer) Bytes() []byte {
-	return buf.data
+	return buf.packet
 }
 
 // Clone clone the underlying data excluding the buf field
 func (buf *basePacketBuffer) Clone() IPacketBuffer {
-	return &basePacketBuffer{data: nil, maxSize: buf.maxSize, pool: buf.pool}
+	return &basePacketBuffer{data: nil, maxSize: buf.maxSize, pool: buf.pool, framer: buf.framer}
 }
 
 // Free release the buffer to its pool
 func (buf *basePacketBuffer) Free() {
 	if buf.pool != nil && buf.data != nil {
 		buf.pool.Free(buf.data)
-		buf.data = nil
+		buf.data, buf.packet = nil, nil
 	}
 }
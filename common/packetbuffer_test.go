@@ -0,0 +1,46 @@
+package common_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/slab"
+)
+
+func FuzzPacketBufferReadFrom(f *testing.F) {
+	f.Add([]byte(packet.NewFromData([]byte("hello"), nil, packet.NoneCompresser)), uint8(0))
+	f.Add([]byte{0, 0}, uint8(1))
+	f.Add([]byte("hello\r\n"), uint8(5))
+	framers := []common.IFramer{
+		common.DefaultFramer,
+		common.NewLengthFramer(2, binary.LittleEndian),
+		common.NewLengthFramer(4, binary.BigEndian),
+		common.NewLengthFramer(4, binary.LittleEndian),
+		common.VarintFramer,
+		common.NewDelimiterFramer([]byte("\r\n"), 1024),
+	}
+	f.Fuzz(func(t *testing.T, b []byte, i uint8) {
+		framer := framers[int(i)%len(framers)]
+		buffer := common.NewFramedPacketBuffer(1024, &slab.NoPool{}, framer)
+		n, err := buffer.ReadFrom(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		frame, payload := b[:n], buffer.Bytes()
+		if n > 1024 || !bytes.Equal(payload, common.FramePacket(framer, frame)) {
+			t.Fatalf("packet %v of %v", payload, b)
+		}
+		// the packet is framed back by the framer
+		out, err := common.AppendPacketFrame(framer, nil, payload)
+		if err != nil {
+			return
+		}
+		again := common.NewFramedPacketBuffer(1024, &slab.NoPool{}, framer)
+		if _, err = again.ReadFrom(bytes.NewReader(out)); err != nil || !bytes.Equal(again.Bytes(), payload) {
+			t.Fatalf("append frame %v: %v, %v", frame, out, err)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"errors"
+	"sync"
+)
+
+// error definitions
+var (
+	ErrNoSeq    = errors.New("missing sequence number")
+	ErrReplayed = errors.New("replayed request")
+)
+
+// ISeqRequest a request which may have a sequence number
+type ISeqRequest interface {
+	IRequest
+	GetSeq() uint32
+	HasSequence() bool
+}
+
+// ReplayWindowFunc get the replay window of the session
+// which the request belongs to
+type ReplayWindowFunc func(IRequest) *ReplayWindow
+
+// ReplayWindow a sliding window of the accepted sequence numbers of a
+// session, a client increases the sequence number of each request, and the
+// requests arriving out of order are accepted if they are still in the window.
+// NOTE: the sequence number mustn't wrap, renew the session before it.
+type ReplayWindow struct {
+	lock   sync.Mutex
+	size   uint32
+	max    uint32
+	bitmap []uint64 // the bit of seq is seq%size
+}
+
+// NewReplayWindow create a ReplayWindow struct, size is rounded up to 64x
+func NewReplayWindow(size int) *ReplayWindow {
+	words := (size + 63) / 64
+	if words < 1 {
+		words = 1
+	}
+	return &ReplayWindow{size: uint32(words * 64), bitmap: make([]uint64, words)}
+}
+
+func (w *ReplayWindow) bit(seq uint32) (int, uint64) {
+	i := seq % w.size
+	return int(i / 64), 1 << (i % 64)
+}
+
+// Accept check whether the sequence number is new and record it, it's false
+// for a replayed one or the one too old to check, and 0 is never accepted.
+func (w *ReplayWindow) Accept(seq uint32) bool {
+	if seq == 0 {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if seq > w.max {
+		// slide the window, and clear the bits of the skipped numbers
+		if seq-w.max >= w.size {
+			for i := range w.bitmap {
+				w.bitmap[i] = 0
+			}
+		} else {
+			for n := w.max + 1; n < seq; n++ {
+				i, mask := w.bit(n)
+				w.bitmap[i] &^= mask
+			}
+		}
+		w.max = seq
+		i, mask := w.bit(seq)
+		w.bitmap[i] |= mask
+		return true
+	}
+	if w.max-seq >= w.size {
+		return false
+	}
+	i, mask := w.bit(seq)
+	if w.bitmap[i]&mask != 0 {
+		return false
+	}
+	w.bitmap[i] |= mask
+	return true
+}
+
+// Max get the largest accepted sequence number
+func (w *ReplayWindow) Max() uint32 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.max
+}
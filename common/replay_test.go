@@ -0,0 +1,105 @@
+package common_test
+
+import (
+	"testing"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+)
+
+type testSeqRequest struct {
+	testRequest
+	seq    uint32
+	hasSeq bool
+}
+
+func (r *testSeqRequest) GetSeq() uint32    { return r.seq }
+func (r *testSeqRequest) HasSequence() bool { return r.hasSeq }
+
+func TestReplayWindow(t *testing.T) {
+	window := common.NewReplayWindow(64)
+	for _, seq := range []uint32{1, 3, 2, 10, 5} {
+		if !window.Accept(seq) {
+			t.Fatalf("new seq %d rejected", seq)
+		}
+	}
+	for _, seq := range []uint32{0, 1, 3, 10} {
+		if window.Accept(seq) {
+			t.Fatalf("replayed seq %d accepted", seq)
+		}
+	}
+	if !window.Accept(70) || window.Max() != 70 {
+		t.Fatalf("slide: %d", window.Max())
+	}
+	// too old to check
+	if window.Accept(4) || window.Accept(6) {
+		t.Fatal("old seq accepted")
+	}
+	if !window.Accept(69) || !window.Accept(1000) || window.Accept(70) {
+		t.Fatal("window after sliding")
+	}
+}
+
+func TestRouterReplay(t *testing.T) {
+	packet.SetSignSecret([]byte("secret"))
+	window := common.NewReplayWindow(128)
+	verifier := common.NewSignVerifier(packet.HMACSha1Signature, nil).
+		RejectReplay(func(common.IRequest) *common.ReplayWindow { return window }).
+		RequireAction(1, 1)
+	router := common.NewRouter(common.OptionSignVerifier(verifier))
+	router.Register(common.NewModule(1, &echoAction{1}, &echoAction{2}))
+
+	data := []byte("claim reward")
+	sign, _ := packet.HMACSha1Signature.Sum(nil, packet.SeqSignData(7, data))
+	req := &testSeqRequest{testRequest{mid: 1, aid: 1, data: data, sign: sign}, 7, true}
+	if _, err := router.DispatchErr(req); err != nil {
+		t.Fatalf("signed request: %v", err)
+	}
+	if _, err := router.DispatchErr(req); err != common.ErrReplayed || verifier.Replayed() != 1 {
+		t.Fatalf("replayed request: %v, %d", err, verifier.Replayed())
+	}
+	// the sequence number is signed
+	req.seq = 8
+	if _, err := router.DispatchErr(req); err != packet.ErrInvalidSign {
+		t.Fatalf("changed seq: %v", err)
+	}
+	sign, _ = packet.HMACSha1Signature.Sum(nil, data)
+	if _, err := router.DispatchErr(&testRequest{mid: 1, aid: 1, data: data, sign: sign}); err != common.ErrNoSeq {
+		t.Fatalf("request without seq: %v", err)
+	}
+	if _, err := router.DispatchErr(&testRequest{mid: 1, aid: 2, data: data}); err != nil {
+		t.Fatalf("optional request: %v", err)
+	}
+}
+
+func TestSignVerifierSeq(t *testing.T) {
+	packet.SetSignSecret([]byte("secret"))
+	verifier := common.NewSignVerifier(packet.HMACSha1Signature, nil).RequireAll()
+	data := []byte("claim reward")
+	dataSign, _ := packet.HMACSha1Signature.Sum(nil, data)
+	seqSign, _ := packet.HMACSha1Signature.Sum(nil, packet.SeqSignData(7, data))
+
+	// without a replay window, the seq may be signed or not
+	for _, sign := range [][]byte{dataSign, seqSign} {
+		req := &testSeqRequest{testRequest{mid: 1, aid: 1, data: data, sign: sign}, 7, true}
+		if err := verifier.Verify(req); err != nil {
+			t.Fatalf("without a window: %v", err)
+		}
+	}
+	req := &testSeqRequest{testRequest{mid: 1, aid: 1, data: data, sign: seqSign}, 8, true}
+	if err := verifier.Verify(req); err != packet.ErrInvalidSign {
+		t.Fatalf("without a window, changed seq: %v", err)
+	}
+
+	// the seq must be signed with a replay window
+	window := common.NewReplayWindow(128)
+	verifier.RejectReplay(func(common.IRequest) *common.ReplayWindow { return window })
+	req = &testSeqRequest{testRequest{mid: 1, aid: 1, data: data, sign: dataSign}, 7, true}
+	if err := verifier.Verify(req); err != packet.ErrInvalidSign {
+		t.Fatalf("with a window, unsigned seq: %v", err)
+	}
+	req.sign = seqSign
+	if err := verifier.Verify(req); err != nil {
+		t.Fatalf("with a window: %v", err)
+	}
+}
@@ -1,6 +1,23 @@
 package common
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/overtalk/qnet/pool"
+)
+
+// error definitions
+var (
+	ErrModuleNotFound     = errors.New("route: module not found")
+	ErrActionNotFound     = errors.New("route: action not found")
+	ErrVersionUnsupported = errors.New("route: proto version unsupported")
+	ErrRouteDisabled      = errors.New("route: disabled")
+	ErrRouteTimeout       = errors.New("route: handle timeout")
+	ErrRouteBusy          = errors.New("route: busy")
+	ErrDuplicateRoute     = errors.New("route: duplicate registration")
+)
 
 // IOutProtocol protocol message
 type IOutProtocol interface {
@@ -63,14 +80,16 @@ var NoneModule IModule = &noneModule{}
 
 type baseModule struct {
 	mid     uint8
-	actions map[uint8]IAction
+	actions map[uint8][]IAction
 }
 
-// NewModule create a IModule instance
+// NewModule create a IModule instance, an action id can be registered several
+// times with different proto version ranges, see NewVersionAction.
 func NewModule(mid uint8, acts ...IAction) IModule {
-	modActions := make(map[uint8]IAction, len(acts))
+	modActions := make(map[uint8][]IAction, len(acts))
 	for _, v := range acts {
-		modActions[v.GetAID()] = v
+		aid := v.GetAID()
+		modActions[aid] = append(modActions[aid], v)
 	}
 	return &baseModule{mid: mid, actions: modActions}
 }
@@ -79,10 +98,27 @@ func (m *baseModule) GetMID() uint8 {
 	return m.mid
 }
 
-func (m *baseModule) Handle(r IRequest) IOutProtocol {
-	actionID := r.GetAID()
-	act, ok := m.actions[actionID]
+// Actions list all registered actions
+func (m *baseModule) Actions() []IAction {
+	var acts []IAction
+	for _, v := range m.actions {
+		acts = append(acts, v...)
+	}
+	return acts
+}
+
+// Resolve find the best matched action for the proto version
+func (m *baseModule) Resolve(aid, ver uint8, policy VersionPolicy) (IAction, error) {
+	acts, ok := m.actions[aid]
 	if !ok {
+		return nil, ErrActionNotFound
+	}
+	return resolveVersion(acts, ver, policy)
+}
+
+func (m *baseModule) Handle(r IRequest) IOutProtocol {
+	act, err := m.Resolve(r.GetAID(), r.GetProtoVer(), VersionReject)
+	if err != nil {
 		act = NoneAction
 		// TODO: log
 		//zaplog.S.Errorf("module %d: action(%d) not found", m.mid, actionID)
@@ -91,6 +127,8 @@ func (m *baseModule) Handle(r IRequest) IOutProtocol {
 }
 
 var _ IModule = (*baseModule)(nil)
+var _ IActionResolver = (*baseModule)(nil)
+var _ IActionLister = (*baseModule)(nil)
 
 // IRouteEnabler enable or disable some routes
 type IRouteEnabler interface {
@@ -114,6 +152,10 @@ type ITimeouter interface {
 type Router struct {
 	modules  map[uint8]IModule
 	enabler  IRouteEnabler
+	verifier ISignVerifier
+	policy   VersionPolicy
+	dupPanic bool
+	workers  *pool.WorkerPool
 	timeout  ITimeouter
 	noneResp IOutProtocol
 }
@@ -128,6 +170,37 @@ func OptionRouteEnabler(enabler IRouteEnabler) RouterOptionFunc {
 	}
 }
 
+// OptionSignVerifier set Router's signature verifier
+func OptionSignVerifier(verifier ISignVerifier) RouterOptionFunc {
+	return func(r *Router) {
+		r.verifier = verifier
+	}
+}
+
+// OptionVersionPolicy set Router's policy for the unsupported proto versions
+func OptionVersionPolicy(policy VersionPolicy) RouterOptionFunc {
+	return func(r *Router) {
+		r.policy = policy
+	}
+}
+
+// OptionDuplicatePolicy set what Register does with a duplicate module or
+// action, it returns an error by default.
+func OptionDuplicatePolicy(policy DuplicatePolicy) RouterOptionFunc {
+	return func(r *Router) {
+		r.dupPanic = policy == DuplicatePanic
+	}
+}
+
+// OptionWorkerPool set Router's worker pool, the requests are handled in it
+// instead of a new goroutine if a timeout is set. A service handling the
+// requests in a pool of OverflowBlock mustn't share it with the router.
+func OptionWorkerPool(workers *pool.WorkerPool) RouterOptionFunc {
+	return func(r *Router) {
+		r.workers = workers
+	}
+}
+
 // OptionTimeoutResponse set Router's timeout
 func OptionTimeoutResponse(timeout ITimeouter) RouterOptionFunc {
 	return func(r *Router) {
@@ -144,56 +217,144 @@ func OptionNoneResponse(resp IOutProtocol) RouterOptionFunc {
 
 // NewRouter create a Router struct
 func NewRouter(opts ...RouterOptionFunc) *Router {
-	router := &Router{map[uint8]IModule{}, FullRouteEnabler, nil, nil}
+	router := &Router{
+		modules: map[uint8]IModule{},
+		enabler: FullRouteEnabler,
+		policy:  VersionReject,
+	}
 	for _, opt := range opts {
 		opt(router)
 	}
 	return router
 }
 
-// Register register several modules
-func (router *Router) Register(modules ...IModule) {
+// WorkerPool get the worker pool handling the requests, it's nil if not set
+func (router *Router) WorkerPool() *pool.WorkerPool { return router.workers }
+
+// Register register several modules, a module with a registered module id or
+// with overlapped actions is rejected, see OptionDuplicatePolicy.
+func (router *Router) Register(modules ...IModule) error {
+	var errs []error
 	for _, m := range modules {
-		router.modules[m.GetMID()] = m
+		err := router.checkDuplicate(m)
+		if err == nil {
+			router.modules[m.GetMID()] = m
+			continue
+		}
+		if router.dupPanic {
+			panic(err)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// checkDuplicate check whether the module or its actions is registered
+func (router *Router) checkDuplicate(m IModule) error {
+	mid := m.GetMID()
+	if old, ok := router.modules[mid]; ok {
+		return fmt.Errorf("%w: module(%d) %T and %T", ErrDuplicateRoute, mid, old, m)
+	}
+	lister, ok := m.(IActionLister)
+	if !ok {
+		return nil
+	}
+	// the action with the higher minimum version is preferred for the
+	// overlapped versions, so actions with the same one are ambiguous.
+	acts := lister.Actions()
+	for i, a := range acts {
+		aMin, aMax := actionVersion(a)
+		for _, b := range acts[i+1:] {
+			if a.GetAID() != b.GetAID() {
+				continue
+			}
+			if bMin, bMax := actionVersion(b); aMin == bMin {
+				return fmt.Errorf(
+					"%w: module(%d) action(%d) %s and %s, proto version [%d, %d] and [%d, %d]",
+					ErrDuplicateRoute, mid, a.GetAID(), handlerName(a), handlerName(b),
+					aMin, aMax, bMin, bMax)
+			}
+		}
+	}
+	return nil
+}
+
+// enabled check whether the route of the request is enabled
+func (router *Router) enabled(r IRequest) bool {
+	if enabler, ok := router.enabler.(IVersionRouteEnabler); ok {
+		return enabler.EnabledVersion(r.GetMID(), r.GetAID(), r.GetProtoVer())
 	}
+	return router.enabler.Enabled(r.GetMID(), r.GetAID())
 }
 
-// Dispatch dispath each client's request
+// Dispatch dispath each client's request, it returns true if timeout.
+// Use DispatchErr to know why a request is rejected.
 func (router *Router) Dispatch(r IRequest) (IOutProtocol, bool) {
+	resp, err := router.DispatchErr(r)
+	return resp, err == ErrRouteTimeout
+}
+
+// DispatchErr dispath each client's request, if the request is rejected or
+// timeout, the noneResp or the timeout result is returned with an error.
+func (router *Router) DispatchErr(r IRequest) (IOutProtocol, error) {
 	moduleID := r.GetMID()
 	actionID := r.GetAID()
 
 	var module IModule
-	if router.enabler.Enabled(moduleID, actionID) {
+	if router.enabled(r) {
 		var ok bool
 		module, ok = router.modules[moduleID]
 		if !ok {
 			//TODO: log
 			//zaplog.S.Errorf("router: module(%d) not found", moduleID)
-			return router.noneResp, false
+			return router.noneResp, ErrModuleNotFound
 		}
 	} else {
 		//TODO: log
 		//zaplog.S.Errorf("router: module(%d) action(%d) disabled", moduleID, actionID)
-		return router.noneResp, false
+		return router.noneResp, ErrRouteDisabled
+	}
+	if router.verifier != nil {
+		if err := router.verifier.Verify(r); err != nil {
+			return router.noneResp, err
+		}
+	}
+	handle := module.Handle
+	if resolver, ok := module.(IActionResolver); ok {
+		act, err := resolver.Resolve(actionID, r.GetProtoVer(), router.policy)
+		switch err {
+		case nil:
+		case ErrActionNotFound:
+			// an unknown action gets the empty response as before
+			//zaplog.S.Errorf("router: module(%d) action(%d) not found", moduleID, actionID)
+			act = NoneAction
+		default:
+			return router.noneResp, err
+		}
+		handle = act.Handle
 	}
 	if router.timeout == nil {
-		return module.Handle(r), false
+		return handle(r), nil
 	}
 	// timeout to handle a request
 	result := make(chan IOutProtocol, 1)
-	go func() {
+	task := func() {
 		defer func() {
 			if err := recover(); err != nil {
 				//TODO : log
 			}
 		}()
-		result <- module.Handle(r)
-	}()
+		result <- handle(r)
+	}
+	if router.workers == nil {
+		go task()
+	} else if err := router.workers.Submit(task); err != nil {
+		return router.noneResp, ErrRouteBusy
+	}
 	select {
 	case pb := <-result:
-		return pb, false
+		return pb, nil
 	case <-time.After(router.timeout.Timeout()):
-		return router.timeout.Result(), true
+		return router.timeout.Result(), ErrRouteTimeout
 	}
 }
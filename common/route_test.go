@@ -0,0 +1,239 @@
+package common_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+)
+
+type testRequest struct {
+	mid, aid, ver uint8
+	data, sign    []byte
+}
+
+func (r *testRequest) GetMID() uint8      { return r.mid }
+func (r *testRequest) GetAID() uint8      { return r.aid }
+func (r *testRequest) GetProtoVer() uint8 { return r.ver }
+func (r *testRequest) GetData() []byte    { return r.data }
+func (r *testRequest) GetSign() []byte    { return r.sign }
+
+type echoAction struct{ aid uint8 }
+
+func (a *echoAction) GetAID() uint8 { return a.aid }
+func (a *echoAction) Handle(r common.IRequest) common.IOutProtocol {
+	return common.BytesOutProtocol(r.GetData())
+}
+
+func TestRouterSignVerifier(t *testing.T) {
+	packet.SetSignSecret([]byte("secret"))
+	token := []byte("token")
+	verifier := common.NewSignVerifier(
+		packet.HMACSha1Signature,
+		func(common.IRequest) []byte { return token },
+	).RequireAction(1, 1)
+
+	router := common.NewRouter(common.OptionSignVerifier(verifier))
+	router.Register(common.NewModule(1, &echoAction{1}, &echoAction{2}))
+
+	data := []byte("hello")
+	sign, _ := packet.HMACSha1Signature.Sum(token, data)
+
+	if _, err := router.DispatchErr(&testRequest{mid: 1, aid: 1, data: data, sign: sign}); err != nil {
+		t.Fatalf("signed request: %v", err)
+	}
+	if _, err := router.DispatchErr(&testRequest{mid: 1, aid: 1, data: data}); err != packet.ErrNoSign {
+		t.Fatalf("unsigned request: %v", err)
+	}
+	if _, err := router.DispatchErr(&testRequest{mid: 1, aid: 1, data: []byte("hellO"), sign: sign}); err != packet.ErrInvalidSign {
+		t.Fatalf("tampered request: %v", err)
+	}
+	if _, err := router.DispatchErr(&testRequest{mid: 1, aid: 2, data: data}); err != nil {
+		t.Fatalf("optional request: %v", err)
+	}
+	if _, err := router.DispatchErr(&testRequest{mid: 2, aid: 1, data: data}); err != common.ErrModuleNotFound {
+		t.Fatalf("unknown module: %v", err)
+	}
+	// a rejected request isn't timeout
+	if out, timeout := router.Dispatch(&testRequest{mid: 1, aid: 1, data: data}); out != nil || timeout {
+		t.Fatalf("dispatch unsigned request: %v, %v", out, timeout)
+	}
+}
+
+func TestRouterSessionSignature(t *testing.T) {
+	packet.SetSignSecret([]byte("secret"))
+	session := packet.NewHMACSha1Signature([]byte("session key"))
+	verifier := common.NewSignVerifier(packet.HMACSha1Signature, nil).
+		SessionSignature(func(r common.IRequest) packet.ISignature {
+			if r.GetMID() == 1 {
+				return session
+			}
+			return nil
+		}).RequireAll()
+	router := common.NewRouter(common.OptionSignVerifier(verifier))
+	router.Register(common.NewModule(1, &echoAction{1}), common.NewModule(2, &echoAction{1}))
+
+	data := []byte("hello")
+	sessionSign, _ := session.Sum(nil, data)
+	globalSign, _ := packet.HMACSha1Signature.Sum(nil, data)
+	if _, err := router.DispatchErr(&testRequest{mid: 1, aid: 1, data: data, sign: sessionSign}); err != nil {
+		t.Fatalf("session signed request: %v", err)
+	}
+	if _, err := router.DispatchErr(&testRequest{mid: 1, aid: 1, data: data, sign: globalSign}); err != packet.ErrInvalidSign {
+		t.Fatalf("global signed request: %v", err)
+	}
+	if _, err := router.DispatchErr(&testRequest{mid: 2, aid: 1, data: data, sign: globalSign}); err != nil {
+		t.Fatalf("no session signature: %v", err)
+	}
+}
+
+type versionAction struct{ ver string }
+
+func (a *versionAction) GetAID() uint8 { return 1 }
+func (a *versionAction) Handle(_ common.IRequest) common.IOutProtocol {
+	return common.BytesOutProtocol(a.ver)
+}
+
+func TestRouterProtoVersion(t *testing.T) {
+	module := common.NewModule(1,
+		common.NewVersionAction(&versionAction{"v1"}, 1, 2),
+		common.NewVersionAction(&versionAction{"v3"}, 3, 5),
+		common.NewVersionAction(&versionAction{"v4"}, 4, 4),
+	)
+	cases := []struct {
+		policy common.VersionPolicy
+		ver    uint8
+		out    string
+		err    error
+	}{
+		{common.VersionReject, 1, "v1", nil},
+		{common.VersionReject, 3, "v3", nil},
+		{common.VersionReject, 4, "v4", nil},
+		{common.VersionReject, 5, "v3", nil},
+		{common.VersionReject, 6, "", common.ErrVersionUnsupported},
+		{common.VersionLatest, 6, "v3", nil},
+		{common.VersionLatest, 0, "v3", nil},
+	}
+	for _, c := range cases {
+		router := common.NewRouter(common.OptionVersionPolicy(c.policy))
+		router.Register(module)
+		out, err := router.DispatchErr(&testRequest{mid: 1, aid: 1, ver: c.ver})
+		if err != c.err {
+			t.Fatalf("ver %d: err %v, expected %v", c.ver, err, c.err)
+		}
+		if err == nil && out.(common.BytesOutProtocol).String() != c.out {
+			t.Fatalf("ver %d: out %v, expected %s", c.ver, out, c.out)
+		}
+	}
+}
+
+func TestRouterUnknownAction(t *testing.T) {
+	router := common.NewRouter(common.OptionNoneResponse(common.BytesOutProtocol("none")))
+	router.Register(common.NewModule(1, &echoAction{1}))
+	// an unknown action is handled by NoneAction, the noneResp is for a rejected route
+	out, err := router.DispatchErr(&testRequest{mid: 1, aid: 2, data: []byte("hello")})
+	if err != nil || out == nil || len(out.(common.BytesOutProtocol)) != 0 {
+		t.Fatalf("unknown action: %v %v", out, err)
+	}
+}
+
+func TestRouterRuleEnabler(t *testing.T) {
+	enabler := common.NewRuleEnabler()
+	router := common.NewRouter(common.OptionRouteEnabler(enabler))
+	router.Register(common.NewModule(12, &echoAction{1}, &echoAction{2}))
+
+	dispatch := func(aid, ver uint8) error {
+		_, err := router.DispatchErr(&testRequest{mid: 12, aid: aid, ver: ver})
+		return err
+	}
+	enabler.SetAction(12, 1, false)
+	if dispatch(1, 0) != common.ErrRouteDisabled || dispatch(2, 0) != nil {
+		t.Fatal("disable action")
+	}
+	enabler.SetVersion(3, false)
+	if dispatch(2, 3) != common.ErrRouteDisabled || dispatch(2, 4) != nil {
+		t.Fatal("disable version")
+	}
+	if err := enabler.SetRules(common.RouteRules{Modules: []int{12}}); err != nil {
+		t.Fatal(err)
+	}
+	if dispatch(1, 0) != common.ErrRouteDisabled || dispatch(2, 0) != common.ErrRouteDisabled {
+		t.Fatal("disable module")
+	}
+	if err := enabler.SetRules(common.RouteRules{Modules: []int{256}}); err == nil {
+		t.Fatal("invalid rules accepted")
+	}
+	hits := enabler.DisabledHits()
+	if hits[packet.MakeProtoID(12, 1)] != 2 || hits[packet.MakeProtoID(12, 2)] != 2 {
+		t.Fatalf("disabled hits: %v", hits)
+	}
+}
+
+func TestRouterDuplicate(t *testing.T) {
+	router := common.NewRouter()
+	if err := router.Register(common.NewModule(1, &echoAction{1})); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Register(common.NewModule(1, &echoAction{2})); !errors.Is(err, common.ErrDuplicateRoute) {
+		t.Fatalf("duplicate module: %v", err)
+	}
+	if err := router.Register(common.NewModule(2, &echoAction{1}, &echoAction{1})); !errors.Is(err, common.ErrDuplicateRoute) {
+		t.Fatalf("duplicate action: %v", err)
+	}
+	// the modules after a duplicate one are still registered
+	if err := router.Register(common.NewModule(5), common.NewModule(1), common.NewModule(6)); !errors.Is(err, common.ErrDuplicateRoute) {
+		t.Fatalf("duplicate in a batch: %v", err)
+	}
+	if _, err := router.DispatchErr(&testRequest{mid: 6}); err != nil {
+		t.Fatalf("the module after a duplicate one: %v", err)
+	}
+	if err := router.Register(common.NewModule(3,
+		common.NewVersionAction(&echoAction{1}, 1, 4),
+		common.NewVersionAction(&echoAction{1}, 3, 3),
+	)); err != nil {
+		t.Fatalf("versioned actions: %v", err)
+	}
+	if err := router.Register(common.NewModule(4,
+		common.NewVersionAction(&echoAction{1}, 1, 3),
+		common.NewVersionAction(&echoAction{1}, 1, 4),
+	)); !errors.Is(err, common.ErrDuplicateRoute) {
+		t.Fatalf("ambiguous versions: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicate module without panic")
+		}
+	}()
+	common.NewRouter(common.OptionDuplicatePolicy(common.DuplicatePanic)).
+		Register(common.NewModule(1), common.NewModule(1))
+}
+
+func TestRouterRoutes(t *testing.T) {
+	enabler := common.NewRuleEnabler()
+	enabler.SetAction(1, 2, false)
+	router := common.NewRouter(common.OptionRouteEnabler(enabler))
+	router.Register(
+		common.NewModule(2, &echoAction{1}),
+		common.NewModule(1, &echoAction{2}, common.NewVersionAction(&echoAction{1}, 2, 3)),
+	)
+	expected := []common.RouteInfo{
+		{MID: 1, AID: 1, MinVer: 2, MaxVer: 3, Handler: "*common_test.echoAction", Enabled: true},
+		{MID: 1, AID: 2, MinVer: 0, MaxVer: 0xFF, Handler: "*common_test.echoAction", Enabled: false},
+		{MID: 2, AID: 1, MinVer: 0, MaxVer: 0xFF, Handler: "*common_test.echoAction", Enabled: true},
+	}
+	routes := router.Routes()
+	if !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("routes: %+v", routes)
+	}
+	if err := router.DumpRoutes(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	// listing the routes isn't a request to the disabled one
+	if hits := enabler.DisabledHits(); len(hits) != 0 {
+		t.Errorf("disabled hits: %v", hits)
+	}
+}
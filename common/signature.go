@@ -0,0 +1,189 @@
+package common
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/overtalk/qnet/packet"
+)
+
+// ErrSignAlgRejected the signature algorithm isn't accepted by the verifier
+var ErrSignAlgRejected = errors.New("signature algorithm rejected")
+
+// ISignAlgRequest a request which tells its signature algorithm
+type ISignAlgRequest interface {
+	IRequest
+	GetSignAlg() packet.SignAlg
+}
+
+// ISignVerifier verify the signature of a request before handling it
+type ISignVerifier interface {
+	Verify(IRequest) error
+}
+
+// SignTokenFunc get the token of the session which the request belongs to
+type SignTokenFunc func(IRequest) []byte
+
+// SignatureFunc get the signature of the session which the request belongs
+// to, eg: the one derived by a handshake, it's nil if the session has no one
+type SignatureFunc func(IRequest) packet.ISignature
+
+// SignVerifier recalculate the signature of the dataload with a session token,
+// only the required modules or actions will be verified. The sequence number
+// of a request must be signed with the dataload if rejecting the replays, see
+// packet.SeqSignData, otherwise the dataload alone may be signed. The
+// signature is chosen by the algorithm of the request, and only the accepted
+// algorithms are verified, they are the added signatures' by default.
+// NOTE: configure it before registering it to a Router, it's not concurrent safely.
+type SignVerifier struct {
+	// replayed must be the first field for the 64-bit atomic access
+	replayed uint64
+
+	signature  packet.ISignature
+	signatures map[packet.SignAlg]packet.ISignature
+	accepted   map[packet.SignAlg]bool
+	token      SignTokenFunc
+	session    SignatureFunc
+	window     ReplayWindowFunc
+
+	all     bool
+	modules map[uint8]bool
+	actions map[uint16]bool
+}
+
+var _ ISignVerifier = (*SignVerifier)(nil)
+
+// NewSignVerifier create a SignVerifier struct, no route is required by default
+func NewSignVerifier(signature packet.ISignature, token SignTokenFunc) *SignVerifier {
+	return &SignVerifier{
+		signature:  signature,
+		signatures: map[packet.SignAlg]packet.ISignature{packet.SignatureAlg(signature): signature},
+		token:      token,
+		all:        false,
+		modules:    map[uint8]bool{},
+		actions:    map[uint16]bool{},
+	}
+}
+
+// AddSignature add the signatures of other algorithms
+func (v *SignVerifier) AddSignature(signatures ...packet.ISignature) *SignVerifier {
+	for _, signature := range signatures {
+		v.signatures[packet.SignatureAlg(signature)] = signature
+	}
+	return v
+}
+
+// AcceptSignAlg only accept the algorithms, eg: the ones of the session
+// signatures without an added signature.
+func (v *SignVerifier) AcceptSignAlg(algs ...packet.SignAlg) *SignVerifier {
+	v.accepted = map[packet.SignAlg]bool{}
+	for _, alg := range algs {
+		v.accepted[alg] = true
+	}
+	return v
+}
+
+// Accepted check whether the signature algorithm is accepted
+func (v *SignVerifier) Accepted(alg packet.SignAlg) bool {
+	if v.accepted != nil {
+		return v.accepted[alg]
+	}
+	_, ok := v.signatures[alg]
+	return ok
+}
+
+// RequireAll all requests must be signed
+func (v *SignVerifier) RequireAll() *SignVerifier {
+	v.all = true
+	return v
+}
+
+// RequireModule all actions of the modules must be signed
+func (v *SignVerifier) RequireModule(mids ...uint8) *SignVerifier {
+	for _, mid := range mids {
+		v.modules[mid] = true
+	}
+	return v
+}
+
+// RequireAction the action of a module must be signed
+func (v *SignVerifier) RequireAction(mid, aid uint8) *SignVerifier {
+	v.actions[packet.MakeProtoID(mid, aid)] = true
+	return v
+}
+
+// SessionSignature verify by the signature of the session, the added one
+// is used if the session has no one of the request's algorithm.
+func (v *SignVerifier) SessionSignature(fn SignatureFunc) *SignVerifier {
+	v.session = fn
+	return v
+}
+
+// RejectReplay reject the replayed requests by the replay window of their
+// sessions, a required route must be signed with a sequence number.
+func (v *SignVerifier) RejectReplay(window ReplayWindowFunc) *SignVerifier {
+	v.window = window
+	return v
+}
+
+// Replayed get the number of the rejected replayed requests
+func (v *SignVerifier) Replayed() uint64 {
+	return atomic.LoadUint64(&v.replayed)
+}
+
+// Required check whether the route must be signed
+func (v *SignVerifier) Required(mid, aid uint8) bool {
+	return v.all || v.modules[mid] || v.actions[packet.MakeProtoID(mid, aid)]
+}
+
+// Verify check the signature of a request, it returns packet.ErrNoSign,
+// packet.ErrInvalidSign, ErrSignAlgRejected, ErrNoSeq or ErrReplayed
+// if the request is rejected.
+func (v *SignVerifier) Verify(r IRequest) error {
+	if !v.Required(r.GetMID(), r.GetAID()) {
+		return nil
+	}
+	var token []byte
+	if v.token != nil {
+		token = v.token(r)
+	}
+	alg := packet.SignatureAlg(v.signature)
+	if algReq, ok := r.(ISignAlgRequest); ok && algReq.GetSignAlg() != packet.SignNone {
+		alg = algReq.GetSignAlg()
+	}
+	if !v.Accepted(alg) {
+		return ErrSignAlgRejected
+	}
+	signature := v.signatures[alg]
+	if v.session != nil {
+		if s := v.session(r); s != nil && packet.SignatureAlg(s) == alg {
+			signature = s
+		}
+	}
+	if signature == nil {
+		return ErrSignAlgRejected
+	}
+	data := r.GetData()
+	seqReq, hasSeq := r.(ISeqRequest)
+	hasSeq = hasSeq && seqReq.HasSequence()
+	if v.window == nil {
+		// the sequence number isn't bound without rejecting the replays,
+		// eg: a legacy client signs the dataload alone
+		err := packet.VerifySign(signature, token, data, r.GetSign())
+		if err == packet.ErrInvalidSign && hasSeq {
+			err = packet.VerifySign(signature, token, packet.SeqSignData(seqReq.GetSeq(), data), r.GetSign())
+		}
+		return err
+	}
+	if !hasSeq {
+		return ErrNoSeq
+	}
+	if err := packet.VerifySign(signature, token, packet.SeqSignData(seqReq.GetSeq(), data), r.GetSign()); err != nil {
+		return err
+	}
+	if window := v.window(r); window != nil && !window.Accept(seqReq.GetSeq()) {
+		atomic.AddUint64(&v.replayed, 1)
+		return ErrReplayed
+	}
+	return nil
+}
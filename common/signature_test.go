@@ -0,0 +1,54 @@
+package common_test
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+)
+
+type testAlgRequest struct {
+	testRequest
+	alg packet.SignAlg
+}
+
+func (r *testAlgRequest) GetSignAlg() packet.SignAlg { return r.alg }
+
+func TestSignVerifierAlgs(t *testing.T) {
+	packet.SetSignSecret([]byte("secret"))
+	public, private, _ := ed25519.GenerateKey(nil)
+	data := []byte("hello")
+	signReq := func(signature packet.ISignature) *testAlgRequest {
+		sign, err := signature.Sum(nil, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &testAlgRequest{testRequest{mid: 1, aid: 1, data: data, sign: sign}, packet.SignatureAlg(signature)}
+	}
+
+	verifier := common.NewSignVerifier(packet.HMACSha1Signature, nil).
+		AddSignature(packet.HMACSha256Signature, packet.NewEd25519Verifier(public)).
+		RequireAll()
+	for _, signature := range []packet.ISignature{
+		packet.HMACSha1Signature, packet.HMACSha256Signature, packet.NewEd25519Signature(private),
+	} {
+		if err := verifier.Verify(signReq(signature)); err != nil {
+			t.Fatalf("%s: %v", packet.SignatureAlg(signature), err)
+		}
+	}
+	// the algorithm comes from the flag
+	req := signReq(packet.HMACSha256Signature)
+	req.alg = packet.SignHMACSha1
+	if err := verifier.Verify(req); err != packet.ErrInvalidSign {
+		t.Fatalf("wrong algorithm: %v", err)
+	}
+
+	verifier.AcceptSignAlg(packet.SignHMACSha256, packet.SignEd25519)
+	if err := verifier.Verify(signReq(packet.HMACSha1Signature)); err != common.ErrSignAlgRejected {
+		t.Fatalf("rejected algorithm: %v", err)
+	}
+	if _, err := packet.NewEd25519Verifier(public).Sum(nil, data); err != packet.ErrSignUnsupported {
+		t.Fatalf("ed25519 verifier signing: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package common
+
+// VersionPolicy decide what to do with a request whose proto version is not
+// supported by any registered action
+type VersionPolicy uint8
+
+const (
+	// VersionReject reject the request with ErrVersionUnsupported
+	VersionReject VersionPolicy = iota
+	// VersionLatest handle the request by the action of the latest version
+	VersionLatest
+)
+
+// IVersionAction an action handling a range of proto versions,
+// an IAction without versions handles all proto versions.
+type IVersionAction interface {
+	IAction
+	GetProtoVer() (uint8, uint8)
+}
+
+// IActionResolver find the action to handle a request,
+// a Router will resolve the action by itself if the module implements it.
+type IActionResolver interface {
+	Resolve(aid, ver uint8, policy VersionPolicy) (IAction, error)
+}
+
+type versionAction struct {
+	IAction
+	minVer uint8
+	maxVer uint8
+}
+
+// NewVersionAction create an action handling the proto version in [minVer, maxVer]
+func NewVersionAction(act IAction, minVer, maxVer uint8) IVersionAction {
+	if minVer > maxVer {
+		minVer, maxVer = maxVer, minVer
+	}
+	return &versionAction{IAction: act, minVer: minVer, maxVer: maxVer}
+}
+
+func (va *versionAction) GetProtoVer() (uint8, uint8) {
+	return va.minVer, va.maxVer
+}
+
+// actionVersion get the proto version range of an action
+func actionVersion(act IAction) (uint8, uint8) {
+	if va, ok := act.(IVersionAction); ok {
+		return va.GetProtoVer()
+	}
+	return 0, 0xFF
+}
+
+// resolveVersion choose the best matched action for the version: the one
+// with the highest minimum version, and the later registered one if equal.
+func resolveVersion(acts []IAction, ver uint8, policy VersionPolicy) (IAction, error) {
+	var best, latest IAction
+	var bestMin, latestMax uint8
+	for _, act := range acts {
+		minVer, maxVer := actionVersion(act)
+		if ver >= minVer && ver <= maxVer && (best == nil || minVer >= bestMin) {
+			best, bestMin = act, minVer
+		}
+		if latest == nil || maxVer >= latestMax {
+			latest, latestMax = act, maxVer
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if policy == VersionLatest && latest != nil {
+		return latest, nil
+	}
+	return nil, ErrVersionUnsupported
+}
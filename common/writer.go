@@ -0,0 +1,210 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// error definitions
+var (
+	ErrWriteQueueFull = errors.New("writer: queue is full")
+	ErrWriterClosed   = errors.New("writer: closed")
+)
+
+const (
+	// maxBatchPackets the maximum packets written by a syscall
+	maxBatchPackets = 64
+)
+
+type writeError struct{ err error }
+
+// BatchWriter write all packets of a connection in its own goroutine, so the
+// packets never interleave, and the queued packets are written at once.
+type BatchWriter struct {
+	conn       *BaseConn
+	queue      chan []byte
+	flushDelay time.Duration
+	framer     IFramer
+
+	err    atomic.Value // the first write error
+	closed int32
+	// lock make Write and Close exclusive, a packet is queued before Close
+	// or never, sigStop wakes the blocked writers up before Close locks
+	lock     sync.RWMutex
+	sigStop  chan struct{}
+	sigClose chan struct{}
+	done     chan struct{}
+}
+
+// NewBatchWriter create a BatchWriter struct and start its goroutine, it waits
+// flushDelay for more packets before writing, or writes the queued packets
+// immediately if flushDelay is 0.
+func NewBatchWriter(conn *BaseConn, queueSize int, flushDelay time.Duration) *BatchWriter {
+	return NewFramedBatchWriter(conn, queueSize, flushDelay, DefaultFramer)
+}
+
+// NewFramedBatchWriter create a BatchWriter struct writing the packets framed
+// by the framer, see AppendPacketFrame.
+func NewFramedBatchWriter(conn *BaseConn, queueSize int, flushDelay time.Duration, framer IFramer) *BatchWriter {
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	w := &BatchWriter{
+		conn:       conn,
+		queue:      make(chan []byte, queueSize),
+		flushDelay: flushDelay,
+		framer:     framer,
+		sigStop:    make(chan struct{}),
+		sigClose:   make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Write queue a frame of the packet, it blocks if the queue is full, and
+// returns ErrWriteQueueFull if still full after the conn's write timeout.
+// A packet written successfully is flushed by Close.
+func (w *BatchWriter) Write(b []byte) (int, error) {
+	if err := w.Err(); err != nil {
+		return 0, err
+	}
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if atomic.LoadInt32(&w.closed) == 1 {
+		return 0, ErrWriterClosed
+	}
+	data, err := AppendPacketFrame(w.framer, nil, b)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case w.queue <- data:
+		return len(b), nil
+	default:
+	}
+
+	// back pressure: wait for a free slot
+	var timeout <-chan time.Time
+	if wrTimeout := w.conn.GetWriteTimeout(); wrTimeout > 0 {
+		timer := time.NewTimer(wrTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case w.queue <- data:
+		return len(b), nil
+	case <-timeout:
+		return 0, ErrWriteQueueFull
+	case <-w.sigStop:
+		return 0, ErrWriterClosed
+	}
+}
+
+// QueueDepth get the number of the queued packets
+func (w *BatchWriter) QueueDepth() int {
+	return len(w.queue)
+}
+
+// Err get the first error of writing the connection
+func (w *BatchWriter) Err() error {
+	if v := w.err.Load(); v != nil {
+		return v.(writeError).err
+	}
+	return nil
+}
+
+// Close write all queued packets and stop the goroutine
+func (w *BatchWriter) Close() {
+	if atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
+		close(w.sigStop)
+		// wait for the writers queueing, then the queue is final
+		w.lock.Lock()
+		close(w.sigClose)
+		w.lock.Unlock()
+		<-w.done
+	}
+}
+
+func (w *BatchWriter) run() {
+	defer func() {
+		if err := recover(); err != nil {
+			//zaplog.S.Error(err)
+			//zaplog.S.Error(zap.Stack("").String)
+		}
+		close(w.done)
+	}()
+
+	bufs := make(net.Buffers, 0, maxBatchPackets)
+	for {
+		select {
+		case b := <-w.queue:
+			bufs = append(bufs[:0], b)
+		case <-w.sigClose:
+			w.flushQueue(bufs[:0])
+			return
+		}
+		if w.flushDelay > 0 {
+			bufs = w.waitBatch(bufs)
+		} else {
+			bufs = w.collect(bufs)
+		}
+		w.flush(bufs)
+	}
+}
+
+// collect take the queued packets without waiting
+func (w *BatchWriter) collect(bufs net.Buffers) net.Buffers {
+	for len(bufs) < maxBatchPackets {
+		select {
+		case b := <-w.queue:
+			bufs = append(bufs, b)
+		default:
+			return bufs
+		}
+	}
+	return bufs
+}
+
+// waitBatch take the packets arriving in the flush delay
+func (w *BatchWriter) waitBatch(bufs net.Buffers) net.Buffers {
+	timer := time.NewTimer(w.flushDelay)
+	defer timer.Stop()
+	for len(bufs) < maxBatchPackets {
+		select {
+		case b := <-w.queue:
+			bufs = append(bufs, b)
+		case <-timer.C:
+			return bufs
+		case <-w.sigClose:
+			return w.collect(bufs)
+		}
+	}
+	return bufs
+}
+
+// flushQueue write all queued packets before exiting
+func (w *BatchWriter) flushQueue(bufs net.Buffers) {
+	for {
+		bufs = w.collect(bufs[:0])
+		if len(bufs) == 0 {
+			return
+		}
+		w.flush(bufs)
+	}
+}
+
+func (w *BatchWriter) flush(bufs net.Buffers) {
+	// discard the packets after an error, the connection is broken
+	if w.Err() != nil {
+		return
+	}
+	// the written buffers are consumed, but bufs is reset before reusing
+	if _, err := w.conn.WriteBuffers(bufs); err != nil {
+		w.err.Store(writeError{err})
+		w.conn.Close()
+	}
+}
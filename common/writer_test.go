@@ -0,0 +1,97 @@
+package common_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/pool"
+	"github.com/overtalk/qnet/slab"
+)
+
+func TestBatchWriter(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := common.NewBaseConn(server, pool.NewBufReaderPool(1, 1024).Get(server))
+	writer := common.NewBatchWriter(conn, 16, time.Millisecond)
+
+	const writers, packets = 8, 100
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			payload := bytes.Repeat([]byte{byte(i)}, 100+i)
+			data := append([]byte{byte(len(payload) >> 8), byte(len(payload))}, payload...)
+			for j := 0; j < packets; j++ {
+				if _, err := writer.Write(data); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	reader := bufio.NewReader(client)
+	buffer := common.NewPacketBuffer(1024, &slab.NoPool{})
+	for n := 0; n < writers*packets; n++ {
+		if _, err := buffer.ReadFrom(reader); err != nil {
+			t.Fatal(err)
+		}
+		payload := buffer.Bytes()[2:]
+		if len(payload) != 100+int(payload[0]) || bytes.Count(payload, payload[:1]) != len(payload) {
+			t.Fatalf("packet %d interleaved: %v", n, payload)
+		}
+	}
+	wg.Wait()
+	writer.Close()
+	if _, err := writer.Write([]byte{0, 0}); err != common.ErrWriterClosed {
+		t.Fatalf("write after closed: %v", err)
+	}
+}
+
+func TestBatchWriterClose(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		server, client := net.Pipe()
+		conn := common.NewBaseConn(server, pool.NewBufReaderPool(1, 1024).Get(server))
+		writer := common.NewBatchWriter(conn, 4, 0)
+
+		received := make(chan int)
+		go func() {
+			n, _ := io.Copy(io.Discard, client)
+			received <- int(n)
+		}()
+
+		var written int64
+		var wg sync.WaitGroup
+		wg.Add(4)
+		for i := 0; i < 4; i++ {
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := writer.Write([]byte{0, 1, 2}); err != nil {
+						if err != common.ErrWriterClosed {
+							t.Error(err)
+						}
+						return
+					}
+					atomic.AddInt64(&written, 3)
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		writer.Close()
+		wg.Wait()
+		server.Close()
+		if n := <-received; int64(n) != atomic.LoadInt64(&written) {
+			t.Fatalf("round %d: written %d, received %d", round, written, n)
+		}
+		client.Close()
+	}
+}
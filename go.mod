@@ -1,5 +1,10 @@
 module github.com/overtalk/qnet
 
-go 1.14
+go 1.20
 
-require github.com/funny/utest v0.0.0-20161029064919-43870a374500
+require (
+	github.com/funny/utest v0.0.0-20161029064919-43870a374500
+	golang.org/x/crypto v0.31.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,129 @@
+package packet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// error definitions
+var (
+	ErrDecrypt      = errors.New("packet authentication failed")
+	ErrNotEncrypted = errors.New("packet not encrypted")
+)
+
+// the size of the nonce's random prefix, the rest is a counter
+const aeadNoncePrefixSize = 4
+
+// aeadCrypto an authenticated crypto, the data after the data flag is sealed,
+// and the proto id, version and data flag are authenticated. A sealed packet:
+//
+//	DATASIZE + CONNID + PROTOID + VER + FLAG + NONCE + SEALED DATA + TAG
+//
+// The connection id isn't authenticated because an agent server rewrites it.
+type aeadCrypto struct {
+	// counter must be the first field for the 64-bit atomic access
+	counter uint64
+	prefix  [aeadNoncePrefixSize]byte
+	seal    cipher.AEAD
+	open    cipher.AEAD
+}
+
+// NewAEADCrypto create an authenticated ICrypto of a session, each nonce is
+// a random prefix and a counter so that it's never reused with the key.
+func NewAEADCrypto(aead cipher.AEAD) (ICrypto, error) {
+	return NewDuplexAEADCrypto(aead, aead)
+}
+
+// NewDuplexAEADCrypto create an authenticated ICrypto of a session which
+// seals the sent packets and opens the received ones by different keys.
+func NewDuplexAEADCrypto(seal, open cipher.AEAD) (ICrypto, error) {
+	c := &aeadCrypto{seal: seal, open: open}
+	if _, err := rand.Read(c.prefix[:]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewAESGCMCrypto create an AES-GCM ICrypto of a session,
+// the key is 16, 24 or 32 bytes.
+func NewAESGCMCrypto(key []byte) (ICrypto, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return NewAEADCrypto(aead)
+}
+
+// NewChaCha20Crypto create a ChaCha20-Poly1305 ICrypto of a session,
+// the key is 32 bytes.
+func NewChaCha20Crypto(key []byte) (ICrypto, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewAEADCrypto(aead)
+}
+
+func (c *aeadCrypto) nextNonce(nonce []byte) {
+	copy(nonce, c.prefix[:])
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], atomic.AddUint64(&c.counter, 1))
+}
+
+// additionalData the authenticated header: PROTOID + VER + FLAG
+func additionalData(packet Packet) []byte {
+	return packet[6 : 2+OptSizeData]
+}
+
+// Encrypt seal a packet into a new allocated one
+func (c *aeadCrypto) Encrypt(packet Packet) (Packet, error) {
+	if len(packet) < 2+OptSizeData {
+		return nil, ErrInvalidSize
+	}
+	index := 2 + OptSizeData + c.seal.NonceSize()
+	size := len(packet) + c.seal.NonceSize() + c.seal.Overhead()
+	if size > MaxPacketSize {
+		return nil, ErrInvalidSize
+	}
+	out := make(Packet, index, size)
+	copy(out, packet[:2+OptSizeData])
+	out.SetDataSize(uint16(size - 2))
+	out.SetDataFlag(FlagAEAD)
+	nonce := out[2+OptSizeData : index]
+	c.nextNonce(nonce)
+	return c.seal.Seal(out, nonce, packet[2+OptSizeData:], additionalData(out)), nil
+}
+
+// Decrypt open a sealed packet in place, a cmd packet is never encrypted,
+// and the other unsealed packets are rejected.
+func (c *aeadCrypto) Decrypt(packet Packet) (Packet, error) {
+	if packet.IsCmd() {
+		return packet, nil
+	}
+	if len(packet) < 2+OptSizeData || !packet.HasDataFlag(FlagAEAD) {
+		return nil, ErrNotEncrypted
+	}
+	index := 2 + OptSizeData + c.open.NonceSize()
+	if len(packet) < index+c.open.Overhead() {
+		return nil, ErrDecrypt
+	}
+	sealed := packet[index:]
+	data, err := c.open.Open(sealed[:0], packet[2+OptSizeData:index], sealed, additionalData(packet))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	copy(packet[2+OptSizeData:], data)
+	packet = packet[:2+OptSizeData+len(data)]
+	packet.SetDataSize(uint16(len(packet) - 2))
+	packet.ClearDataFlag(FlagAEAD)
+	return packet, nil
+}
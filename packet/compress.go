@@ -1,15 +1,108 @@
 package packet
 
-import "github.com/overtalk/qnet/pool"
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/overtalk/qnet/pool"
+)
+
+// CompressAlg a compression algorithm id, a zlib-compressed packet is marked by
+// FlagZLIB, and the others by FlagCompressAlg followed by the algorithm id.
+type CompressAlg uint8
+
+// compression algorithms
+const (
+	CompressNone CompressAlg = iota
+	CompressZlib
+	CompressFlate
+	CompressGzip
+	CompressLZ4
+)
+
+var compressAlgNames = [...]string{"none", "zlib", "flate", "gzip", "lz4"}
+
+func (alg CompressAlg) String() string {
+	if int(alg) < len(compressAlgNames) {
+		return compressAlgNames[alg]
+	}
+	return "unknown"
+}
+
+// error definitions
+var (
+	ErrInvalidCompressed = errors.New("invalid compressed data")
+	ErrUnknownCompress   = errors.New("unknown compression algorithm")
+)
+
+const defaultCompressPoolSize = 128
 
 // provide some methods to compress a packet of data
 var (
-	zlibPool *pool.ZlibWriterPool
+	zlibPool        = pool.NewZlibWriterPool(defaultCompressPoolSize)
+	zlibReaderPool  = pool.NewZlibReaderPool(defaultCompressPoolSize)
+	flatePool       = pool.NewFlateWriterPool(defaultCompressPoolSize)
+	flateReaderPool = pool.NewFlateReaderPool(defaultCompressPoolSize)
+	gzipPool        = pool.NewGzipWriterPool(defaultCompressPoolSize)
+	gzipReaderPool  = pool.NewGzipReaderPool(defaultCompressPoolSize)
+
+	// maxDecompressedSize the maximum size of a decompressed dataload, it's
+	// the maximum size of a reassembled packet by default, so an oversized
+	// packet can be decompressed. It's accessed atomically.
+	maxDecompressedSize int64 = DefaultMaxReassembledSize
 )
 
 // InitZlibPool initialize a zlibpool with a pool size
 func InitZlibPool(size int) {
 	zlibPool = pool.NewZlibWriterPool(size)
+	zlibReaderPool = pool.NewZlibReaderPool(size)
+}
+
+// InitCompressPool initialize the pools of all algorithms with a pool size
+func InitCompressPool(size int) {
+	InitZlibPool(size)
+	flatePool = pool.NewFlateWriterPool(size)
+	flateReaderPool = pool.NewFlateReaderPool(size)
+	gzipPool = pool.NewGzipWriterPool(size)
+	gzipReaderPool = pool.NewGzipReaderPool(size)
+}
+
+// SetMaxDecompressedSize set the maximum size of a decompressed dataload,
+// a larger one is rejected to prevent a zip bomb. It's concurrent safely.
+func SetMaxDecompressedSize(size int) {
+	atomic.StoreInt64(&maxDecompressedSize, int64(size))
+}
+
+// getMaxDecompressedSize get the maximum size of a decompressed dataload
+func getMaxDecompressedSize() int {
+	return int(atomic.LoadInt64(&maxDecompressedSize))
+}
+
+// Decompress get the decompressed dataload of a packet, the dataload itself is
+// returned if it's not compressed, otherwise a new allocated one.
+func Decompress(packet Packet) ([]byte, error) {
+	data := packet.GetDataLoad()
+	var reader *pool.CompressReader
+	switch packet.GetCompressAlg() {
+	case CompressNone:
+		return data, nil
+	case CompressLZ4:
+		return lz4Decompress(data, getMaxDecompressedSize())
+	case CompressZlib:
+		reader = zlibReaderPool.Get()
+	case CompressFlate:
+		reader = flateReaderPool.Get()
+	case CompressGzip:
+		reader = gzipReaderPool.Get()
+	default:
+		return nil, ErrUnknownCompress
+	}
+	defer reader.Free()
+	out, err := reader.Decompress(data, getMaxDecompressedSize())
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), out...), nil
 }
 
 // ICompresser a data compresser
@@ -18,6 +111,15 @@ type ICompresser interface {
 	Close()
 }
 
+// compressAlg get the algorithm of a compresser,
+// it's zlib if the compresser doesn't tell it.
+func compressAlg(compressor ICompresser) CompressAlg {
+	if c, ok := compressor.(interface{ Alg() CompressAlg }); ok {
+		return c.Alg()
+	}
+	return CompressZlib
+}
+
 // noneCompresser a compresser doing nothing
 type noneCompresser struct{}
 
@@ -26,6 +128,7 @@ var NoneCompresser = &noneCompresser{}
 
 func (*noneCompresser) Compress(b []byte) ([]byte, bool) { return b, false }
 func (*noneCompresser) Close()                           {}
+func (*noneCompresser) Alg() CompressAlg                 { return CompressNone }
 
 // zlibCompresser
 type zlibCompresser struct {
@@ -38,11 +141,14 @@ func NewZlibCompresser(minSize int) ICompresser {
 	return &zlibCompresser{minSize: minSize, writer: nil}
 }
 
-// Compress compress some data
+// Compress compress some data, it's not compressed if the result isn't smaller
 func (zc *zlibCompresser) Compress(b []byte) ([]byte, bool) {
 	if len(b) > zc.minSize {
 		zc.writer = zlibPool.Get()
-		return zc.writer.Compress(b), true
+		if out := zc.writer.Compress(b); len(out) < len(b) {
+			return out, true
+		}
+		zc.Close()
 	}
 	return b, false
 }
@@ -54,3 +160,108 @@ func (zc *zlibCompresser) Close() {
 		zc.writer = nil
 	}
 }
+
+// Alg get the compression algorithm
+func (zc *zlibCompresser) Alg() CompressAlg { return CompressZlib }
+
+// poolCompresser a compresser using a pooled writer
+type poolCompresser struct {
+	alg     CompressAlg
+	minSize int
+	pool    *pool.CompressWriterPool
+	writer  *pool.CompressWriter
+}
+
+// Compress compress some data, it's not compressed if the result isn't smaller
+func (pc *poolCompresser) Compress(b []byte) ([]byte, bool) {
+	if len(b) > pc.minSize {
+		pc.writer = pc.pool.Get()
+		if out := pc.writer.Compress(b); len(out) < len(b) {
+			return out, true
+		}
+		pc.Close()
+	}
+	return b, false
+}
+
+// Close close the compresser
+func (pc *poolCompresser) Close() {
+	if pc.writer != nil {
+		pc.writer.Free()
+		pc.writer = nil
+	}
+}
+
+// Alg get the compression algorithm
+func (pc *poolCompresser) Alg() CompressAlg { return pc.alg }
+
+// lz4Compresser a compresser of the LZ4-style block format
+type lz4Compresser struct {
+	minSize int
+}
+
+// Compress compress some data, it's not compressed if the result isn't smaller
+func (lc *lz4Compresser) Compress(b []byte) ([]byte, bool) {
+	if len(b) > lc.minSize {
+		if out := lz4Compress(b); len(out) < len(b) {
+			return out, true
+		}
+	}
+	return b, false
+}
+
+// Close close the compresser
+func (lc *lz4Compresser) Close() {}
+
+// Alg get the compression algorithm
+func (lc *lz4Compresser) Alg() CompressAlg { return CompressLZ4 }
+
+// NewCompresser create a compresser of the algorithm, only the data larger than
+// minSize is compressed. A compresser can't be used concurrently.
+func NewCompresser(alg CompressAlg, minSize int) ICompresser {
+	switch alg {
+	case CompressZlib:
+		return NewZlibCompresser(minSize)
+	case CompressFlate:
+		return &poolCompresser{alg: alg, minSize: minSize, pool: flatePool}
+	case CompressGzip:
+		return &poolCompresser{alg: alg, minSize: minSize, pool: gzipPool}
+	case CompressLZ4:
+		return &lz4Compresser{minSize: minSize}
+	default:
+		return NoneCompresser
+	}
+}
+
+// CompressAlgMask make a mask of the algorithms for the negotiation
+func CompressAlgMask(algs ...CompressAlg) uint8 {
+	var mask uint8
+	for _, alg := range algs {
+		if alg > CompressNone && alg < 8 {
+			mask |= 1 << alg
+		}
+	}
+	return mask
+}
+
+// ChooseCompressAlg choose the first preferred algorithm in the mask,
+// it's CompressNone if no one is in the mask.
+func ChooseCompressAlg(mask uint8, preferred ...CompressAlg) CompressAlg {
+	for _, alg := range preferred {
+		if alg > CompressNone && mask&CompressAlgMask(alg) != 0 {
+			return alg
+		}
+	}
+	return CompressNone
+}
+
+// NewCompressCmd create a cmd packet to negotiate the compression algorithm,
+// a client sends the mask of its supported algorithms, see CompressAlgMask,
+// and the server replies the chosen algorithm.
+func NewCompressCmd(connID uint32, value uint8) Packet {
+	packet := New(OptSizeCmd + 1)
+	packet.SetConnID(connID)
+	packet.SetProtoID(CmdCompress)
+	packet[2+OptSizeCmd] = value
+	return packet
+}
@@ -0,0 +1,160 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/overtalk/qnet/pool"
+)
+
+var compressAlgs = []CompressAlg{CompressZlib, CompressFlate, CompressGzip, CompressLZ4}
+
+func TestCompressRoundTrip(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		bytes.Repeat([]byte("hello, world!"), 10),
+		bytes.Repeat([]byte("abcd"), 3000),
+		bytes.Repeat([]byte{0}, 70000),
+		bytes.Repeat(random, 4),
+	}
+	for _, alg := range compressAlgs {
+		for _, data := range inputs {
+			packet := NewFromDataSeq(9, data, []byte("sign"), NewCompresser(alg, 0))
+			if packet.GetCompressAlg() != alg || !packet.IsCompressed() {
+				t.Fatalf("%s: %d bytes, compression flags %x", alg, len(data), packet.GetDataFlag())
+			}
+			if packet.GetSeq() != 9 || string(packet.GetDataSign()) != "sign" {
+				t.Fatalf("%s: seq %d, sign %q", alg, packet.GetSeq(), packet.GetDataSign())
+			}
+			out, err := Decompress(packet)
+			if err != nil || !bytes.Equal(out, data) {
+				t.Fatalf("%s: decompress %d bytes: %v", alg, len(data), err)
+			}
+		}
+	}
+}
+
+func TestCompressNotSmaller(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, alg := range compressAlgs {
+		packet := NewFromData([]byte("hello"), nil, NewCompresser(alg, 5))
+		if packet.IsCompressed() || packet.GetCompressAlg() != CompressNone {
+			t.Fatalf("%s: small data compressed", alg)
+		}
+		packet = NewFromData(random, nil, NewCompresser(alg, 0))
+		if packet.IsCompressed() || !bytes.Equal(packet.GetDataLoad(), random) {
+			t.Fatalf("%s: random data compressed", alg)
+		}
+	}
+}
+
+func TestLZ4Invalid(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	compressed := lz4Compress(data)
+	if len(compressed) >= len(data)/2 {
+		t.Fatalf("lz4 ratio: %d/%d", len(compressed), len(data))
+	}
+	if _, err := lz4Decompress(compressed, len(data)-1); err != pool.ErrDecompressTooLarge {
+		t.Fatalf("lz4 oversize: %v", err)
+	}
+	for i := 0; i < len(compressed); i++ {
+		// never panic with a truncated data
+		if _, err := lz4Decompress(compressed[:i], len(data)); err == nil {
+			t.Fatalf("lz4 truncated at %d", i)
+		}
+	}
+}
+
+func TestLZ4UntrustedSize(t *testing.T) {
+	// a tiny data claiming a large raw size never allocates the claimed size
+	claimed := append(binary.AppendUvarint(nil, 1<<30), 0x10, 'a')
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	before := stats.TotalAlloc
+	if _, err := lz4Decompress(claimed, 1<<30); err != ErrInvalidCompressed {
+		t.Fatalf("lz4 claimed size: %v", err)
+	}
+	runtime.ReadMemStats(&stats)
+	if allocated := stats.TotalAlloc - before; allocated > 1<<20 {
+		t.Fatalf("lz4 claimed size: allocated %d bytes", allocated)
+	}
+
+	// the buffer grows to decompress a data of a high ratio
+	data := bytes.Repeat([]byte{7}, 100000)
+	out, err := lz4Decompress(lz4Compress(data), len(data))
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("lz4 high ratio: %v", err)
+	}
+}
+
+func TestChooseCompressAlg(t *testing.T) {
+	mask := CompressAlgMask(CompressZlib, CompressLZ4)
+	if alg := ChooseCompressAlg(mask, CompressGzip, CompressLZ4, CompressZlib); alg != CompressLZ4 {
+		t.Fatalf("choose: %s", alg)
+	}
+	if alg := ChooseCompressAlg(mask, CompressGzip); alg != CompressNone {
+		t.Fatalf("choose unsupported: %s", alg)
+	}
+	cmd := NewCompressCmd(0, mask)
+	if cmd.GetCmd() != CmdCompress || cmd.GetCmdData()[0] != mask {
+		t.Fatalf("compress cmd: %v", cmd)
+	}
+}
+
+func TestCompressPolicy(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("hello"), 200)
+
+	policy := NewCompressPolicy(CompressLZ4, 10, 0.9)
+	policy.SetProbeInterval(10)
+	for i := 0; i < 100; i++ {
+		NewFromData(random, nil, policy.Compresser(1, 1))
+		NewFromData(text, nil, policy.Compresser(1, 2))
+		NewFromData([]byte("small"), nil, policy.Compresser(1, 3))
+	}
+
+	stats := policy.Stats()
+	randomStat, textStat := stats[MakeProtoID(1, 1)], stats[MakeProtoID(1, 2)]
+	if randomStat.Enabled || randomStat.Ratio < 1 || randomStat.Compressed != 0 ||
+		randomStat.Skipped < 80 || randomStat.Packets != 100 {
+		t.Fatalf("random data: %+v", randomStat)
+	}
+	if !textStat.Enabled || textStat.Ratio > 0.1 || textStat.Compressed != 100 || textStat.Skipped != 0 {
+		t.Fatalf("text data: %+v", textStat)
+	}
+	if smallStat := stats[MakeProtoID(1, 3)]; smallStat.Packets != 0 {
+		t.Fatalf("small data: %+v", smallStat)
+	}
+}
+
+func TestSetMaxDecompressedSize(t *testing.T) {
+	data := bytes.Repeat([]byte("abcd"), 1000)
+	packet := NewFromData(data, nil, NewCompresser(CompressLZ4, 0))
+	defer SetMaxDecompressedSize(DefaultMaxReassembledSize)
+
+	// setting while decompressing is safe, run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			SetMaxDecompressedSize(len(data) + i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := Decompress(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	SetMaxDecompressedSize(len(data) - 1)
+	if _, err := Decompress(packet); err != pool.ErrDecompressTooLarge {
+		t.Fatalf("oversize: %v", err)
+	}
+}
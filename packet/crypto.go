@@ -7,10 +7,12 @@ func SetCryptoSecret(sec []byte) {
 	defaultCryptoSecret = append([]byte{}, sec...)
 }
 
-// ICrypto a crypto to encrypt/decrypt a packet
+// ICrypto a crypto to encrypt/decrypt a packet, the result may be the packet
+// itself or a new allocated one, and a tampered packet can't be decrypted.
+// A cmd packet is never encrypted, Decrypt returns it as is, see Packet.IsCmd.
 type ICrypto interface {
-	Encrypt(Packet)
-	Decrypt(Packet)
+	Encrypt(Packet) (Packet, error)
+	Decrypt(Packet) (Packet, error)
 }
 
 type xorCrypto struct{}
@@ -51,16 +53,22 @@ func (xor *xorCrypto) encryptOrDecryptDataLoad(packet Packet) {
 	}
 }
 
-func (xor *xorCrypto) Encrypt(packet Packet) {
+func (xor *xorCrypto) Encrypt(packet Packet) (Packet, error) {
 	xor.encryptOrDecryptDataLoad(packet)
 	xor.encryptOrDecryptOptvals(packet)
 	packet.SetDataFlag(FlagXOR)
+	return packet, nil
 }
 
-func (xor *xorCrypto) Decrypt(packet Packet) {
-	if packet.HasDataFlag(FlagXOR) {
+func (xor *xorCrypto) Decrypt(packet Packet) (Packet, error) {
+	if packet.IsCmd() {
+		return packet, nil
+	}
+	// a truncated packet has no data flag, it's left to the parser
+	if len(packet) >= 2+OptSizeData && packet.HasDataFlag(FlagXOR) {
 		xor.encryptOrDecryptOptvals(packet)
 		xor.encryptOrDecryptDataLoad(packet)
 		packet.ClearDataFlag(FlagXOR)
 	}
+	return packet, nil
 }
@@ -0,0 +1,242 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func newAEADCryptos(t *testing.T) map[string]ICrypto {
+	gcm, err := NewAESGCMCrypto(bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chacha, err := NewChaCha20Crypto(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]ICrypto{"aes-gcm": gcm, "chacha20-poly1305": chacha}
+}
+
+// newDataPacket create a data packet, a packet of MID 0 is a cmd
+func newDataPacket(mid, aid uint8, data []byte) Packet {
+	packet := NewFromData(data, nil, NoneCompresser)
+	packet.SetProtoID(MakeProtoID(mid, aid))
+	return packet
+}
+
+func TestAEADCrypto(t *testing.T) {
+	for name, crypto := range newAEADCryptos(t) {
+		plain := NewFromDataSeq(5, []byte("hello, world"), []byte("sign"), NoneCompresser)
+		plain.SetProtoID(MakeProtoID(1, 2))
+		sealed, err := plain.Encrypt(crypto)
+		if err != nil {
+			t.Fatalf("%s: encrypt: %v", name, err)
+		}
+		if !sealed.HasDataFlag(FlagAEAD) || bytes.Contains(sealed, []byte("hello")) {
+			t.Fatalf("%s: not sealed: %v", name, sealed)
+		}
+		if _, err = Check(sealed); err != nil {
+			t.Fatalf("%s: sealed size: %v", name, err)
+		}
+		// the nonce is never reused
+		again, _ := plain.Encrypt(crypto)
+		if bytes.Equal(again, sealed) {
+			t.Fatalf("%s: nonce reused", name)
+		}
+
+		for i := 2 + 4; i < len(sealed); i++ {
+			tampered := append(Packet(nil), sealed...)
+			tampered[i] ^= 0x80
+			if _, err = tampered.Decrypt(crypto); err != ErrDecrypt {
+				t.Fatalf("%s: tampered byte %d: %v", name, i, err)
+			}
+		}
+
+		opened, err := sealed.Decrypt(crypto)
+		if err != nil || !bytes.Equal(opened, plain) {
+			t.Fatalf("%s: decrypt: %v, %v", name, err, opened)
+		}
+		if _, err = plain.Decrypt(crypto); err != ErrNotEncrypted {
+			t.Fatalf("%s: plain packet: %v", name, err)
+		}
+		if _, err = NewCompressCmd(0, 1).Decrypt(crypto); err != nil {
+			t.Fatalf("%s: cmd packet: %v", name, err)
+		}
+	}
+}
+
+func TestDecryptCmd(t *testing.T) {
+	SetCryptoSecret([]byte{0x12, 0x34})
+	cryptos := newAEADCryptos(t)
+	cryptos["xor"] = XORCrypto
+	// the key byte 1 is the flag byte of a data packet
+	key := bytes.Repeat([]byte{FlagAEAD | FlagXOR}, 32)
+	for name, crypto := range cryptos {
+		for _, cmd := range []Packet{NewHandshakeCmd(1, key), NewCompressCmd(1, FlagAEAD|FlagXOR)} {
+			out, err := append(Packet(nil), cmd...).Decrypt(crypto)
+			if err != nil || !bytes.Equal(out, cmd) {
+				t.Fatalf("%s: cmd %d decrypted: %v, %v", name, cmd.GetCmd(), err, out)
+			}
+		}
+	}
+}
+
+func TestXORCryptoMID(t *testing.T) {
+	SetCryptoSecret([]byte{0x21, 0x43})
+	for mid := 1; mid < 0x100; mid++ {
+		plain := newDataPacket(uint8(mid), 0x05, []byte("hello"))
+		encrypted, _ := append(Packet(nil), plain...).Encrypt(XORCrypto)
+		// the MID equal to the secret is encrypted to 0 as before
+		if encrypted.IsCmdProto() != (mid == 0x21) || encrypted.IsCmd() {
+			t.Fatalf("mid %x: encrypted as a cmd", mid)
+		}
+		if decrypted, err := encrypted.Decrypt(XORCrypto); err != nil || !bytes.Equal(decrypted, plain) {
+			t.Fatalf("mid %x: decrypt: %v", mid, err)
+		}
+	}
+}
+
+func TestAEADCryptoKey(t *testing.T) {
+	if _, err := NewAESGCMCrypto([]byte("short")); err == nil {
+		t.Fatal("aes-gcm: invalid key accepted")
+	}
+	if _, err := NewChaCha20Crypto([]byte("short")); err == nil {
+		t.Fatal("chacha20: invalid key accepted")
+	}
+	gcm, _ := NewAESGCMCrypto(bytes.Repeat([]byte{1}, 16))
+	other, _ := NewAESGCMCrypto(bytes.Repeat([]byte{3}, 16))
+	sealed, _ := newDataPacket(1, 1, []byte("hello")).Encrypt(gcm)
+	if _, err := sealed.Decrypt(other); err != ErrDecrypt {
+		t.Fatalf("another session's key: %v", err)
+	}
+}
+
+func TestKeyExchange(t *testing.T) {
+	client, err := NewKeyExchange(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewKeyExchange(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := NewHandshakeCmd(0, client.PublicKey())
+	if cmd.GetCmd() != CmdHandshake || !bytes.Equal(cmd.GetCmdData(), client.PublicKey()) {
+		t.Fatalf("handshake cmd: %v", cmd)
+	}
+	serverKeys, err := server.SessionKeys(cmd.GetCmdData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeys, err := client.SessionKeys(server.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientKeys.SendKey, serverKeys.RecvKey) || !bytes.Equal(clientKeys.RecvKey, serverKeys.SendKey) ||
+		!bytes.Equal(clientKeys.SignKey, serverKeys.SignKey) || bytes.Equal(clientKeys.SendKey, clientKeys.RecvKey) {
+		t.Fatalf("keys: %+v, %+v", clientKeys, serverKeys)
+	}
+
+	clientCrypto, _ := clientKeys.NewCrypto()
+	serverCrypto, _ := serverKeys.NewCrypto()
+	sealed, _ := newDataPacket(1, 1, []byte("hello")).Encrypt(clientCrypto)
+	if opened, err := sealed.Decrypt(serverCrypto); err != nil || string(opened.GetDataLoad()) != "hello" {
+		t.Fatalf("server decrypt: %v", err)
+	}
+	// a packet can't be reflected to its sender
+	sealed, _ = newDataPacket(1, 1, []byte("hello")).Encrypt(clientCrypto)
+	if _, err = sealed.Decrypt(clientCrypto); err != ErrDecrypt {
+		t.Fatalf("reflected packet: %v", err)
+	}
+
+	sign, _ := clientKeys.NewSignature().Sum(nil, []byte("data"))
+	if err = VerifySign(serverKeys.NewSignature(), nil, []byte("data"), sign); err != nil {
+		t.Fatalf("session signature: %v", err)
+	}
+	if _, err = server.SessionKeys([]byte("short")); err != ErrInvalidHandshake {
+		t.Fatalf("invalid public key: %v", err)
+	}
+}
+
+func TestResumeProof(t *testing.T) {
+	exchange := func() (*SessionKeys, *SessionKeys) {
+		client, _ := NewKeyExchange(true)
+		server, _ := NewKeyExchange(false)
+		clientKeys, err := client.SessionKeys(server.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverKeys, err := server.SessionKeys(client.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return clientKeys, serverKeys
+	}
+	resumedClient, resumedServer := exchange()
+	client, server := exchange()
+	token, _ := NewResumeToken()
+
+	cmd := NewResumeCmd(0, 3, token, NewResumeProof(resumedClient, client, token, 3))
+	if !cmd.IsCmd() || cmd.GetCmd() != CmdResume {
+		t.Fatalf("resume cmd: %v", cmd)
+	}
+	count, gotToken, proof, err := ParseResumeCmd(cmd)
+	if err != nil || count != 3 || !bytes.Equal(gotToken, token) {
+		t.Fatalf("parse: %d %x %v", count, gotToken, err)
+	}
+	if err = VerifyResumeProof(resumedServer, server, gotToken, count, proof); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	// the proof is bound to the count, the resumed keys and the new ones
+	_, attacker := exchange()
+	for _, keys := range [][2]*SessionKeys{{resumedServer, attacker}, {server, server}} {
+		if err = VerifyResumeProof(keys[0], keys[1], gotToken, count, proof); err != ErrInvalidResume {
+			t.Errorf("verify by other keys: %v", err)
+		}
+	}
+	if err = VerifyResumeProof(resumedServer, server, gotToken, count+1, proof); err != ErrInvalidResume {
+		t.Errorf("verify another count: %v", err)
+	}
+
+	// a new session is asked by a zero token
+	if _, gotToken, proof, err = ParseResumeCmd(NewResumeCmd(0, 0, nil, nil)); err != nil || gotToken != nil || proof != nil {
+		t.Errorf("empty token: %x %x %v", gotToken, proof, err)
+	}
+	if _, _, _, err = ParseResumeCmd(NewAckCmd(0, 1)); err != ErrInvalidResume {
+		t.Errorf("parse an ack cmd: %v", err)
+	}
+	if count, err = ParseAckCmd(NewAckCmd(0, 7)); err != nil || count != 7 {
+		t.Errorf("ack: %d %v", count, err)
+	}
+}
+
+func TestPacketSignAlg(t *testing.T) {
+	pack := NewFromDataSeq(1, []byte("data"), []byte("sign"), NoneCompresser)
+	if pack.GetSignAlg() != SignHMACSha1 {
+		t.Fatalf("default sign alg: %s", pack.GetSignAlg())
+	}
+	for _, alg := range []SignAlg{SignHMACSha256, SignEd25519, SignHMACSha1} {
+		pack.SetSignAlg(alg)
+		if pack.GetSignAlg() != alg || !pack.HasSeq() || string(pack.GetDataSign()) != "sign" ||
+			string(pack.GetDataLoad()) != "data" {
+			t.Fatalf("%s: %v", alg, pack)
+		}
+	}
+}
+
+func TestEd25519TokenBoundary(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := NewEd25519Signature(private)
+	sign, _ := signature.Sum([]byte("token"), []byte("data"))
+	if err = VerifySign(signature, []byte("token"), []byte("data"), sign); err != nil {
+		t.Fatal(err)
+	}
+	// the bytes moved between the token and the dataload are another message
+	if err = VerifySign(signature, []byte("tok"), []byte("endata"), sign); err != ErrInvalidSign {
+		t.Fatalf("shifted token: %v", err)
+	}
+}
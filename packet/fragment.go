@@ -0,0 +1,271 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// error definitions
+var (
+	ErrInvalidFragment    = errors.New("invalid packet fragment")
+	ErrReassembleTooLarge = errors.New("reassembled packet too large")
+	ErrTooManyFragments   = errors.New("too many fragmented packets")
+	ErrFragmentTimeout    = errors.New("fragmented packet timeout")
+)
+
+const (
+	// DefaultMaxReassembledSize the default maximum size of a reassembled packet
+	DefaultMaxReassembledSize = 4 * 1024 * 1024
+	// the default maximum number of the packets being reassembled of a
+	// connection
+	defaultMaxConnFragmentGroups = 8
+	// the default timeout of receiving all fragments of a packet
+	defaultFragmentTimeout = 10 * time.Second
+	// the room left in a fragment for the crypto, eg: the nonce and tag of AEAD
+	fragmentReservedSize = 64
+	// the maximum size of the body carried by a fragment
+	fragmentChunkSize = MaxPacketSize - 2 - OptSizeData - OptSizeFragment - fragmentReservedSize
+)
+
+// the id of the last fragmented packet, it's unique among the packets
+// being reassembled by a peer
+var lastFragmentID uint32
+
+// IsOversized check whether the packet is larger than MaxPacketSize,
+// it must be fragmented before sent.
+func (packet Packet) IsOversized() bool {
+	return len(packet) > MaxPacketSize
+}
+
+// IsFragment check whether it's a fragment of an oversized packet
+func (packet Packet) IsFragment() bool {
+	return len(packet) >= 2+OptSizeData && packet.HasDataFlag(FlagFragment)
+}
+
+// Fragment split an oversized packet into fragments, or return the packet
+// itself if it's not oversized. A fragment has the same header as the packet
+// with FlagFragment, and carries a chunk of the data after the data flag:
+//
+//	DATASIZE + CONNID + PROTOID + VER + FLAG + ID(2) + INDEX(2) + COUNT(2) + CHUNK
+//
+// Each fragment is encrypted by itself, and the packet must be reassembled
+// before reading the other fields.
+func Fragment(packet Packet) []Packet {
+	if !packet.IsOversized() {
+		return []Packet{packet}
+	}
+	body := packet[2+OptSizeData:]
+	count := (len(body) + fragmentChunkSize - 1) / fragmentChunkSize
+	id := uint16(atomic.AddUint32(&lastFragmentID, 1))
+	fragments := make([]Packet, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := body[i*fragmentChunkSize:]
+		if len(chunk) > fragmentChunkSize {
+			chunk = chunk[:fragmentChunkSize]
+		}
+		fragment := New(uint16(OptSizeData + OptSizeFragment + len(chunk)))
+		copy(fragment[2:2+OptSizeData], packet[2:2+OptSizeData])
+		fragment.SetDataFlag(FlagFragment)
+		index := 2 + OptSizeData
+		binary.BigEndian.PutUint16(fragment[index:], id)
+		binary.BigEndian.PutUint16(fragment[index+2:], uint16(i))
+		binary.BigEndian.PutUint16(fragment[index+4:], uint16(count))
+		copy(fragment[index+OptSizeFragment:], chunk)
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+// fragmentGroup the received fragments of a packet
+type fragmentGroup struct {
+	header   Packet
+	chunks   [][]byte
+	received int
+	size     int
+	deadline int64 // the unix nano time
+}
+
+// connFragments the packets being reassembled of a connection
+type connFragments struct {
+	groups map[uint16]*fragmentGroup
+	size   int // the size of the received chunks
+}
+
+// Reassembler reassemble the fragments of the oversized packets from a peer,
+// the fragments of a packet are grouped by the connection id and the id. Each
+// connection has its own limits, so a connection can't starve the others.
+type Reassembler struct {
+	maxSize       int
+	maxConnSize   int
+	maxConnGroups int
+	timeout       time.Duration
+
+	lock  sync.Mutex
+	conns map[uint32]*connFragments
+}
+
+// NewReassembler create a Reassembler struct, a reassembled packet must not
+// be larger than maxSize, eg: DefaultMaxReassembledSize.
+func NewReassembler(maxSize int) *Reassembler {
+	return &Reassembler{
+		maxSize:       maxSize,
+		maxConnSize:   maxSize,
+		maxConnGroups: defaultMaxConnFragmentGroups,
+		timeout:       defaultFragmentTimeout,
+		conns:         map[uint32]*connFragments{},
+	}
+}
+
+// SetMaxConnSize set the maximum size of the received fragments being
+// reassembled of a connection id, it's the maximum size of a reassembled
+// packet by default. It must be set before using the reassembler.
+func (r *Reassembler) SetMaxConnSize(size int) {
+	r.maxConnSize = size
+}
+
+// SetMaxConnGroups set the maximum number of the packets being reassembled
+// of a connection id, it must be set before using the reassembler.
+func (r *Reassembler) SetMaxConnGroups(n int) {
+	r.maxConnGroups = n
+}
+
+// SetTimeout set the timeout of receiving all fragments of a packet, the
+// expired packets are dropped, and they never expire if the timeout is 0. It
+// must be set before using the reassembler.
+func (r *Reassembler) SetTimeout(timeout time.Duration) {
+	r.timeout = timeout
+}
+
+// Pending get the number of the packets being reassembled
+func (r *Reassembler) Pending() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var n int
+	for _, conn := range r.conns {
+		n += len(conn.groups)
+	}
+	return n
+}
+
+// Remove drop the packets being reassembled of a closed connection
+func (r *Reassembler) Remove(connID uint32) {
+	r.lock.Lock()
+	delete(r.conns, connID)
+	r.lock.Unlock()
+}
+
+// Add add a decrypted fragment, it returns the reassembled packet when all
+// fragments are received, otherwise nil. The packet being reassembled is
+// dropped if an error occurs.
+func (r *Reassembler) Add(fragment Packet) (Packet, error) {
+	if !fragment.IsValid() {
+		return nil, ErrInvalidFragment
+	}
+	return r.AddFrom(fragment.GetConnID(), fragment)
+}
+
+// AddFrom add a decrypted fragment of a connection like Add, but the fragment
+// is grouped by the connID instead of the one in it, eg: the fragments from a
+// client are grouped by its session whatever their connID is.
+func (r *Reassembler) AddFrom(connID uint32, fragment Packet) (Packet, error) {
+	if !fragment.IsFragment() || len(fragment) < 2+OptSizeData+OptSizeFragment {
+		return nil, ErrInvalidFragment
+	}
+	index := 2 + OptSizeData
+	id := binary.BigEndian.Uint16(fragment[index:])
+	i := int(binary.BigEndian.Uint16(fragment[index+2:]))
+	count := int(binary.BigEndian.Uint16(fragment[index+4:]))
+	chunk := fragment[index+OptSizeFragment:]
+	now := time.Now().UnixNano()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	conn, ok := r.conns[connID]
+	if !ok {
+		conn = &connFragments{groups: map[uint16]*fragmentGroup{}}
+		r.conns[connID] = conn
+	}
+	group, ok := conn.groups[id]
+	if ok && group.deadline > 0 && now > group.deadline {
+		r.remove(connID, conn, id)
+		return nil, ErrFragmentTimeout
+	}
+	if !ok {
+		if count < 2 || count > r.maxSize/fragmentChunkSize+1 {
+			r.remove(connID, conn, id)
+			return nil, ErrInvalidFragment
+		}
+		r.expire(now)
+		if len(conn.groups) >= r.maxConnGroups {
+			r.remove(connID, conn, id)
+			return nil, ErrTooManyFragments
+		}
+		group = &fragmentGroup{
+			header: append(Packet(nil), fragment[:2+OptSizeData]...),
+			chunks: make([][]byte, count),
+		}
+		if r.timeout > 0 {
+			group.deadline = now + int64(r.timeout)
+		}
+		conn.groups[id] = group
+		// the connection is removed by expire if all its packets expired
+		r.conns[connID] = conn
+	}
+	if i >= len(group.chunks) || count != len(group.chunks) || group.chunks[i] != nil ||
+		fragment.GetProtoID() != group.header.GetProtoID() {
+		r.remove(connID, conn, id)
+		return nil, ErrInvalidFragment
+	}
+	if group.size+len(chunk) > r.maxSize {
+		r.remove(connID, conn, id)
+		return nil, ErrReassembleTooLarge
+	}
+	if conn.size+len(chunk) > r.maxConnSize {
+		r.remove(connID, conn, id)
+		return nil, ErrTooManyFragments
+	}
+	group.size += len(chunk)
+	conn.size += len(chunk)
+	group.chunks[i] = append([]byte(nil), chunk...)
+	group.received++
+	if group.received < count {
+		return nil, nil
+	}
+
+	r.remove(connID, conn, id)
+	packet := newPacket(OptSizeData + group.size)
+	copy(packet, group.header)
+	packet.setOversizedDataSize()
+	packet.ClearDataFlag(FlagFragment)
+	body := packet[2+OptSizeData:]
+	for _, chunk := range group.chunks {
+		body = body[copy(body, chunk):]
+	}
+	return packet, nil
+}
+
+// remove drop a packet being reassembled of a connection,
+// and the connection if it has no more packet.
+func (r *Reassembler) remove(connID uint32, conn *connFragments, id uint16) {
+	if group, ok := conn.groups[id]; ok {
+		conn.size -= group.size
+		delete(conn.groups, id)
+	}
+	if len(conn.groups) == 0 {
+		delete(r.conns, connID)
+	}
+}
+
+// expire drop the expired packets being reassembled
+func (r *Reassembler) expire(now int64) {
+	for connID, conn := range r.conns {
+		for id, group := range conn.groups {
+			if group.deadline > 0 && now > group.deadline {
+				r.remove(connID, conn, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package packet
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestFragment(t *testing.T) {
+	data := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	pack := NewFromDataSeq(3, data, []byte("sign"), NoneCompresser)
+	pack.SetConnID(9)
+	pack.SetProtoID(MakeProtoID(1, 2))
+	if !pack.IsOversized() || pack.GetDataSize() != 0 {
+		t.Fatalf("oversized packet: %d", pack.GetDataSize())
+	}
+	if small := NewFromData([]byte("small"), nil, NoneCompresser); len(Fragment(small)) != 1 {
+		t.Fatal("small packet fragmented")
+	}
+
+	crypto, _ := NewChaCha20Crypto(bytes.Repeat([]byte{1}, 32))
+	fragments := Fragment(pack)
+	reassembler := NewReassembler(DefaultMaxReassembledSize)
+	var whole Packet
+	// the fragments may arrive out of order
+	for i := len(fragments) - 1; i >= 0; i-- {
+		sealed, err := fragments[i].Encrypt(crypto)
+		if err != nil {
+			t.Fatalf("encrypt fragment %d: %v", i, err)
+		}
+		if _, err = Check(sealed); err != nil {
+			t.Fatalf("fragment %d size: %v", i, err)
+		}
+		opened, _ := sealed.Decrypt(crypto)
+		if whole, err = reassembler.Add(opened); err != nil || (whole != nil) != (i == 0) {
+			t.Fatalf("fragment %d: %v", i, err)
+		}
+	}
+	if !bytes.Equal(whole, pack) || whole.GetSeq() != 3 || !bytes.Equal(whole.GetDataLoad(), data) {
+		t.Fatal("reassembled packet")
+	}
+	if reassembler.Pending() != 0 {
+		t.Fatalf("pending: %d", reassembler.Pending())
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	pack := NewFromData(make([]byte, 200*1024), nil, NoneCompresser)
+	fragments := Fragment(pack)
+
+	reassembler := NewReassembler(100 * 1024)
+	var err error
+	for _, fragment := range fragments {
+		if _, err = reassembler.Add(fragment); err != nil {
+			break
+		}
+	}
+	if err != ErrInvalidFragment || reassembler.Pending() != 0 {
+		t.Fatalf("too many fragments: %v", err)
+	}
+
+	reassembler = NewReassembler(DefaultMaxReassembledSize)
+	reassembler.Add(fragments[0])
+	if _, err = reassembler.Add(fragments[0]); err != ErrInvalidFragment || reassembler.Pending() != 0 {
+		t.Fatalf("duplicate fragment: %v", err)
+	}
+
+	reassembler.SetMaxConnGroups(1)
+	reassembler.Add(fragments[0])
+	if _, err = reassembler.Add(Fragment(pack)[0]); err != ErrTooManyFragments {
+		t.Fatalf("too many groups: %v", err)
+	}
+	if _, err = reassembler.Add(pack[:100]); err != ErrInvalidFragment {
+		t.Fatalf("not a fragment: %v", err)
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	pack := NewFromData(make([]byte, 100*1024), nil, NoneCompresser)
+	reassembler := NewReassembler(DefaultMaxReassembledSize)
+	reassembler.SetTimeout(10 * time.Millisecond)
+	fragments := Fragment(pack)
+	if _, err := reassembler.Add(fragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := reassembler.Add(fragments[1]); err != ErrFragmentTimeout || reassembler.Pending() != 0 {
+		t.Fatalf("expired packet: %v, %d pending", err, reassembler.Pending())
+	}
+
+	// the expired packets are dropped for the new ones
+	reassembler.SetMaxConnGroups(1)
+	reassembler.Add(Fragment(pack)[0])
+	time.Sleep(20 * time.Millisecond)
+	fragments = Fragment(pack)
+	for i, fragment := range fragments {
+		if whole, err := reassembler.Add(fragment); err != nil || (whole != nil) != (i == len(fragments)-1) {
+			t.Fatalf("fragment %d after expired: %v", i, err)
+		}
+	}
+	if reassembler.Pending() != 0 {
+		t.Fatalf("pending: %d", reassembler.Pending())
+	}
+}
+
+func TestReassemblerConnLimits(t *testing.T) {
+	fragments := func(connID uint32, size int) []Packet {
+		pack := NewFromData(make([]byte, size), nil, NoneCompresser)
+		pack.SetConnID(connID)
+		return Fragment(pack)
+	}
+	reassembler := NewReassembler(DefaultMaxReassembledSize)
+	reassembler.SetMaxConnGroups(2)
+	reassembler.SetMaxConnSize(3 * fragmentChunkSize)
+	first := fragments(1, 100*1024)
+	for _, fragment := range [][]Packet{first, fragments(1, 100*1024)} {
+		if _, err := reassembler.Add(fragment[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := reassembler.Add(fragments(1, 100*1024)[0]); err != ErrTooManyFragments {
+		t.Fatalf("too many groups of a connection: %v", err)
+	}
+	if _, err := reassembler.Add(first[1]); err != nil {
+		t.Fatal(err)
+	}
+	// the packet exceeding the budget of its connection is dropped
+	if _, err := reassembler.Add(first[2]); err != ErrTooManyFragments || reassembler.Pending() != 1 {
+		t.Fatalf("connection budget: %v, %d pending", err, reassembler.Pending())
+	}
+
+	// the busy connections can't starve the others
+	for connID := uint32(2); connID < 100; connID++ {
+		if _, err := reassembler.Add(fragments(connID, 100*1024)[0]); err != nil {
+			t.Fatalf("connection %d: %v", connID, err)
+		}
+	}
+	other := fragments(100, 2*fragmentChunkSize)
+	for i, fragment := range other {
+		if whole, err := reassembler.Add(fragment); err != nil || (whole != nil) != (i == len(other)-1) {
+			t.Fatalf("fragment %d of another connection: %v", i, err)
+		}
+	}
+
+	reassembler.Remove(1)
+	if pending := reassembler.Pending(); pending != 98 {
+		t.Fatalf("pending after removed: %d", pending)
+	}
+}
+
+func TestReassemblerAddFrom(t *testing.T) {
+	reassembler := NewReassembler(DefaultMaxReassembledSize)
+	reassembler.SetMaxConnGroups(1)
+	pack := NewFromData(make([]byte, 100*1024), nil, NoneCompresser)
+	// the connID of a client's fragment is ignored
+	for connID := uint32(1); connID <= 2; connID++ {
+		fragment := Fragment(pack)[0]
+		fragment.SetConnID(connID)
+		if _, err := reassembler.AddFrom(0, fragment); (err == nil) != (connID == 1) {
+			t.Fatalf("connection %d: %v", connID, err)
+		}
+	}
+}
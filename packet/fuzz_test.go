@@ -0,0 +1,165 @@
+package packet
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// fuzzSeeds some valid packets for the fuzz targets
+func fuzzSeeds() [][]byte {
+	full, _ := NewBuilder(1, 2).Version(3).Seq(4).Compress(NewCompresser(CompressLZ4, 0)).
+		Sign(SignHMACSha1, []byte("sign")).Data(bytes.Repeat([]byte("hello"), 20)).Build()
+	return [][]byte{
+		NewPing(),
+		NewCompressCmd(1, 2),
+		NewFromData([]byte("hello"), nil, NoneCompresser),
+		NewFromDataSeq(1, []byte("hello"), []byte("sign"), NoneCompresser),
+		full,
+	}
+}
+
+func FuzzNewFromBytes(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		pack, err := NewFromBytes(b)
+		if err != nil {
+			return
+		}
+		if len(pack) != len(b) || int(pack.GetDataSize()) != len(b)-2 {
+			t.Fatalf("packet %d bytes, size %d, input %d bytes", len(pack), pack.GetDataSize(), len(b))
+		}
+		// a valid packet is parsed without panic
+		Parse(pack)
+	})
+}
+
+func FuzzCheck(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		size, err := Check(b)
+		if err == nil && (int(size) != len(b)-2 || len(b) < OptSizeCmd || len(b) > MaxPacketSize) {
+			t.Fatalf("size %d of %d bytes", size, len(b))
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		header, data, err := Parse(b)
+		if err != nil {
+			return
+		}
+		if header.IsCmd() {
+			return
+		}
+		// the getters agree with a parsed packet, and the header is encoded back
+		pack := Packet(b)
+		if !bytes.Equal(pack.GetDataLoad(), data) || pack.GetSeq() != header.Seq ||
+			pack.GetCompressAlg() != header.CompressAlg {
+			t.Fatalf("getters of %v: %+v", b, header)
+		}
+		out, err := header.Marshal(len(data))
+		if err != nil {
+			t.Fatalf("marshal %+v: %v", header, err)
+		}
+		if !bytes.Equal(append(out, data...), b) {
+			t.Fatalf("marshal %+v: %v != %v", header, out, b)
+		}
+		Decompress(pack)
+	})
+}
+
+func FuzzLZ4Decompress(f *testing.F) {
+	f.Add(lz4Compress(bytes.Repeat([]byte("0123456789"), 10)))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		lz4Decompress(b, 64*1024)
+	})
+}
+
+func FuzzReassembler(f *testing.F) {
+	for _, fragment := range Fragment(NewFromData(make([]byte, 40*1024), nil, NoneCompresser)) {
+		f.Add([]byte(fragment))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		NewReassembler(64 * 1024).Add(b)
+	})
+}
+
+// randomPacket build a random valid packet
+func randomPacket(r *rand.Rand) Packet {
+	data := make([]byte, r.Intn(2000))
+	r.Read(data[:len(data)/2])
+	builder := NewBuilder(uint8(1+r.Intn(255)), uint8(r.Intn(256))).
+		ConnID(r.Uint32()).Version(uint8(r.Intn(256))).Data(data)
+	if r.Intn(2) == 0 {
+		builder.Seq(r.Uint32())
+	}
+	if r.Intn(2) == 0 {
+		builder.Compress(NewCompresser(compressAlgs[r.Intn(len(compressAlgs))], 0))
+	}
+	if r.Intn(2) == 0 {
+		builder.SignWith(HMACSha1Signature, nil)
+	}
+	pack, err := builder.Build()
+	if err != nil {
+		panic(err)
+	}
+	return pack
+}
+
+func TestCryptoRoundTrip(t *testing.T) {
+	SetCryptoSecret([]byte{0x12, 0x34})
+	cryptos := newAEADCryptos(t)
+	cryptos["xor"] = XORCrypto
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		pack := randomPacket(r)
+		for name, crypto := range cryptos {
+			encrypted, err := append(Packet(nil), pack...).Encrypt(crypto)
+			if err != nil {
+				t.Fatalf("%s: encrypt: %v", name, err)
+			}
+			decrypted, err := encrypted.Decrypt(crypto)
+			if err != nil || !bytes.Equal(decrypted, pack) {
+				t.Fatalf("%s: decrypt %v: %v", name, pack, err)
+			}
+		}
+	}
+}
+
+func TestCompressSignRoundTrip(t *testing.T) {
+	SetSignSecret([]byte("secret"))
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		data := make([]byte, r.Intn(5000))
+		r.Read(data[:len(data)/3])
+		seq := r.Uint32()
+		alg := compressAlgs[r.Intn(len(compressAlgs))]
+		for _, signature := range []ISignature{HMACSha1Signature, HMACSha256Signature} {
+			pack, err := NewBuilder(1, 1).Seq(seq).Compress(NewCompresser(alg, 0)).
+				SignWith(signature, []byte("token")).Data(data).Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, _, err := Parse(pack)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			raw, err := Decompress(pack)
+			if err != nil || !bytes.Equal(raw, data) {
+				t.Fatalf("%s: decompress: %v", alg, err)
+			}
+			if err = VerifySign(signature, []byte("token"), SeqSignData(header.Seq, raw), header.Sign); err != nil {
+				t.Fatalf("%s: verify: %v", SignatureAlg(signature), err)
+			}
+		}
+	}
+}
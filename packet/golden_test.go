@@ -0,0 +1,272 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenVector a packet encoded by the fixed inputs, a client SDK validates
+// its implementation by encoding the same inputs to the same output.
+type goldenVector struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Inputs      map[string]string `json:"inputs"` // hex encoded
+	Output      string            `json:"output"` // hex encoded
+}
+
+const goldenFile = "golden.json"
+
+// golden inputs
+var (
+	goldenData       = []byte("hello")
+	goldenXORSecret  = []byte{0x12, 0x34}
+	goldenSignSecret = []byte("secret")
+	goldenToken      = []byte("token")
+	goldenEd25519    = bytes.Repeat([]byte{0x01}, ed25519.SeedSize)
+	goldenAEADKey    = bytes.Repeat([]byte{0x02}, chacha20poly1305.KeySize)
+	goldenClientKey  = bytes.Repeat([]byte{0x03}, 32)
+	goldenServerKey  = bytes.Repeat([]byte{0x04}, 32)
+	goldenResumeKey  = bytes.Repeat([]byte{0x05}, 32)
+	goldenResumeID   = bytes.Repeat([]byte{0x06}, ResumeTokenSize)
+)
+
+// goldenPlain the plain packet of the golden vectors
+func goldenPlain(t *testing.T) Packet {
+	pack, err := NewBuilder(1, 2).ConnID(5).Version(3).Seq(4).Data(goldenData).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pack
+}
+
+// goldenAEAD an AEAD crypto with a zero nonce prefix, the first nonce counter is 1
+func goldenAEAD(t *testing.T, alg string) ICrypto {
+	var crypto ICrypto
+	var err error
+	if alg == "aes-gcm" {
+		crypto, err = NewAESGCMCrypto(goldenAEADKey)
+	} else {
+		crypto, err = NewChaCha20Crypto(goldenAEADKey)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.(*aeadCrypto).prefix = [aeadNoncePrefixSize]byte{}
+	return crypto
+}
+
+func goldenVectors(t *testing.T) []goldenVector {
+	plain := goldenPlain(t)
+	header := map[string]string{
+		"conn_id": "00000005", "mid": "01", "aid": "02", "ver": "03", "seq": "00000004",
+		"data": hex.EncodeToString(goldenData),
+	}
+	with := func(kv ...string) map[string]string {
+		inputs := map[string]string{}
+		for k, v := range header {
+			inputs[k] = v
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			inputs[kv[i]] = kv[i+1]
+		}
+		return inputs
+	}
+	build := func(b *Builder) Packet {
+		pack, err := b.ConnID(5).Version(3).Seq(4).Data(goldenData).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pack
+	}
+	vectors := []goldenVector{{
+		Name:        "plain",
+		Description: "a packet with a sequence number",
+		Inputs:      with(),
+		Output:      hex.EncodeToString(plain),
+	}}
+
+	SetCryptoSecret(goldenXORSecret)
+	xor, _ := XORCrypto.Encrypt(append(Packet(nil), plain...))
+	vectors = append(vectors, goldenVector{
+		Name:        "xor",
+		Description: "the plain packet encrypted by XOR with the secret",
+		Inputs:      with("secret", hex.EncodeToString(goldenXORSecret)),
+		Output:      hex.EncodeToString(xor),
+	})
+
+	SetSignSecret(goldenSignSecret)
+	ed := NewEd25519Signature(ed25519.NewKeyFromSeed(goldenEd25519))
+	for _, s := range []struct {
+		name      string
+		signature ISignature
+		key       []byte
+	}{
+		{"hmac-sha1", HMACSha1Signature, goldenSignSecret},
+		{"hmac-sha256", HMACSha256Signature, goldenSignSecret},
+		{"ed25519", ed, goldenEd25519},
+	} {
+		vectors = append(vectors, goldenVector{
+			Name:        s.name,
+			Description: "a packet signed over SEQ + DATA, the key is the secret or the Ed25519 seed",
+			Inputs:      with("key", hex.EncodeToString(s.key), "token", hex.EncodeToString(goldenToken)),
+			Output:      hex.EncodeToString(build(NewBuilder(1, 2).SignWith(s.signature, goldenToken))),
+		})
+	}
+
+	lz4Data := bytes.Repeat(goldenData, 20)
+	lz4, err := NewBuilder(1, 2).ConnID(5).Version(3).Compress(NewCompresser(CompressLZ4, 0)).
+		Data(lz4Data).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors = append(vectors, goldenVector{
+		Name:        "lz4",
+		Description: "a packet compressed by LZ4 without a sequence number",
+		Inputs:      map[string]string{"conn_id": "00000005", "mid": "01", "aid": "02", "ver": "03", "data": hex.EncodeToString(lz4Data)},
+		Output:      hex.EncodeToString(lz4),
+	})
+
+	for _, alg := range []string{"aes-gcm", "chacha20-poly1305"} {
+		sealed, err := goldenAEAD(t, alg).Encrypt(append(Packet(nil), plain...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vectors = append(vectors, goldenVector{
+			Name:        alg,
+			Description: "the plain packet sealed by the key, the nonce is a zero prefix and the counter 1",
+			Inputs:      with("key", hex.EncodeToString(goldenAEADKey), "nonce", "000000000000000000000001"),
+			Output:      hex.EncodeToString(sealed),
+		})
+	}
+
+	client, err := ecdh.X25519().NewPrivateKey(goldenClientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ecdh.X25519().NewPrivateKey(goldenServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := (&KeyExchange{private: client, client: true}).SessionKeys(server.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors = append(vectors, goldenVector{
+		Name:        "handshake",
+		Description: "the client's handshake cmd, the output is the client's SendKey + RecvKey + SignKey",
+		Inputs: map[string]string{
+			"client_private": hex.EncodeToString(goldenClientKey),
+			"server_private": hex.EncodeToString(goldenServerKey),
+			"client_cmd":     hex.EncodeToString(NewHandshakeCmd(0, client.PublicKey().Bytes())),
+			"server_cmd":     hex.EncodeToString(NewHandshakeCmd(0, server.PublicKey().Bytes())),
+		},
+		Output: hex.EncodeToString(append(append(keys.SendKey, keys.RecvKey...), keys.SignKey...)),
+	})
+
+	// the client of the handshake reconnects by the resume private key
+	resumeClient, err := ecdh.X25519().NewPrivateKey(goldenResumeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumeKeys, err := (&KeyExchange{private: resumeClient, client: true}).SessionKeys(server.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors = append(vectors, goldenVector{
+		Name: "resume",
+		Description: "the resume cmd of 7 received messages, the token is proved by the ResumeKey of the " +
+			"handshake vector's keys and the keys of another handshake by the resume private key",
+		Inputs: map[string]string{
+			"resumed_key":    hex.EncodeToString(keys.ResumeKey),
+			"resume_private": hex.EncodeToString(goldenResumeKey),
+			"key":            hex.EncodeToString(resumeKeys.ResumeKey),
+			"token":          hex.EncodeToString(goldenResumeID),
+		},
+		Output: hex.EncodeToString(NewResumeCmd(0, 7, goldenResumeID, NewResumeProof(keys, resumeKeys, goldenResumeID, 7))),
+	})
+	return vectors
+}
+
+func TestGolden(t *testing.T) {
+	vectors := goldenVectors(t)
+	path := filepath.Join("testdata", goldenFile)
+	if *updateGolden {
+		b, err := json.MarshalIndent(vectors, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var golden []goldenVector
+	if err := json.Unmarshal(b, &golden); err != nil {
+		t.Fatal(err)
+	}
+	if len(golden) != len(vectors) {
+		t.Fatalf("%d golden vectors, expected %d", len(golden), len(vectors))
+	}
+	for i, v := range vectors {
+		if golden[i].Name != v.Name || golden[i].Output != v.Output {
+			t.Errorf("vector %s: got %s, golden %s %s", v.Name, v.Output, golden[i].Name, golden[i].Output)
+		}
+	}
+}
+
+// TestGoldenDecode decode the golden packets as a peer does
+func TestGoldenDecode(t *testing.T) {
+	plain := goldenPlain(t)
+	vectors := map[string][]byte{}
+	for _, v := range goldenVectors(t) {
+		vectors[v.Name], _ = hex.DecodeString(v.Output)
+	}
+
+	SetCryptoSecret(goldenXORSecret)
+	if got, _ := XORCrypto.Decrypt(vectors["xor"]); !bytes.Equal(got, plain) {
+		t.Errorf("xor: %x, expected %x", got, plain)
+	}
+	for _, alg := range []string{"aes-gcm", "chacha20-poly1305"} {
+		got, err := goldenAEAD(t, alg).Decrypt(vectors[alg])
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%s: %x %v, expected %x", alg, got, err, plain)
+		}
+	}
+	header, data, err := Parse(vectors["lz4"])
+	if err != nil || header.CompressAlg != CompressLZ4 {
+		t.Fatalf("lz4: %+v %v", header, err)
+	}
+	if got, err := Decompress(vectors["lz4"]); err != nil || !bytes.Equal(got, bytes.Repeat(goldenData, 20)) {
+		t.Errorf("lz4: %q %v, compressed %x", got, err, data)
+	}
+	ed := NewEd25519Verifier(ed25519.NewKeyFromSeed(goldenEd25519).Public().(ed25519.PublicKey))
+	for name, signature := range map[string]ISignature{
+		"hmac-sha1": HMACSha1Signature, "hmac-sha256": HMACSha256Signature, "ed25519": ed,
+	} {
+		header, data, err := Parse(vectors[name])
+		if err != nil || header.SignAlg != SignatureAlg(signature) {
+			t.Fatalf("%s: %+v %v", name, header, err)
+		}
+		if err := VerifySign(signature, goldenToken, SeqSignData(header.Seq, data), header.Sign); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package packet
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrInvalidHandshake the handshake packet or the peer's public key is invalid
+var ErrInvalidHandshake = errors.New("invalid handshake")
+
+// the HKDF info of the derived keys
+var (
+	handshakeInfoClientKey = []byte("qnet client to server")
+	handshakeInfoServerKey = []byte("qnet server to client")
+	handshakeInfoSignKey   = []byte("qnet sign")
+	handshakeInfoResumeKey = []byte("qnet resume")
+)
+
+// SessionKeys the per-session secrets derived by a handshake
+type SessionKeys struct {
+	// SendKey seal the sent packets, RecvKey open the received ones
+	SendKey []byte
+	RecvKey []byte
+	// SignKey sign the dataload
+	SignKey []byte
+	// ResumeKey prove a resume cmd is sent by the session, see NewResumeProof
+	ResumeKey []byte
+}
+
+// NewCrypto create a ChaCha20-Poly1305 ICrypto by the keys
+func (keys *SessionKeys) NewCrypto() (ICrypto, error) {
+	seal, err := chacha20poly1305.New(keys.SendKey)
+	if err != nil {
+		return nil, err
+	}
+	open, err := chacha20poly1305.New(keys.RecvKey)
+	if err != nil {
+		return nil, err
+	}
+	return NewDuplexAEADCrypto(seal, open)
+}
+
+// NewSignature create a hmac-sha1 signature by the sign key
+func (keys *SessionKeys) NewSignature() ISignature {
+	return NewHMACSha1Signature(keys.SignKey)
+}
+
+// KeyExchange an X25519 key exchange of a connection, a client sends its
+// public key by a CmdHandshake packet, the server replies its own, and both
+// derive the same SessionKeys.
+//
+// The exchange is unauthenticated: neither public key is signed, so an active
+// man-in-the-middle may exchange its own keys with both endpoints and read or
+// modify the traffic. It only protects against a passive eavesdropper, run it
+// over an authenticated transport such as TLS if an active attacker matters.
+type KeyExchange struct {
+	private *ecdh.PrivateKey
+	client  bool
+}
+
+// NewKeyExchange create a KeyExchange struct with a new generated key pair
+func NewKeyExchange(client bool) (*KeyExchange, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyExchange{private: private, client: client}, nil
+}
+
+// PublicKey get the public key sent to the peer
+func (kx *KeyExchange) PublicKey() []byte {
+	return kx.private.PublicKey().Bytes()
+}
+
+// SessionKeys derive the session keys by the peer's public key
+func (kx *KeyExchange) SessionKeys(peerKey []byte) (*SessionKeys, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+	shared, err := kx.private.ECDH(peer)
+	if err != nil {
+		return nil, ErrInvalidHandshake
+	}
+
+	// both public keys salt the derivation, the client's one is the first
+	salt := append(kx.PublicKey(), peerKey...)
+	if !kx.client {
+		salt = append(append([]byte{}, peerKey...), kx.PublicKey()...)
+	}
+	derive := func(info []byte) ([]byte, error) {
+		key := make([]byte, chacha20poly1305.KeySize)
+		_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, info), key)
+		return key, err
+	}
+	clientKey, err := derive(handshakeInfoClientKey)
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := derive(handshakeInfoServerKey)
+	if err != nil {
+		return nil, err
+	}
+	signKey, err := derive(handshakeInfoSignKey)
+	if err != nil {
+		return nil, err
+	}
+	resumeKey, err := derive(handshakeInfoResumeKey)
+	if err != nil {
+		return nil, err
+	}
+	if kx.client {
+		return &SessionKeys{SendKey: clientKey, RecvKey: serverKey, SignKey: signKey, ResumeKey: resumeKey}, nil
+	}
+	return &SessionKeys{SendKey: serverKey, RecvKey: clientKey, SignKey: signKey, ResumeKey: resumeKey}, nil
+}
+
+// NewHandshakeCmd create a cmd packet carrying a public key of the handshake
+func NewHandshakeCmd(connID uint32, publicKey []byte) Packet {
+	packet := New(uint16(OptSizeCmd + len(publicKey)))
+	packet.SetConnID(connID)
+	packet.SetProtoID(CmdHandshake)
+	copy(packet[2+OptSizeCmd:], publicKey)
+	return packet
+}
@@ -0,0 +1,290 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// error definitions of parsing a packet, they are wrapped by a ParseError
+var (
+	ErrTruncatedHeader = errors.New("truncated packet header")
+	ErrBadSignLength   = errors.New("bad signature length")
+	ErrBadFlags        = errors.New("bad data flags")
+)
+
+// ParseError a descriptive error of parsing a packet, it wraps the cause,
+// eg: errors.Is(err, ErrTruncatedHeader)
+type ParseError struct {
+	Err    error
+	Offset int    // the offset of the bad field
+	Detail string // the description of the bad field
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v at byte %d: %s", e.Err, e.Offset, e.Detail)
+}
+
+// Unwrap get the cause
+func (e *ParseError) Unwrap() error { return e.Err }
+
+func newParseError(err error, offset int, format string, args ...interface{}) error {
+	return &ParseError{Err: err, Offset: offset, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Header the fields of a packet before the dataload, the data flag is made by
+// the fields. A cmd packet only has the connection id and the proto id.
+type Header struct {
+	ConnID      uint32
+	MID         uint8
+	AID         uint8
+	Ver         uint8
+	HasSeq      bool
+	Seq         uint32
+	CompressAlg CompressAlg
+	SignAlg     SignAlg // it's SignHMACSha1 if not set for a sign
+	Sign        []byte
+}
+
+// IsCmd check whether it's the header of a cmd packet
+func (h *Header) IsCmd() bool { return h.MID == 0 }
+
+// Flag get the data flag made by the fields
+func (h *Header) Flag() uint8 {
+	var flag uint8
+	if h.HasSeq {
+		flag |= FlagSeq
+	}
+	switch h.CompressAlg {
+	case CompressNone:
+	case CompressZlib:
+		flag |= FlagZLIB
+	default:
+		flag |= FlagCompressAlg
+	}
+	if len(h.Sign) > 0 {
+		alg := h.SignAlg
+		if alg == SignNone {
+			alg = SignHMACSha1
+		}
+		flag |= uint8(alg) & FlagSignMask
+	}
+	return flag
+}
+
+// Size get the size of the header including the size field
+func (h *Header) Size() int {
+	if h.IsCmd() {
+		return 2 + OptSizeCmd
+	}
+	size := 2 + OptSizeData
+	if h.HasSeq {
+		size += OptSizeSeq
+	}
+	if h.CompressAlg > CompressZlib {
+		size++
+	}
+	if len(h.Sign) > 0 {
+		size += 1 + len(h.Sign)
+	}
+	return size
+}
+
+// Marshal encode the header of a packet with a dataLen-bytes dataload, the
+// size field of an oversized packet is 0.
+func (h *Header) Marshal(dataLen int) ([]byte, error) {
+	if len(h.Sign) > 0xFF {
+		return nil, newParseError(ErrBadSignLength, 0, "sign length %d > 255", len(h.Sign))
+	}
+	if h.SignAlg != SignNone && len(h.Sign) == 0 {
+		return nil, newParseError(ErrBadSignLength, 0, "empty %s sign", h.SignAlg)
+	}
+	if h.CompressAlg > CompressLZ4 {
+		return nil, newParseError(ErrUnknownCompress, 0, "compression algorithm %d", h.CompressAlg)
+	}
+	b := newPacket(h.Size() - 2 + dataLen)
+	b.SetConnID(h.ConnID)
+	b.SetProtoMID(h.MID)
+	b.SetProtoAID(h.AID)
+	if h.IsCmd() {
+		return b[:h.Size()], nil
+	}
+	b.SetProtoVer(h.Ver)
+	b.ResetDataFlag(h.Flag())
+	if h.HasSeq {
+		binary.BigEndian.PutUint32(b[2+OptSizeData:], h.Seq)
+	}
+	if h.CompressAlg > CompressZlib {
+		b[b.getCompressAlgIndex()] = byte(h.CompressAlg)
+	}
+	if len(h.Sign) > 0 {
+		b.SetDataSign(h.Sign)
+	}
+	return b[:h.Size()], nil
+}
+
+// Unmarshal decode the header of a packet, see Parse
+func (h *Header) Unmarshal(b []byte) error {
+	header, _, err := Parse(b)
+	if err == nil {
+		*h = *header
+	}
+	return err
+}
+
+// Parse parse a decrypted and reassembled packet into its header and dataload,
+// the dataload of a cmd packet is its cmd data. It never panics, and returns
+// a ParseError if the packet is invalid.
+func Parse(b []byte) (*Header, []byte, error) {
+	if len(b) < 2+OptSizeCmd {
+		return nil, nil, newParseError(ErrTruncatedHeader, len(b), "%d bytes < %d", len(b), 2+OptSizeCmd)
+	}
+	packet := Packet(b)
+	if size := int(packet.GetDataSize()); packet.IsOversized() && size != 0 ||
+		!packet.IsOversized() && size != len(b)-2 {
+		return nil, nil, newParseError(ErrInvalidSize, 0, "size field %d, %d bytes", size, len(b))
+	}
+	h := &Header{ConnID: packet.GetConnID(), MID: packet.GetProtoMID(), AID: packet.GetProtoAID()}
+	if packet.IsCmdProto() {
+		return h, packet.GetCmdData(), nil
+	}
+	if len(b) < 2+OptSizeData {
+		return nil, nil, newParseError(ErrTruncatedHeader, len(b), "%d bytes < %d", len(b), 2+OptSizeData)
+	}
+
+	h.Ver = packet.GetProtoVer()
+	flag := packet.GetDataFlag()
+	switch {
+	case flag&(FlagXOR|FlagAEAD) != 0:
+		return nil, nil, newParseError(ErrBadFlags, 9, "encrypted flag %#02x", flag)
+	case flag&FlagFragment != 0:
+		return nil, nil, newParseError(ErrBadFlags, 9, "fragment flag %#02x", flag)
+	case flag&FlagZLIB != 0 && flag&FlagCompressAlg != 0:
+		return nil, nil, newParseError(ErrBadFlags, 9, "zlib and compression algorithm flag %#02x", flag)
+	}
+
+	index := 2 + OptSizeData
+	if packet.HasSeq() {
+		if len(b) < index+OptSizeSeq {
+			return nil, nil, newParseError(ErrTruncatedHeader, index, "sequence number")
+		}
+		h.HasSeq, h.Seq = true, packet.GetSeq()
+		index += OptSizeSeq
+	}
+	if packet.HasDataFlag(FlagCompressAlg) {
+		if len(b) < index+1 {
+			return nil, nil, newParseError(ErrTruncatedHeader, index, "compression algorithm")
+		}
+		h.CompressAlg = CompressAlg(b[index])
+		if h.CompressAlg <= CompressZlib || h.CompressAlg > CompressLZ4 {
+			return nil, nil, newParseError(ErrUnknownCompress, index, "compression algorithm %d", b[index])
+		}
+		index++
+	} else if packet.IsZlibCompressed() {
+		h.CompressAlg = CompressZlib
+	}
+	if packet.HasDataSign() {
+		if len(b) < index+1 {
+			return nil, nil, newParseError(ErrTruncatedHeader, index, "sign length")
+		}
+		size := int(b[index])
+		if size == 0 || len(b) < index+1+size {
+			return nil, nil, newParseError(ErrBadSignLength, index, "sign length %d, %d bytes left", size, len(b)-index-1)
+		}
+		h.SignAlg = packet.GetSignAlg()
+		h.Sign = b[index+1 : index+1+size]
+		index += 1 + size
+	}
+	return h, b[index:], nil
+}
+
+// Validate check whether the packet can be parsed, see Parse
+func (packet Packet) Validate() error {
+	_, _, err := Parse(packet)
+	return err
+}
+
+// Builder build a packet by the header fields and the dataload, the sizes and
+// the data flag are computed when building.
+type Builder struct {
+	header     Header
+	data       []byte
+	compressor ICompresser
+	signature  ISignature
+	token      []byte
+}
+
+// NewBuilder create a Builder struct of a proto
+func NewBuilder(mid, aid uint8) *Builder {
+	return &Builder{header: Header{MID: mid, AID: aid}, compressor: NoneCompresser}
+}
+
+// ConnID set the connection id
+func (b *Builder) ConnID(id uint32) *Builder {
+	b.header.ConnID = id
+	return b
+}
+
+// Version set the proto version
+func (b *Builder) Version(ver uint8) *Builder {
+	b.header.Ver = ver
+	return b
+}
+
+// Seq set the sequence number
+func (b *Builder) Seq(seq uint32) *Builder {
+	b.header.HasSeq, b.header.Seq = true, seq
+	return b
+}
+
+// Compress compress the dataload by the compresser
+func (b *Builder) Compress(compressor ICompresser) *Builder {
+	b.compressor = compressor
+	return b
+}
+
+// Sign set a calculated signature
+func (b *Builder) Sign(alg SignAlg, sign []byte) *Builder {
+	b.header.SignAlg, b.header.Sign = alg, sign
+	return b
+}
+
+// SignWith sign the raw dataload and the sequence number by the signature
+// when building, see SeqSignData.
+func (b *Builder) SignWith(signature ISignature, token []byte) *Builder {
+	b.signature, b.token = signature, token
+	return b
+}
+
+// Data set the raw dataload
+func (b *Builder) Data(data []byte) *Builder {
+	b.data = data
+	return b
+}
+
+// Build build the packet, it may be oversized, see Fragment.
+func (b *Builder) Build() (Packet, error) {
+	header := b.header
+	if b.signature != nil {
+		data := b.data
+		if header.HasSeq {
+			data = SeqSignData(header.Seq, data)
+		}
+		sign, err := b.signature.Sum(b.token, data)
+		if err != nil {
+			return nil, err
+		}
+		header.SignAlg, header.Sign = SignatureAlg(b.signature), sign
+	}
+	data, compressed := b.compressor.Compress(b.data)
+	defer b.compressor.Close()
+	header.CompressAlg = CompressNone
+	if compressed {
+		header.CompressAlg = compressAlg(b.compressor)
+	}
+	out, err := header.Marshal(len(data))
+	if err != nil {
+		return nil, err
+	}
+	return append(out, data...), nil
+}
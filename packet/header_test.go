@@ -0,0 +1,102 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	data := bytes.Repeat([]byte("hello"), 100)
+	pack, err := NewBuilder(1, 2).ConnID(3).Version(4).Seq(5).
+		Compress(NewCompresser(CompressLZ4, 10)).
+		SignWith(HMACSha256Signature, []byte("token")).
+		Data(data).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Check(pack); err != nil {
+		t.Fatalf("size: %v", err)
+	}
+	header, load, err := Parse(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.ConnID != 3 || header.MID != 1 || header.AID != 2 || header.Ver != 4 ||
+		!header.HasSeq || header.Seq != 5 || header.CompressAlg != CompressLZ4 ||
+		header.SignAlg != SignHMACSha256 || !bytes.Equal(load, pack.GetDataLoad()) {
+		t.Fatalf("header: %+v", header)
+	}
+	raw, _ := Decompress(pack)
+	if !bytes.Equal(raw, data) {
+		t.Fatal("dataload")
+	}
+	if err = VerifySign(HMACSha256Signature, []byte("token"), SeqSignData(5, raw), header.Sign); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	// the header is the same as the one of NewFromData
+	legacy := NewFromDataSeq(5, []byte("data"), []byte("sign"), NoneCompresser)
+	legacy.SetProtoID(MakeProtoID(1, 1))
+	built, _ := NewBuilder(1, 1).Seq(5).Sign(SignHMACSha1, []byte("sign")).Data([]byte("data")).Build()
+	if !bytes.Equal(legacy, built) {
+		t.Fatalf("builder: %v, NewFromData: %v", built, legacy)
+	}
+
+	var h Header
+	if err = h.Unmarshal(NewCompressCmd(7, 1)); err != nil || !h.IsCmd() || h.ConnID != 7 || h.AID != CmdCompress {
+		t.Fatalf("cmd header: %+v, %v", h, err)
+	}
+	if _, err = NewBuilder(1, 1).Sign(SignHMACSha1, make([]byte, 256)).Build(); !errors.Is(err, ErrBadSignLength) {
+		t.Fatalf("long sign: %v", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	pack, _ := NewBuilder(1, 2).Seq(5).Compress(NewCompresser(CompressLZ4, 0)).
+		Sign(SignHMACSha1, []byte("sign")).Data(bytes.Repeat([]byte("a"), 100)).Build()
+	// a truncated packet never panics
+	for i := 0; i < len(pack); i++ {
+		truncated := append(Packet(nil), pack[:i]...)
+		if i >= 2 {
+			truncated.SetDataSize(uint16(i - 2))
+		}
+		if _, _, err := Parse(truncated); err == nil && i < 2+OptSizeData+OptSizeSeq+1+1+4 {
+			t.Fatalf("truncated at %d", i)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		modify func(Packet)
+		err    error
+	}{
+		{"size", func(p Packet) { p.SetDataSize(3) }, ErrInvalidSize},
+		{"encrypted", func(p Packet) { p.SetDataFlag(FlagXOR) }, ErrBadFlags},
+		{"fragment", func(p Packet) { p.SetDataFlag(FlagFragment) }, ErrBadFlags},
+		{"compression", func(p Packet) { p.SetDataFlag(FlagZLIB) }, ErrBadFlags},
+		{"algorithm", func(p Packet) { p[2+OptSizeData+OptSizeSeq] = 9 }, ErrUnknownCompress},
+		{"sign length", func(p Packet) { p[2+OptSizeData+OptSizeSeq+1] = 0xFF }, ErrBadSignLength},
+		{"empty sign", func(p Packet) { p[2+OptSizeData+OptSizeSeq+1] = 0 }, ErrBadSignLength},
+	}
+	for _, c := range cases {
+		bad := append(Packet(nil), pack...)
+		c.modify(bad)
+		_, _, err := Parse(bad)
+		var parseErr *ParseError
+		if !errors.Is(err, c.err) || !errors.As(err, &parseErr) || bad.Validate() == nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestNewFromBytes(t *testing.T) {
+	pack := NewFromData([]byte("hello"), nil, NoneCompresser)
+	got, err := NewFromBytes(pack)
+	if err != nil || !bytes.Equal(got, pack) {
+		t.Fatalf("NewFromBytes: %v, %v", got, err)
+	}
+	if _, err = NewFromBytes(pack[:len(pack)-1]); err != ErrInvalidSize {
+		t.Fatalf("truncated: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package packet
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// NewPingCmd create a ping carrying the sending time, the cmd data is:
+//
+//	UNIXNANO(8)
+//
+// The peer replies a CmdPong echoing the time to measure the RTT, and a
+// ping without the time is the same as a PingPacket.
+func NewPingCmd(connID uint32, now time.Time) Packet {
+	packet := New(OptSizeCmd + 8)
+	packet.SetConnID(connID)
+	packet.SetProtoID(CmdPing)
+	binary.BigEndian.PutUint64(packet[2+OptSizeCmd:], uint64(now.UnixNano()))
+	return packet
+}
+
+// NewPongCmd create a pong echoing the time of a ping
+func NewPongCmd(ping Packet) Packet {
+	data := ping.GetCmdData()
+	packet := New(uint16(OptSizeCmd + len(data)))
+	packet.SetConnID(ping.GetConnID())
+	packet.SetProtoID(CmdPong)
+	copy(packet[2+OptSizeCmd:], data)
+	return packet
+}
+
+// ParsePingTime get the sending time of a ping or a pong,
+// it returns false if the time is absent.
+func ParsePingTime(packet Packet) (time.Time, bool) {
+	data := packet.GetCmdData()
+	if len(data) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), true
+}
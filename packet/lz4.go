@@ -0,0 +1,181 @@
+package packet
+
+import (
+	"encoding/binary"
+
+	"github.com/overtalk/qnet/pool"
+)
+
+// An LZ4-style block compression, it's fast but the ratio is lower than zlib.
+// The compressed data is the uvarint size of the raw data followed by the
+// sequences, each sequence is:
+//   token(1 byte): literals length(4 bits) + match length - 4(4 bits)
+//   [extended literals length] + literals
+//   offset(2 bytes, little endian) + [extended match length]
+// A length of 15 is extended by the following bytes until a byte < 255,
+// and the last sequence only has the literals.
+
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // the last 5 bytes are always literals
+	lz4MFLimit      = 12 // the last match starts 12 bytes before the end
+	lz4MaxOffset    = 0xFFFF
+	lz4HashLog      = 12
+	lz4InitRatio    = 4 // the initial decompressing capacity per compressed byte
+)
+
+func lz4Hash(seq uint32) uint32 {
+	return (seq * 2654435761) >> (32 - lz4HashLog)
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 0xFF; n -= 0xFF {
+		dst = append(dst, 0xFF)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4AppendSequence append a sequence, matchLen is 0 for the last one
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	litLen, ml := len(literals), matchLen-lz4MinMatch
+	var token byte
+	if litLen >= 0x0F {
+		token = 0xF0
+	} else {
+		token = byte(litLen << 4)
+	}
+	if matchLen > 0 {
+		if ml >= 0x0F {
+			token |= 0x0F
+		} else {
+			token |= byte(ml)
+		}
+	}
+	dst = append(dst, token)
+	if litLen >= 0x0F {
+		dst = lz4AppendLength(dst, litLen-0x0F)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if ml >= 0x0F {
+		dst = lz4AppendLength(dst, ml-0x0F)
+	}
+	return dst
+}
+
+// lz4Compress compress the data into a new allocated buffer
+func lz4Compress(src []byte) []byte {
+	srcLen := len(src)
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+srcLen+srcLen/0xFF+16)
+	dst = dst[:binary.PutUvarint(dst, uint64(srcLen))]
+
+	// the position+1 of the last 4 bytes with the same hash
+	var table [1 << lz4HashLog]int32
+	anchor := 0
+	for i := 0; i <= srcLen-lz4MFLimit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(seq)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		matchLen := lz4MinMatch
+		for i+matchLen < srcLen-lz4LastLiterals && src[ref+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, matchLen)
+		i += matchLen
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+func lz4ReadLength(src []byte, i, n int) (int, int, error) {
+	for {
+		if i >= len(src) {
+			return 0, 0, ErrInvalidCompressed
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 0xFF {
+			return n, i, nil
+		}
+	}
+}
+
+// lz4Decompress decompress the data into a new allocated buffer,
+// the raw data must not be larger than maxSize
+func lz4Decompress(src []byte, maxSize int) ([]byte, error) {
+	rawSize, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, ErrInvalidCompressed
+	}
+	if rawSize > uint64(maxSize) {
+		return nil, pool.ErrDecompressTooLarge
+	}
+	size := int(rawSize)
+	src = src[n:]
+	// the size is untrusted, the buffer grows by appending beyond a capacity
+	// relative to the compressed data
+	capacity := lz4InitRatio*len(src) + 64
+	if capacity > size {
+		capacity = size
+	}
+	dst := make([]byte, 0, capacity)
+
+	var err error
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		litLen := int(token >> 4)
+		if litLen == 0x0F {
+			if litLen, i, err = lz4ReadLength(src, i, litLen); err != nil {
+				return nil, err
+			}
+		}
+		if litLen > len(src)-i || litLen > size-len(dst) {
+			return nil, ErrInvalidCompressed
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		if i == len(src) {
+			// the last sequence
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, ErrInvalidCompressed
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, ErrInvalidCompressed
+		}
+		matchLen := int(token & 0x0F)
+		if matchLen == 0x0F {
+			if matchLen, i, err = lz4ReadLength(src, i, matchLen); err != nil {
+				return nil, err
+			}
+		}
+		matchLen += lz4MinMatch
+		if matchLen > size-len(dst) {
+			return nil, ErrInvalidCompressed
+		}
+		// the match may overlap the bytes being copied
+		start := len(dst) - offset
+		for k := 0; k < matchLen; k++ {
+			dst = append(dst, dst[start+k])
+		}
+	}
+	if len(dst) != size {
+		return nil, ErrInvalidCompressed
+	}
+	return dst, nil
+}
@@ -30,18 +30,57 @@ const (
 	// packet size
 	OptSizeCmd    = 6
 	OptSizeData   = 8
+	OptSizeSeq    = 4
 	MaxPacketSize = 32 * 1024
+	// OptSizeFragment the size of the fragment header, see Fragment
+	OptSizeFragment = 6
 
 	// data flags
 	FlagZLIB     = 0x01
 	FlagXOR      = 0x02
 	FlagHMACSha1 = 0x04
+	// the signature bits 0x0C mark the signature algorithm, see SignAlg
+	FlagHMACSha256 = 0x08
+	FlagEd25519    = 0x0C
+	FlagSignMask   = 0x0C
+	// FlagSeq a 4-bytes sequence number follows the data flag, a client sets
+	// it to pipeline requests, and the response echoes the sequence number.
+	FlagSeq = 0x10
+	// FlagAEAD the data after the flag is sealed by an AEAD crypto, a nonce
+	// follows the data flag, and the authentication tag ends the packet
+	FlagAEAD = 0x20
+	// FlagCompressAlg the dataload is compressed by an algorithm other than
+	// zlib, and the 1-byte algorithm id follows the sequence number
+	FlagCompressAlg = 0x40
+	// FlagFragment the packet is a fragment of an oversized packet
+	FlagFragment = 0x80
 
 	// cmd id
 	CmdPing     = 0x0000
 	CmdRegister = 0x0001
+	CmdCompress = 0x0002
+	// CmdHandshake exchange the public keys to derive the session keys
+	CmdHandshake = 0x0003
+	// CmdClose an agent server tells the client of the conn id is closed
+	CmdClose = 0x0004
+	// CmdResume resume a session after reconnected, see NewResumeCmd
+	CmdResume = 0x0005
+	// CmdAck acknowledge the messages received in a resumable session
+	CmdAck = 0x0006
+	// CmdPong reply a ping carrying the sending time, see NewPingCmd
+	CmdPong = 0x0007
 )
 
+// cmdDataSizes the payload sizes of the cmds long enough to have a data flag,
+// a new cmd must be added to be told from a XOR-encrypted packet, see IsCmd.
+var cmdDataSizes = map[uint16]int{
+	CmdHandshake: 32,
+	CmdResume:    resumeCmdSize,
+	CmdAck:       4,
+	CmdPing:      8,
+	CmdPong:      8,
+}
+
 // Packet a agent protocol
 type Packet []byte
 
@@ -52,6 +91,23 @@ func New(datasize uint16) Packet {
 	return pack
 }
 
+// newPacket create a Packet which may be oversized, the size field of an
+// oversized one is 0 because it must be fragmented before sent.
+func newPacket(datasize int) Packet {
+	pack := Packet(make([]byte, 2+datasize))
+	pack.setOversizedDataSize()
+	return pack
+}
+
+// setOversizedDataSize set the size field by the length of the packet
+func (packet Packet) setOversizedDataSize() {
+	if packet.IsOversized() {
+		packet.SetDataSize(0)
+	} else {
+		packet.SetDataSize(uint16(len(packet) - 2))
+	}
+}
+
 // Check check whether it's a valid packet
 func Check(b []byte) (uint16, error) {
 	dataLen := len(b)
@@ -68,24 +124,50 @@ func Check(b []byte) (uint16, error) {
 // NewFromBytes create a Packet from a raw bytes
 func NewFromBytes(b []byte) (Packet, error) {
 	dataSize, err := Check(b)
-	return Packet(b[:dataSize]), err
+	if err != nil {
+		return nil, err
+	}
+	return Packet(b[:2+int(dataSize)]), nil
 }
 
-// NewFromData create a Packet from a data
+// NewFromData create a Packet from a data, it's oversized if the data is
+// too large, see Fragment.
 func NewFromData(data, sign []byte, compressor ICompresser) Packet {
+	return newFromData(data, sign, compressor, false, 0)
+}
+
+// NewFromDataSeq create a Packet with a sequence number from a data
+func NewFromDataSeq(seq uint32, data, sign []byte, compressor ICompresser) Packet {
+	return newFromData(data, sign, compressor, true, seq)
+}
+
+func newFromData(data, sign []byte, compressor ICompresser, hasSeq bool, seq uint32) Packet {
 	var compressed bool
 	data, compressed = compressor.Compress(data)
-	if signSize := len(sign); signSize > 0 {
-		packet := New(uint16(OptSizeData + 1 + signSize + len(data)))
-		packet.SetZlibCompressed(compressed)
+	alg := CompressNone
+	dataSize := OptSizeData + len(data)
+	if hasSeq {
+		dataSize += OptSizeSeq
+	}
+	if compressed {
+		alg = compressAlg(compressor)
+		if alg != CompressZlib {
+			dataSize++
+		}
+	}
+	signSize := len(sign)
+	if signSize > 0 {
+		dataSize += 1 + signSize
+	}
+	packet := newPacket(dataSize)
+	if hasSeq {
+		packet.SetSeq(seq)
+	}
+	packet.SetCompressAlg(alg)
+	if signSize > 0 {
 		packet.SetDataFlag(FlagHMACSha1)
 		packet.SetDataSign(sign)
-		packet.SetDataLoad(data)
-		compressor.Close()
-		return packet
 	}
-	packet := New(uint16(OptSizeData + len(data)))
-	packet.SetZlibCompressed(compressed)
 	packet.SetDataLoad(data)
 	compressor.Close()
 	return packet
@@ -112,6 +194,15 @@ func NewRegister(sid uint32) Packet {
 	return packet
 }
 
+// NewClose create a ClosePacket of a conn id
+// which is DATASIZE + CONNID + PROTOID
+func NewClose(connID uint32) Packet {
+	packet := New(OptSizeCmd)
+	packet.SetConnID(connID)
+	packet.SetProtoID(CmdClose)
+	return packet
+}
+
 // MakeProtoID make a proto id by the mid and aid
 func MakeProtoID(mid, aid uint8) uint16 {
 	return uint16(mid)<<8 + uint16(aid)
@@ -131,14 +222,37 @@ func (packet Packet) IsValid() bool {
 func (packet Packet) IsCmdSize() bool { return packet.GetDataSize() == OptSizeCmd }
 func (packet Packet) GetCmd() uint16  { return binary.BigEndian.Uint16(packet[6:8]) }
 
+// GetCmdData get the payload of a cmd packet
+func (packet Packet) GetCmdData() []byte { return packet[2+OptSizeCmd:] }
+
 // IsCmdProto check whether it's a cmd proto
 func (packet Packet) IsCmdProto() bool {
 	// cmd proto[6-7]: 0x0000 ~ 0x00FF
 	return packet[6] == 0
 }
 
-func (packet Packet) Encrypt(crypto ICrypto)      { crypto.Encrypt(packet) }
-func (packet Packet) Decrypt(crypto ICrypto)      { crypto.Decrypt(packet) }
+// IsCmd check whether it's a cmd packet, it's reliable before decrypting: a cmd
+// is never encrypted and the header of an AEAD-encrypted packet is plain. But
+// the MID of a XOR-encrypted packet may be 0, such a packet flagged by FlagXOR
+// is taken as a cmd only if its cmd id and size match a known cmd's, so a
+// XOR-encrypted packet matching both is still ambiguous.
+func (packet Packet) IsCmd() bool {
+	if !packet.IsValid() {
+		return false
+	}
+	if packet.IsCmdSize() {
+		return true
+	}
+	if !packet.IsCmdProto() {
+		return false
+	}
+	if len(packet) < 2+OptSizeData || !packet.HasDataFlag(FlagXOR) {
+		return true
+	}
+	size, ok := cmdDataSizes[packet.GetCmd()]
+	return ok && int(packet.GetDataSize()) == OptSizeCmd+size
+}
+
 func (packet Packet) GetDataSize() uint16         { return binary.BigEndian.Uint16(packet[:2]) }
 func (packet Packet) SetDataSize(datasize uint16) { binary.BigEndian.PutUint16(packet[:2], datasize) }
 func (packet Packet) GetConnID() uint32           { return binary.BigEndian.Uint32(packet[2:6]) }
@@ -154,6 +268,16 @@ func (packet Packet) SetProtoVer(version uint8)   { packet[8] = version }
 func (packet Packet) GetDataFlag() uint8          { return packet[9] }
 func (packet Packet) SetDataFlag(flag uint8)      { packet[9] |= flag }
 
+// Encrypt encrypt the packet by a crypto, the result may be a new packet
+func (packet Packet) Encrypt(crypto ICrypto) (Packet, error) {
+	return crypto.Encrypt(packet)
+}
+
+// Decrypt decrypt the packet by a crypto, the result may be a new packet
+func (packet Packet) Decrypt(crypto ICrypto) (Packet, error) {
+	return crypto.Decrypt(packet)
+}
+
 // HasDataFlag check whether it has a data flag
 func (packet Packet) HasDataFlag(flag uint8) bool {
 	return packet[9]&flag == flag
@@ -175,6 +299,17 @@ func (packet Packet) HasDataSign() bool {
 	return packet[9]&0x0C != 0
 }
 
+// GetSignAlg get the signature algorithm
+func (packet Packet) GetSignAlg() SignAlg {
+	return SignAlg(packet[9] & FlagSignMask)
+}
+
+// SetSignAlg set the signature algorithm, a packet with a signature is
+// marked as hmac-sha1 when created, it can be changed by this.
+func (packet Packet) SetSignAlg(alg SignAlg) {
+	packet[9] = packet[9]&^FlagSignMask | uint8(alg)&FlagSignMask
+}
+
 // SetZlibCompressed set the data flag: ZLIB
 func (packet Packet) SetZlibCompressed(compressed bool) {
 	if compressed {
@@ -187,22 +322,90 @@ func (packet Packet) IsZlibCompressed() bool {
 	return packet.HasDataFlag(FlagZLIB)
 }
 
+// HasSeq check whether it has a sequence number
+func (packet Packet) HasSeq() bool {
+	return packet.HasDataFlag(FlagSeq)
+}
+
+// GetSeq get the sequence number, it's 0 if the packet has no one
+func (packet Packet) GetSeq() uint32 {
+	if !packet.HasSeq() || len(packet) < 2+OptSizeData+OptSizeSeq {
+		return 0
+	}
+	return binary.BigEndian.Uint32(packet[2+OptSizeData:])
+}
+
+// SetSeq set the sequence number and the data flag: SEQ, it must be called
+// before setting the compression algorithm, the signature and the dataload.
+func (packet Packet) SetSeq(seq uint32) {
+	packet.SetDataFlag(FlagSeq)
+	binary.BigEndian.PutUint32(packet[2+OptSizeData:], seq)
+}
+
+// IsCompressed check whether the dataload is compressed by any algorithm
+func (packet Packet) IsCompressed() bool {
+	return packet[9]&(FlagZLIB|FlagCompressAlg) != 0
+}
+
+// GetCompressAlg get the compression algorithm of the dataload
+func (packet Packet) GetCompressAlg() CompressAlg {
+	if packet.HasDataFlag(FlagCompressAlg) {
+		return CompressAlg(packet[packet.getCompressAlgIndex()])
+	}
+	if packet.IsZlibCompressed() {
+		return CompressZlib
+	}
+	return CompressNone
+}
+
+// SetCompressAlg set the compression algorithm of the dataload,
+// it must be called after setting the sequence number.
+func (packet Packet) SetCompressAlg(alg CompressAlg) {
+	switch alg {
+	case CompressNone:
+	case CompressZlib:
+		packet.SetDataFlag(FlagZLIB)
+	default:
+		packet.SetDataFlag(FlagCompressAlg)
+		packet[packet.getCompressAlgIndex()] = byte(alg)
+	}
+}
+
+// getCompressAlgIndex get the index of the compression algorithm
+func (packet Packet) getCompressAlgIndex() int {
+	if packet.HasSeq() {
+		return 2 + OptSizeData + OptSizeSeq
+	}
+	return 2 + OptSizeData
+}
+
+// getDataSignIndex get the index of the signature size
+func (packet Packet) getDataSignIndex() int {
+	index := packet.getCompressAlgIndex()
+	if packet.HasDataFlag(FlagCompressAlg) {
+		index++
+	}
+	return index
+}
+
 // GetDataSign get the signature of dataload
 func (packet Packet) GetDataSign() []byte {
-	size := int(packet[2+OptSizeData])
-	return packet[3+OptSizeData : 3+OptSizeData+size]
+	index := packet.getDataSignIndex()
+	size := int(packet[index])
+	return packet[index+1 : index+1+size]
 }
 
 // SetDataSign set the signature of dataload
 func (packet Packet) SetDataSign(sign []byte) {
-	packet[2+OptSizeData] = byte(len(sign))
-	copy(packet[3+OptSizeData:], sign)
+	index := packet.getDataSignIndex()
+	packet[index] = byte(len(sign))
+	copy(packet[index+1:], sign)
 }
 
 func (packet Packet) getDataLoadIndex() int {
-	var index = 2 + OptSizeData
+	index := packet.getDataSignIndex()
 	if packet.HasDataSign() {
-		index = 3 + OptSizeData + int(packet[2+OptSizeData])
+		index += 1 + int(packet[index])
 	}
 	return index
 }
@@ -0,0 +1,154 @@
+package packet
+
+import "sync"
+
+const (
+	// the weight of a new sample in the moving average of the ratio
+	compressRatioWeight = 0.2
+	// a route not paying off is tried again after so many packets
+	defaultCompressProbe = 100
+)
+
+// CompressStat the compression statistics of a route
+type CompressStat struct {
+	Packets    uint64  `json:"packets"`    // all packets larger than the minSize
+	Compressed uint64  `json:"compressed"` // the compressed packets
+	Skipped    uint64  `json:"skipped"`    // the packets not tried by the policy
+	RawBytes   uint64  `json:"raw_bytes"`  // the raw size of the tried packets
+	OutBytes   uint64  `json:"out_bytes"`  // the sent size of the tried packets
+	Ratio      float64 `json:"ratio"`      // moving average of the OutBytes/RawBytes
+	Enabled    bool    `json:"enabled"`    // whether the compression pays off
+}
+
+type routeCompressStat struct {
+	lock sync.Mutex
+	CompressStat
+	sinceProbe int
+}
+
+// CompressPolicy learn whether the compression pays off for each route(MID/AID)
+// by the compression ratio, and a route not paying off is only compressed
+// once every probe packets to find whether it's changed.
+type CompressPolicy struct {
+	alg      CompressAlg
+	minSize  int
+	maxRatio float64
+	probe    int
+
+	lock   sync.RWMutex
+	routes map[uint16]*routeCompressStat
+}
+
+// NewCompressPolicy create a CompressPolicy struct, the data larger than
+// minSize is compressed by the algorithm if the average ratio of its route is
+// less than maxRatio, eg: 0.9.
+func NewCompressPolicy(alg CompressAlg, minSize int, maxRatio float64) *CompressPolicy {
+	return &CompressPolicy{
+		alg:      alg,
+		minSize:  minSize,
+		maxRatio: maxRatio,
+		probe:    defaultCompressProbe,
+		routes:   map[uint16]*routeCompressStat{},
+	}
+}
+
+// SetProbeInterval set the number of packets between two tries for a route not
+// paying off, it must be set before using the policy.
+func (p *CompressPolicy) SetProbeInterval(n int) {
+	p.probe = n
+}
+
+func (p *CompressPolicy) getStat(protoID uint16) *routeCompressStat {
+	p.lock.RLock()
+	stat, ok := p.routes[protoID]
+	p.lock.RUnlock()
+	if ok {
+		return stat
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if stat, ok = p.routes[protoID]; !ok {
+		stat = &routeCompressStat{}
+		stat.Enabled = true
+		p.routes[protoID] = stat
+	}
+	return stat
+}
+
+// Compresser create a compresser for the data of a route
+func (p *CompressPolicy) Compresser(mid, aid uint8) ICompresser {
+	return &policyCompresser{
+		policy:     p,
+		stat:       p.getStat(MakeProtoID(mid, aid)),
+		compressor: NewCompresser(p.alg, p.minSize),
+	}
+}
+
+// Stats get the compression statistics of all routes,
+// the key is made by MakeProtoID.
+func (p *CompressPolicy) Stats() map[uint16]CompressStat {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	stats := make(map[uint16]CompressStat, len(p.routes))
+	for protoID, stat := range p.routes {
+		stat.lock.Lock()
+		stats[protoID] = stat.CompressStat
+		stat.lock.Unlock()
+	}
+	return stats
+}
+
+// shouldTry check whether to try compressing a packet
+func (p *CompressPolicy) shouldTry(stat *routeCompressStat) bool {
+	stat.lock.Lock()
+	defer stat.lock.Unlock()
+	stat.Packets++
+	if stat.Enabled || stat.sinceProbe >= p.probe {
+		stat.sinceProbe = 0
+		return true
+	}
+	stat.sinceProbe++
+	stat.Skipped++
+	return false
+}
+
+// record learn the ratio of a tried packet
+func (p *CompressPolicy) record(stat *routeCompressStat, rawSize, outSize int, compressed bool) {
+	ratio := float64(outSize) / float64(rawSize)
+	stat.lock.Lock()
+	defer stat.lock.Unlock()
+	if stat.RawBytes == 0 {
+		stat.Ratio = ratio
+	} else {
+		stat.Ratio += (ratio - stat.Ratio) * compressRatioWeight
+	}
+	stat.RawBytes += uint64(rawSize)
+	stat.OutBytes += uint64(outSize)
+	if compressed {
+		stat.Compressed++
+	}
+	stat.Enabled = stat.Ratio < p.maxRatio
+}
+
+// policyCompresser a compresser deciding by the policy
+type policyCompresser struct {
+	policy     *CompressPolicy
+	stat       *routeCompressStat
+	compressor ICompresser
+}
+
+// Compress compress some data if it pays off for the route
+func (pc *policyCompresser) Compress(b []byte) ([]byte, bool) {
+	if len(b) <= pc.policy.minSize || !pc.policy.shouldTry(pc.stat) {
+		return b, false
+	}
+	out, compressed := pc.compressor.Compress(b)
+	pc.policy.record(pc.stat, len(b), len(out), compressed)
+	return out, compressed
+}
+
+// Close close the compresser
+func (pc *policyCompresser) Close() { pc.compressor.Close() }
+
+// Alg get the compression algorithm
+func (pc *policyCompresser) Alg() CompressAlg { return pc.policy.alg }
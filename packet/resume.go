@@ -0,0 +1,112 @@
+package packet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrInvalidResume the resume or ack cmd packet is invalid
+var ErrInvalidResume = errors.New("invalid resume cmd")
+
+const (
+	// ResumeTokenSize the size of a resume token issued by the server
+	ResumeTokenSize = 16
+	// ResumeProofSize the size of a resume proof, see NewResumeProof
+	ResumeProofSize = sha256.Size
+
+	resumeCmdSize = 4 + ResumeTokenSize + ResumeProofSize
+)
+
+// NewResumeToken create a random resume token
+func NewResumeToken() ([]byte, error) {
+	token := make([]byte, ResumeTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// NewResumeCmd create a cmd packet to resume a session, the cmd data is:
+//
+//	COUNT(4) + TOKEN(16) + PROOF(32)
+//
+// A client sends the number of the messages received in the session, its
+// token and the proof of the token, or a zero token for a new session. The
+// server replies a new token, with the proof of the new token if the session
+// is resumed, and then resends the messages after the count, or a zero token
+// if resuming is unsupported. A nil token or proof is sent as zeros.
+func NewResumeCmd(connID, count uint32, token, proof []byte) Packet {
+	packet := New(OptSizeCmd + resumeCmdSize)
+	packet.SetConnID(connID)
+	packet.SetProtoID(CmdResume)
+	data := packet.GetCmdData()
+	binary.BigEndian.PutUint32(data, count)
+	copy(data[4:4+ResumeTokenSize], token)
+	copy(data[4+ResumeTokenSize:], proof)
+	return packet
+}
+
+// ParseResumeCmd get the count, the token and the proof of a resume cmd
+// packet, the token or the proof is nil if it's zeros.
+func ParseResumeCmd(packet Packet) (uint32, []byte, []byte, error) {
+	data := packet.GetCmdData()
+	if len(data) != resumeCmdSize {
+		return 0, nil, nil, ErrInvalidResume
+	}
+	nonZero := func(b []byte) []byte {
+		for _, c := range b {
+			if c != 0 {
+				return b
+			}
+		}
+		return nil
+	}
+	token, proof := data[4:4+ResumeTokenSize], data[4+ResumeTokenSize:]
+	return binary.BigEndian.Uint32(data), nonZero(token), nonZero(proof), nil
+}
+
+// NewResumeProof create the proof of a resume token, it's a HMAC-SHA256 of the
+// token, the count and the ResumeKey of the new connection's keys by the
+// ResumeKey of the resumed session's keys. So only the peer of the resumed
+// session proves it, and a proof sniffed from a resume cmd is useless on
+// another connection.
+func NewResumeProof(resumed, keys *SessionKeys, token []byte, count uint32) []byte {
+	mac := hmac.New(sha256.New, resumed.ResumeKey)
+	mac.Write(keys.ResumeKey)
+	mac.Write(token)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], count)
+	mac.Write(b[:])
+	return mac.Sum(nil)
+}
+
+// VerifyResumeProof verify the proof of a resume token, see NewResumeProof
+func VerifyResumeProof(resumed, keys *SessionKeys, token []byte, count uint32, proof []byte) error {
+	if resumed == nil || keys == nil || len(resumed.ResumeKey) == 0 || len(keys.ResumeKey) == 0 ||
+		!hmac.Equal(proof, NewResumeProof(resumed, keys, token, count)) {
+		return ErrInvalidResume
+	}
+	return nil
+}
+
+// NewAckCmd create a cmd packet acknowledging the number of the messages
+// received in a resumable session, the acknowledged ones aren't resent.
+func NewAckCmd(connID, count uint32) Packet {
+	packet := New(OptSizeCmd + 4)
+	packet.SetConnID(connID)
+	packet.SetProtoID(CmdAck)
+	binary.BigEndian.PutUint32(packet.GetCmdData(), count)
+	return packet
+}
+
+// ParseAckCmd get the count of an ack cmd packet
+func ParseAckCmd(packet Packet) (uint32, error) {
+	data := packet.GetCmdData()
+	if len(data) != 4 {
+		return 0, ErrInvalidResume
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
@@ -1,33 +1,198 @@
 package packet
 
 import (
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
 )
 
 var defaultSignSecret []byte
 
+// error definitions
+var (
+	ErrNoSign          = errors.New("missing data signature")
+	ErrInvalidSign     = errors.New("invalid data signature")
+	ErrSignUnsupported = errors.New("signing unsupported")
+)
+
 // SetSignSecret set the signature secret
 func SetSignSecret(sec []byte) {
 	defaultSignSecret = append([]byte{}, sec...)
 }
 
+// SignAlg a signature algorithm marked by the signature bits of the data flag
+type SignAlg uint8
+
+// signature algorithms
+const (
+	SignNone       SignAlg = 0
+	SignHMACSha1   SignAlg = FlagHMACSha1
+	SignHMACSha256 SignAlg = FlagHMACSha256
+	SignEd25519    SignAlg = FlagEd25519
+)
+
+func (alg SignAlg) String() string {
+	switch alg {
+	case SignNone:
+		return "none"
+	case SignHMACSha1:
+		return "hmac-sha1"
+	case SignHMACSha256:
+		return "hmac-sha256"
+	case SignEd25519:
+		return "ed25519"
+	}
+	return "unknown"
+}
+
 // ISignature a signature to calculate the sum
 type ISignature interface {
 	Sum(token, data []byte) ([]byte, error)
 }
 
-type hmacSha1Signature struct{}
+// ISignatureVerifier a signature verifying a sign by itself, eg: an
+// asymmetric one which can't recalculate the sum by a public key
+type ISignatureVerifier interface {
+	Verify(token, data, sign []byte) error
+}
 
-// HMACSha1Signature a hmac-sha1 signature
-var HMACSha1Signature ISignature = hmacSha1Signature{}
+// SignatureAlg get the algorithm of a signature,
+// it's hmac-sha1 if the signature doesn't tell it.
+func SignatureAlg(signature ISignature) SignAlg {
+	if s, ok := signature.(interface{ Alg() SignAlg }); ok {
+		return s.Alg()
+	}
+	return SignHMACSha1
+}
+
+type hmacSignature struct {
+	alg  SignAlg
+	hash func() hash.Hash
+	// the secret of a session, the global secret is used if not perSession
+	secret     []byte
+	perSession bool
+}
+
+// global signatures with the global secret
+var (
+	// HMACSha1Signature a hmac-sha1 signature
+	HMACSha1Signature ISignature = hmacSignature{alg: SignHMACSha1, hash: sha1.New}
+	// HMACSha256Signature a hmac-sha256 signature
+	HMACSha256Signature ISignature = hmacSignature{alg: SignHMACSha256, hash: sha256.New}
+)
+
+// NewHMACSha1Signature create a hmac-sha1 signature with the secret of a
+// session, eg: the sign key derived by a handshake.
+func NewHMACSha1Signature(secret []byte) ISignature {
+	return hmacSignature{SignHMACSha1, sha1.New, append([]byte{}, secret...), true}
+}
+
+// NewHMACSha256Signature create a hmac-sha256 signature with the secret of a
+// session, eg: the sign key derived by a handshake.
+func NewHMACSha256Signature(secret []byte) ISignature {
+	return hmacSignature{SignHMACSha256, sha256.New, append([]byte{}, secret...), true}
+}
+
+// signKey join the secret and a session token,
+// never append to the secret which is shared by all sessions
+func signKey(secret, token []byte) []byte {
+	key := make([]byte, 0, len(secret)+len(token))
+	key = append(key, secret...)
+	return append(key, token...)
+}
 
 // Sum calculate the signature of the dataload
-func (hmacSha1Signature) Sum(token, data []byte) ([]byte, error) {
-	hmac := hmac.New(sha1.New, append(defaultSignSecret, token...))
+func (s hmacSignature) Sum(token, data []byte) ([]byte, error) {
+	secret := s.secret
+	if !s.perSession {
+		secret = defaultSignSecret
+	}
+	hmac := hmac.New(s.hash, signKey(secret, token))
 	_, err := hmac.Write(data)
 	if err == nil {
 		return hmac.Sum(nil), nil
 	}
 	return nil, err
 }
+
+// Alg get the signature algorithm
+func (s hmacSignature) Alg() SignAlg { return s.alg }
+
+// ed25519Signature an Ed25519 signature of the token and the dataload,
+// a client signs by its private key and the server verifies by the public one.
+type ed25519Signature struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// NewEd25519Signature create an Ed25519 signature to sign by a private key
+func NewEd25519Signature(private ed25519.PrivateKey) ISignature {
+	return &ed25519Signature{private: private, public: private.Public().(ed25519.PublicKey)}
+}
+
+// NewEd25519Verifier create an Ed25519 signature to verify by a public key,
+// it can't sign any data.
+func NewEd25519Verifier(public ed25519.PublicKey) ISignature {
+	return &ed25519Signature{public: public}
+}
+
+// Sum sign the token and the dataload
+func (s *ed25519Signature) Sum(token, data []byte) ([]byte, error) {
+	if s.private == nil {
+		return nil, ErrSignUnsupported
+	}
+	return ed25519.Sign(s.private, ed25519Message(token, data)), nil
+}
+
+// Verify verify the sign of the token and the dataload
+func (s *ed25519Signature) Verify(token, data, sign []byte) error {
+	if len(s.public) != ed25519.PublicKeySize || !ed25519.Verify(s.public, ed25519Message(token, data), sign) {
+		return ErrInvalidSign
+	}
+	return nil
+}
+
+// Alg get the signature algorithm
+func (s *ed25519Signature) Alg() SignAlg { return SignEd25519 }
+
+// ed25519Message join the token and the dataload as the signed message, the
+// token is prefixed by its uvarint length, so a token and a dataload can't be
+// shifted into each other.
+func ed25519Message(token, data []byte) []byte {
+	msg := make([]byte, 0, binary.MaxVarintLen64+len(token)+len(data))
+	msg = binary.AppendUvarint(msg, uint64(len(token)))
+	msg = append(msg, token...)
+	return append(msg, data...)
+}
+
+// VerifySign recalculate the signature of the data and compare it with
+// the sign in constant time
+func VerifySign(signature ISignature, token, data, sign []byte) error {
+	if len(sign) == 0 {
+		return ErrNoSign
+	}
+	if verifier, ok := signature.(ISignatureVerifier); ok {
+		return verifier.Verify(token, data, sign)
+	}
+	sum, err := signature.Sum(token, data)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sum, sign) {
+		return ErrInvalidSign
+	}
+	return nil
+}
+
+// SeqSignData join the sequence number and the dataload as the signed data of
+// a packet with a sequence number, so that it can't be replaced by a replay.
+func SeqSignData(seq uint32, data []byte) []byte {
+	signed := make([]byte, OptSizeSeq+len(data))
+	binary.BigEndian.PutUint32(signed, seq)
+	copy(signed[OptSizeSeq:], data)
+	return signed
+}
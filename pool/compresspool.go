@@ -0,0 +1,191 @@
+package pool
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+)
+
+// ICompressWriter a compress writer which can be reused after resetting
+type ICompressWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// CompressWriter a compress writer containing a writer and a buffer
+type CompressWriter struct {
+	buffer *bytes.Buffer
+	writer ICompressWriter
+
+	pool *CompressWriterPool
+}
+
+// Reset reset the underlying buffer and writer
+func (w *CompressWriter) Reset() {
+	w.buffer.Reset()
+	w.writer.Reset(w.buffer)
+}
+
+// Compress compress a raw bytes of data
+func (w *CompressWriter) Compress(b []byte) []byte {
+	w.writer.Write(b)
+	w.writer.Close()
+	return w.buffer.Bytes()
+}
+
+// Free free its underlying resource
+func (w *CompressWriter) Free() {
+	if w.pool != nil {
+		w.pool.put(w)
+	}
+}
+
+// CompressWriterPool a *CompressWriter pool
+type CompressWriterPool struct {
+	pool      chan *CompressWriter
+	newWriter func(io.Writer) ICompressWriter
+}
+
+// NewCompressWriterPool create a CompressWriterPool struct
+func NewCompressWriterPool(size int, newWriter func(io.Writer) ICompressWriter) *CompressWriterPool {
+	return &CompressWriterPool{pool: make(chan *CompressWriter, size), newWriter: newWriter}
+}
+
+// NewFlateWriterPool create a raw deflate CompressWriterPool struct
+func NewFlateWriterPool(size int) *CompressWriterPool {
+	return NewCompressWriterPool(size, func(w io.Writer) ICompressWriter {
+		// the error is only for an invalid level
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	})
+}
+
+// NewGzipWriterPool create a gzip CompressWriterPool struct
+func NewGzipWriterPool(size int) *CompressWriterPool {
+	return NewCompressWriterPool(size, func(w io.Writer) ICompressWriter {
+		return gzip.NewWriter(w)
+	})
+}
+
+// Get get a free *CompressWriter from the pool
+func (cp *CompressWriterPool) Get() *CompressWriter {
+	var w *CompressWriter
+	select {
+	case w = <-cp.pool:
+		w.Reset()
+	default:
+		buffer := new(bytes.Buffer)
+		w = &CompressWriter{buffer, cp.newWriter(buffer), cp}
+	}
+	return w
+}
+
+// Put put a free *CompressWriter to the pool and if full pool, discard it.
+func (cp *CompressWriterPool) put(w *CompressWriter) {
+	if w != nil {
+		select {
+		case cp.pool <- w:
+		default:
+			// do nothing, just discard
+		}
+	}
+}
+
+// CompressReaderFunc create a decompress reader, or reset the old one
+// if it's not nil
+type CompressReaderFunc func(r io.Reader, old io.ReadCloser) (io.ReadCloser, error)
+
+// CompressReader a decompress reader containing a reader and a buffer
+type CompressReader struct {
+	buffer *bytes.Buffer
+	source *bytes.Reader
+	reader io.ReadCloser
+	open   CompressReaderFunc
+
+	pool *CompressReaderPool
+}
+
+// Decompress decompress a raw bytes of data, the result is at most maxSize
+// bytes and only valid before freeing the CompressReader.
+func (r *CompressReader) Decompress(b []byte, maxSize int) ([]byte, error) {
+	r.buffer.Reset()
+	r.source.Reset(b)
+	reader, err := r.open(r.source, r.reader)
+	if err != nil {
+		return nil, err
+	}
+	r.reader = reader
+	defer r.reader.Close()
+
+	// read one more byte to find the oversize data
+	n, err := r.buffer.ReadFrom(io.LimitReader(r.reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(maxSize) {
+		return nil, ErrDecompressTooLarge
+	}
+	return r.buffer.Bytes(), nil
+}
+
+// Free free its underlying resource
+func (r *CompressReader) Free() {
+	if r.pool != nil {
+		r.pool.put(r)
+	}
+}
+
+// CompressReaderPool a *CompressReader pool
+type CompressReaderPool struct {
+	pool chan *CompressReader
+	open CompressReaderFunc
+}
+
+// NewCompressReaderPool create a CompressReaderPool struct
+func NewCompressReaderPool(size int, open CompressReaderFunc) *CompressReaderPool {
+	return &CompressReaderPool{pool: make(chan *CompressReader, size), open: open}
+}
+
+// NewFlateReaderPool create a raw deflate CompressReaderPool struct
+func NewFlateReaderPool(size int) *CompressReaderPool {
+	return NewCompressReaderPool(size, func(r io.Reader, old io.ReadCloser) (io.ReadCloser, error) {
+		if old == nil {
+			return flate.NewReader(r), nil
+		}
+		return old, old.(flate.Resetter).Reset(r, nil)
+	})
+}
+
+// NewGzipReaderPool create a gzip CompressReaderPool struct
+func NewGzipReaderPool(size int) *CompressReaderPool {
+	return NewCompressReaderPool(size, func(r io.Reader, old io.ReadCloser) (io.ReadCloser, error) {
+		if old == nil {
+			return gzip.NewReader(r)
+		}
+		gr := old.(*gzip.Reader)
+		return gr, gr.Reset(r)
+	})
+}
+
+// Get get a free *CompressReader from the pool
+func (cp *CompressReaderPool) Get() *CompressReader {
+	var r *CompressReader
+	select {
+	case r = <-cp.pool:
+	default:
+		r = &CompressReader{new(bytes.Buffer), bytes.NewReader(nil), nil, cp.open, cp}
+	}
+	return r
+}
+
+// Put put a free *CompressReader to the pool and if full pool, discard it.
+func (cp *CompressReaderPool) put(r *CompressReader) {
+	if r != nil {
+		select {
+		case cp.pool <- r:
+		default:
+			// do nothing, just discard
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package pool
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// error definitions
+var (
+	ErrPoolBusy   = errors.New("worker pool: busy")
+	ErrPoolClosed = errors.New("worker pool: closed")
+)
+
+// OverflowPolicy decide what to do with a task when the queue is full
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock wait until the queue has a free slot, a task mustn't
+	// submit another task to the same pool and wait for it, or all workers
+	// may block each other.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop discard the task and return ErrPoolBusy
+	OverflowDrop
+	// OverflowSpill run the task in a new goroutine
+	OverflowSpill
+)
+
+// WorkerPool a fixed number of goroutines running the queued tasks
+type WorkerPool struct {
+	tasks  chan func()
+	policy OverflowPolicy
+
+	size    int
+	running int32
+	dropped uint64
+	spilled uint64
+
+	// Submit holds the read lock, and Close waits for the submitting tasks
+	// queued before the workers exit.
+	lock     sync.RWMutex
+	closed   int32
+	sigStop  chan struct{} // stop the blocked submitting
+	sigClose chan struct{} // stop the workers after all tasks queued
+	wg       sync.WaitGroup
+}
+
+// NewWorkerPool create a WorkerPool with size goroutines and a queue
+func NewWorkerPool(size, queueSize int, policy OverflowPolicy) *WorkerPool {
+	if size <= 0 {
+		size = 1
+	}
+	wp := &WorkerPool{
+		tasks:    make(chan func(), queueSize),
+		policy:   policy,
+		size:     size,
+		sigStop:  make(chan struct{}),
+		sigClose: make(chan struct{}),
+	}
+	wp.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go wp.work()
+	}
+	return wp
+}
+
+func (wp *WorkerPool) work() {
+	defer wp.wg.Done()
+	for {
+		select {
+		case task := <-wp.tasks:
+			wp.run(task)
+		case <-wp.sigClose:
+			// run all queued tasks before exiting
+			for {
+				select {
+				case task := <-wp.tasks:
+					wp.run(task)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (wp *WorkerPool) run(task func()) {
+	atomic.AddInt32(&wp.running, 1)
+	defer func() {
+		if err := recover(); err != nil {
+			//zaplog.S.Error(err)
+			//zaplog.S.Error(zap.Stack("").String)
+		}
+		atomic.AddInt32(&wp.running, -1)
+	}()
+	task()
+}
+
+// Submit queue a task, it returns ErrPoolBusy if the queue is full
+// and the policy is OverflowDrop.
+func (wp *WorkerPool) Submit(task func()) error {
+	wp.lock.RLock()
+	defer wp.lock.RUnlock()
+	if atomic.LoadInt32(&wp.closed) == 1 {
+		return ErrPoolClosed
+	}
+	select {
+	case wp.tasks <- task:
+		return nil
+	default:
+	}
+
+	switch wp.policy {
+	case OverflowDrop:
+		atomic.AddUint64(&wp.dropped, 1)
+		return ErrPoolBusy
+	case OverflowSpill:
+		atomic.AddUint64(&wp.spilled, 1)
+		go wp.run(task)
+		return nil
+	default:
+		select {
+		case wp.tasks <- task:
+			return nil
+		case <-wp.sigStop:
+			return ErrPoolClosed
+		}
+	}
+}
+
+// Policy get the overflow policy
+func (wp *WorkerPool) Policy() OverflowPolicy { return wp.policy }
+
+// Size get the number of the goroutines
+func (wp *WorkerPool) Size() int { return wp.size }
+
+// QueueSize get the capacity of the queue
+func (wp *WorkerPool) QueueSize() int { return cap(wp.tasks) }
+
+// QueueDepth get the number of the queued tasks
+func (wp *WorkerPool) QueueDepth() int { return len(wp.tasks) }
+
+// Running get the number of the running tasks, including the spilled ones
+func (wp *WorkerPool) Running() int { return int(atomic.LoadInt32(&wp.running)) }
+
+// Dropped get the number of the dropped tasks
+func (wp *WorkerPool) Dropped() uint64 { return atomic.LoadUint64(&wp.dropped) }
+
+// Spilled get the number of the tasks running in a new goroutine
+func (wp *WorkerPool) Spilled() uint64 { return atomic.LoadUint64(&wp.spilled) }
+
+// Close stop accepting tasks and wait all queued tasks done, a task accepted
+// by Submit always runs.
+func (wp *WorkerPool) Close() {
+	if atomic.CompareAndSwapInt32(&wp.closed, 0, 1) {
+		close(wp.sigStop)
+		// wait for the submitting tasks
+		wp.lock.Lock()
+		close(wp.sigClose)
+		wp.lock.Unlock()
+		wp.wg.Wait()
+	}
+}
@@ -0,0 +1,88 @@
+package pool_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/overtalk/qnet/pool"
+)
+
+func TestWorkerPoolDrop(t *testing.T) {
+	workers := pool.NewWorkerPool(1, 1, pool.OverflowDrop)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	workers.Submit(func() { close(started); <-release })
+	<-started
+
+	if err := workers.Submit(func() {}); err != nil {
+		t.Fatalf("queue a task: %v", err)
+	}
+	if depth := workers.QueueDepth(); depth != 1 {
+		t.Fatalf("queue depth: %d", depth)
+	}
+	if err := workers.Submit(func() {}); err != pool.ErrPoolBusy {
+		t.Fatalf("full queue: %v", err)
+	}
+	if workers.Dropped() != 1 {
+		t.Fatalf("dropped: %d", workers.Dropped())
+	}
+	close(release)
+	workers.Close()
+	if err := workers.Submit(func() {}); err != pool.ErrPoolClosed {
+		t.Fatalf("closed pool: %v", err)
+	}
+}
+
+func TestWorkerPoolSpill(t *testing.T) {
+	workers := pool.NewWorkerPool(2, 0, pool.OverflowSpill)
+	defer workers.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		if err := workers.Submit(wg.Done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestWorkerPoolClose(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		workers := pool.NewWorkerPool(2, 64, pool.OverflowDrop)
+		var accepted, done int32
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					switch workers.Submit(func() { atomic.AddInt32(&done, 1) }) {
+					case nil:
+						atomic.AddInt32(&accepted, 1)
+					case pool.ErrPoolClosed:
+						return
+					}
+				}
+			}()
+		}
+		workers.Close()
+		wg.Wait()
+		// all accepted tasks run before Close returns
+		if a, d := atomic.LoadInt32(&accepted), atomic.LoadInt32(&done); a != d {
+			t.Fatalf("%d tasks accepted, %d done", a, d)
+		}
+	}
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	workers := pool.NewWorkerPool(8, 1024, pool.OverflowBlock)
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		workers.Submit(wg.Done)
+	}
+	wg.Wait()
+	workers.Close()
+}
@@ -3,6 +3,8 @@ package pool
 import (
 	"bytes"
 	"compress/zlib"
+	"errors"
+	"io"
 )
 
 // ByteBuf a bytes buffer
@@ -125,3 +127,29 @@ func (zp *ZlibWriterPool) put(w *ZlibWriter) {
 		}
 	}
 }
+
+// error definitions
+var ErrDecompressTooLarge = errors.New("decompressed data too large")
+
+// ZlibReader a zlib reader containing a reader and a buffer
+type ZlibReader = CompressReader
+
+// ZlibReaderPool a *ZlibReader pool
+type ZlibReaderPool = CompressReaderPool
+
+func openZlibReader(r io.Reader, old io.ReadCloser) (io.ReadCloser, error) {
+	if old == nil {
+		return zlib.NewReader(r)
+	}
+	return old, old.(zlib.Resetter).Reset(r, nil)
+}
+
+// NewZlibReader create a ZlibReader struct without a pool
+func NewZlibReader() *ZlibReader {
+	return &CompressReader{new(bytes.Buffer), bytes.NewReader(nil), nil, openZlibReader, nil}
+}
+
+// NewZlibReaderPool create a ZlibReaderPool struct
+func NewZlibReaderPool(size int) *ZlibReaderPool {
+	return NewCompressReaderPool(size, openZlibReader)
+}
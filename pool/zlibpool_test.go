@@ -1,6 +1,7 @@
 package pool_test
 
 import (
+	"bytes"
 	"testing"
 
 	zeropool "github.com/overtalk/qnet/pool"
@@ -45,3 +46,29 @@ func TestZlibPool(t *testing.T) {
 	b3.Free()
 	b4.Free()
 }
+
+func TestZlibReaderPool(t *testing.T) {
+	writers := zeropool.NewZlibWriterPool(10)
+	readers := zeropool.NewZlibReaderPool(10)
+	for _, s := range []string{"hello, world!", "how old are you?"} {
+		w := writers.Get()
+		compressed := append([]byte(nil), w.Compress([]byte(s))...)
+		w.Free()
+
+		r := readers.Get()
+		out, err := r.Decompress(compressed, 100)
+		if err != nil || string(out) != s {
+			t.Fatalf("decompress %q: %q, %v", s, out, err)
+		}
+		if _, err = r.Decompress(compressed, len(s)-1); err != zeropool.ErrDecompressTooLarge {
+			t.Fatalf("decompress oversize %q: %v", s, err)
+		}
+		if _, err = r.Decompress(compressed[:len(compressed)-2], 100); err == nil {
+			t.Fatalf("decompress truncated %q", s)
+		}
+		if _, err = r.Decompress(bytes.Repeat([]byte{1}, 10), 100); err == nil {
+			t.Fatal("decompress invalid data")
+		}
+		r.Free()
+	}
+}
@@ -0,0 +1,141 @@
+package session
+
+import (
+	"errors"
+	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+)
+
+// error definitions
+var (
+	ErrUnauthenticated = errors.New("session: unauthenticated")
+	ErrAuthFailed      = errors.New("session: authentication failed")
+)
+
+// the default time for a new session to log in
+const defaultAuthTimeout = 30 * time.Second
+
+// AuthFunc authenticate a login request of a session, it returns the user id
+// and the login response. A user id 0 means the authentication failed.
+type AuthFunc func(s *Session, r common.IRequest) (userID uint64, result common.IOutProtocol, err error)
+
+// Authenticator an authentication stage before routing, only the login route
+// and the public routes are allowed until the session is logged in. The login
+// request is handled by the AuthFunc, or by the router if it's nil, and the
+// login action marks the session by Session.Login.
+// NOTE: configure it before serving, it's not concurrent safely.
+type Authenticator struct {
+	loginMID uint8
+	loginAID uint8
+	auth     AuthFunc
+	timeout  time.Duration
+	// the response of a rejected request, no response if nil
+	rejectResp common.IOutProtocol
+
+	modules map[uint8]bool
+	actions map[uint16]bool
+}
+
+// NewAuthenticator create an Authenticator struct of the login route,
+// the new sessions must log in 30 seconds by default.
+func NewAuthenticator(loginMID, loginAID uint8, auth AuthFunc) *Authenticator {
+	return &Authenticator{
+		loginMID: loginMID,
+		loginAID: loginAID,
+		auth:     auth,
+		timeout:  defaultAuthTimeout,
+		modules:  map[uint8]bool{},
+		actions:  map[uint16]bool{},
+	}
+}
+
+// Timeout set the time for a new session of a ClientService to log in, the
+// connection of a session which never logs in is closed, 0 means no timeout.
+// It has no effect on an AgentService, the game server can't close a client
+// of an agent server, whose requests are only rejected until logged in.
+func (a *Authenticator) Timeout(timeout time.Duration) *Authenticator {
+	a.timeout = timeout
+	return a
+}
+
+// RejectResponse set the response of the requests rejected before logged in
+func (a *Authenticator) RejectResponse(resp common.IOutProtocol) *Authenticator {
+	a.rejectResp = resp
+	return a
+}
+
+// PublicModule all actions of the modules bypass the authentication
+func (a *Authenticator) PublicModule(mids ...uint8) *Authenticator {
+	for _, mid := range mids {
+		a.modules[mid] = true
+	}
+	return a
+}
+
+// PublicAction the action of a module bypasses the authentication
+func (a *Authenticator) PublicAction(mid, aid uint8) *Authenticator {
+	a.actions[packet.MakeProtoID(mid, aid)] = true
+	return a
+}
+
+// IsPublic check whether the route bypasses the authentication
+func (a *Authenticator) IsPublic(mid, aid uint8) bool {
+	return a.modules[mid] || a.actions[packet.MakeProtoID(mid, aid)]
+}
+
+// isLogin check whether it's the login route
+func (a *Authenticator) isLogin(mid, aid uint8) bool {
+	return mid == a.loginMID && aid == a.loginAID
+}
+
+// watch close a new session if it doesn't log in before the timeout
+func (a *Authenticator) watch(s *Session) {
+	if a.timeout <= 0 {
+		return
+	}
+	time.AfterFunc(a.timeout, func() {
+		if !s.IsLoggedIn() {
+			s.Close()
+		}
+	})
+}
+
+// Dispatch authenticate a request and dispatch it by the router, a request
+// of an unauthenticated session is rejected with ErrUnauthenticated. The
+// previous session of the logged-in user is closed.
+func (a *Authenticator) Dispatch(router *common.Router, r common.IRequest) (common.IOutProtocol, error) {
+	mid, aid := r.GetMID(), r.GetAID()
+	s := FromRequest(r)
+	switch {
+	case a.isLogin(mid, aid):
+		if a.auth == nil || s == nil {
+			return router.DispatchErr(r)
+		}
+		userID, result, err := a.auth(s, r)
+		if err == nil && userID == 0 {
+			err = ErrAuthFailed
+		}
+		if err != nil {
+			return result, err
+		}
+		if prev := s.Login(userID); prev != nil {
+			prev.Close()
+		}
+		return result, nil
+	case a.IsPublic(mid, aid):
+		return router.DispatchErr(r)
+	case s == nil || !s.IsLoggedIn():
+		return a.rejectResp, ErrUnauthenticated
+	}
+	return router.DispatchErr(r)
+}
+
+// dispatch dispatch a request by the router after the authentication if any
+func dispatch(router *common.Router, auth *Authenticator, r common.IRequest) (common.IOutProtocol, error) {
+	if auth == nil {
+		return router.DispatchErr(r)
+	}
+	return auth.Dispatch(router, r)
+}
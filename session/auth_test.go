@@ -0,0 +1,85 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/overtalk/qnet/client"
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+)
+
+// authUser log in the user of the data, a user 0 fails
+func authUser(s *Session, r common.IRequest) (uint64, common.IOutProtocol, error) {
+	return uint64(r.GetData()[0]), common.BytesOutProtocol("welcome"), nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	router := common.NewRouter()
+	router.Register(common.NewModule(1, &echoAction{1}), common.NewModule(2, &echoAction{1}))
+	auth := NewAuthenticator(9, 1, authUser).PublicAction(2, 1).RejectResponse(common.BytesOutProtocol("denied"))
+	m := NewManager()
+	s := m.newSession(0, "addr", nil, nil)
+	request := func(mid, aid uint8, data string) (common.IOutProtocol, error) {
+		return auth.Dispatch(router, &Request{MID: mid, AID: aid, Data: []byte(data), session: s})
+	}
+
+	if result, err := request(1, 1, "hello"); err != ErrUnauthenticated || result.(common.BytesOutProtocol).String() != "denied" {
+		t.Fatalf("private route: %v %v", result, err)
+	}
+	if result, err := request(2, 1, "hello"); err != nil || result.(common.BytesOutProtocol).String() != "hello" {
+		t.Fatalf("public route: %v %v", result, err)
+	}
+	if _, err := request(9, 1, "\x00"); err != ErrAuthFailed || s.IsLoggedIn() {
+		t.Fatalf("failed login: %v", err)
+	}
+	if result, err := request(9, 1, "\x07"); err != nil || result.(common.BytesOutProtocol).String() != "welcome" {
+		t.Fatalf("login: %v %v", result, err)
+	}
+	if s.UserID() != 7 || m.GetByUser(7) != s {
+		t.Fatalf("user: %d", s.UserID())
+	}
+	if result, err := request(1, 1, "hello"); err != nil || result.(common.BytesOutProtocol).String() != "hello" {
+		t.Fatalf("private route after login: %v %v", result, err)
+	}
+	if _, err := auth.Dispatch(router, &Request{MID: 1, AID: 1}); err != ErrUnauthenticated {
+		t.Fatalf("request without a session: %v", err)
+	}
+}
+
+func TestClientServiceAuth(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	router := common.NewRouter()
+	router.Register(common.NewModule(1, &echoAction{1}))
+	auth := NewAuthenticator(9, 1, authUser).Timeout(200 * time.Millisecond)
+	addr, _ := serveRouter(t, router, OptionClientAuthenticator(auth))
+
+	idle, err := client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	cli, err := client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if _, err := cli.RequestTimeout(1, 1, []byte("hello"), 50*time.Millisecond); err != client.ErrTimeout {
+		t.Fatalf("request before login: %v", err)
+	}
+	if msg, err := cli.Request(9, 1, []byte{7}); err != nil || string(msg.Data) != "welcome" {
+		t.Fatalf("login: %v %v", msg, err)
+	}
+	if msg, err := cli.Request(1, 1, []byte("hello")); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("request after login: %v %v", msg, err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if idle.IsConnected() {
+		t.Error("the client never logging in is still connected")
+	}
+	if !cli.IsConnected() {
+		t.Error("the logged-in client is disconnected")
+	}
+}
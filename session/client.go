@@ -0,0 +1,399 @@
+package session
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/pool"
+	"github.com/overtalk/qnet/tunnel"
+)
+
+// the default heartbeat of a client, a client pings every 18 seconds by
+// default, see client.OptionPing.
+var defaultClientHeartbeat = common.Heartbeat{
+	DeadTimeout:  40 * time.Second,
+	WriteTimeout: 10 * time.Second,
+}
+
+// ClientService a service for the clients connecting to the game server
+// directly without an agent server, tunnel.InitFrontendPool must be called
+// before serving.
+type ClientService struct {
+	router   *common.Router
+	workers  *pool.WorkerPool
+	busyResp common.IOutProtocol
+	// mailbox size of each client, 0 means the requests are not ordered
+	mailboxSize int
+	// ping the clients and close the dead or idle ones
+	heartbeat common.Heartbeat
+	// the preferred algorithms negotiated by a CmdCompress, the responses
+	// larger than compressMin are compressed by the negotiated one
+	compressAlgs   []packet.CompressAlg
+	compressMin    int
+	compressPolicy *packet.CompressPolicy
+	sessionOpts    []tunnel.SessionOptionFunc
+	// the sessions of the clients
+	sessions *Manager
+	// authenticate the sessions before routing
+	auth *Authenticator
+	// resume the sessions of the reconnected clients, and the sessions of
+	// the detached connections kept by the resumer
+	resumer      *tunnel.Resumer
+	detached     map[*tunnel.FrontendSession]*Session
+	detachedLock sync.Mutex
+}
+
+// ClientOptionFunc set the ClientService's option
+type ClientOptionFunc func(*ClientService)
+
+// OptionClientWorkerPool set ClientService's worker pool, each request is
+// handled in its own goroutine if not set. A pool of OverflowBlock mustn't be
+// shared with the router, see common.OptionWorkerPool.
+func OptionClientWorkerPool(workers *pool.WorkerPool) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.workers = workers
+	}
+}
+
+// OptionClientOrderedRequest handle the requests of a client one by one in the
+// arriving order, and at most mailboxSize requests are queued. The requests
+// are handled by a task of the worker pool if set.
+func OptionClientOrderedRequest(mailboxSize int) ClientOptionFunc {
+	return func(cs *ClientService) {
+		if mailboxSize <= 0 {
+			mailboxSize = 1
+		}
+		cs.mailboxSize = mailboxSize
+	}
+}
+
+// OptionClientIdleTimeout close a client if no packet is read in the timeout,
+// a ping keeps it alive, it's 40 seconds by default. It's the DeadTimeout of
+// the heartbeat, see OptionClientHeartbeat.
+func OptionClientIdleTimeout(timeout time.Duration) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.heartbeat.DeadTimeout = timeout
+	}
+}
+
+// OptionClientHeartbeat set the heartbeat policy of the clients, the clients
+// are never pinged by default, so their RTT is unknown, see Session.RTT.
+func OptionClientHeartbeat(heartbeat common.Heartbeat) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.heartbeat = heartbeat
+	}
+}
+
+// OptionClientCompress negotiate the compression algorithm with the clients by
+// the preferred algorithms, and compress the responses larger than minSize.
+func OptionClientCompress(minSize int, preferred ...packet.CompressAlg) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.compressAlgs = preferred
+		cs.compressMin = minSize
+	}
+}
+
+// OptionClientCompressPolicy compress the responses by a policy learning
+// whether the compression pays off for each route, it overrides the negotiated
+// algorithm.
+func OptionClientCompressPolicy(policy *packet.CompressPolicy) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.compressPolicy = policy
+	}
+}
+
+// OptionClientBusyResponse set ClientService's response for the requests
+// dropped by a busy worker pool or a full mailbox, no response is sent if
+// not set.
+func OptionClientBusyResponse(resp common.IOutProtocol) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.busyResp = resp
+	}
+}
+
+// OptionClientSession set the options of the clients' sessions, the heartbeat
+// is set by OptionClientHeartbeat.
+func OptionClientSession(opts ...tunnel.SessionOptionFunc) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.sessionOpts = opts
+	}
+}
+
+// OptionClientSessionManager set the manager of the clients' sessions, eg: to
+// share it with an AgentService, a new one is created if not set.
+func OptionClientSessionManager(sessions *Manager) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.sessions = sessions
+	}
+}
+
+// OptionClientAuthenticator authenticate the clients before routing their
+// requests, the clients never logging in are closed after the auth timeout.
+func OptionClientAuthenticator(auth *Authenticator) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.auth = auth
+	}
+}
+
+// OptionClientResumer resume the sessions of the reconnected clients, a client
+// asks for a resume token after the handshake, and the session of a closed
+// connection is kept by the resumer for a while, see tunnel.Resumer.
+func OptionClientResumer(resumer *tunnel.Resumer) ClientOptionFunc {
+	return func(cs *ClientService) {
+		cs.resumer = resumer
+	}
+}
+
+// NewClientService create a ClientService struct
+func NewClientService(router *common.Router, opts ...ClientOptionFunc) *ClientService {
+	cs := &ClientService{
+		router:    router,
+		heartbeat: defaultClientHeartbeat,
+		detached:  map[*tunnel.FrontendSession]*Session{},
+	}
+	for _, opt := range opts {
+		opt(cs)
+	}
+	if cs.sessions == nil {
+		cs.sessions = NewManager()
+	}
+	// the heartbeat overrides the one of the session options
+	cs.sessionOpts = append(append([]tunnel.SessionOptionFunc{}, cs.sessionOpts...),
+		tunnel.OptionHeartbeat(cs.heartbeat))
+	checkWorkerPool(router, cs.workers)
+	return cs
+}
+
+// Sessions get the manager of the clients' sessions
+func (cs *ClientService) Sessions() *Manager { return cs.sessions }
+
+// clientConn the state of a client's connection
+type clientConn struct {
+	sess *tunnel.FrontendSession
+	// the session of the client, it's replaced after resumed
+	state       *Session
+	boxes       *mailboxes
+	waitRequest sync.WaitGroup
+}
+
+// Serve serve a tcp session from a client
+func (cs *ClientService) Serve(nc net.Conn) {
+	sess := tunnel.NewFrontendSession(nc, cs.sessionOpts...)
+	sess.StartHeartbeat()
+	c := &clientConn{sess: sess}
+	c.state = cs.sessions.newSession(0, sess.ClientAddr(), sess.Expire, cs.newWriter(sess))
+	c.state.setRTT(sess.RTT)
+	if cs.auth != nil {
+		cs.auth.watch(c.state)
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			//zaplog.S.Error(err)
+			//zaplog.S.Error(zap.Stack("").String)
+		}
+		// wait 5 seconds for the responses before closing the connection
+		WaitAction(c.waitRequest.Wait, 5*time.Second)
+		cs.closeConn(c)
+	}()
+
+	if cs.mailboxSize > 0 {
+		c.boxes = newMailboxes(cs.mailboxSize, cs.workers)
+	}
+
+	// an idle client gets a timeout error, and a broken one gets the others
+	for {
+		buffer, err := sess.ReadBuffer()
+		if err != nil {
+			//zaplog.S.Errorf("read client@%s request: %v", sess.ClientAddr(), err)
+			return
+		}
+		if !cs.serveBuffer(c, buffer) {
+			return
+		}
+	}
+}
+
+// closeConn close the connection of a client and remove its session, a
+// resumable session is kept by the resumer until it expires.
+func (cs *ClientService) closeConn(c *clientConn) {
+	if c.sess.IsResumable() {
+		sess, state := c.sess, c.state
+		cs.detachedLock.Lock()
+		cs.detached[sess] = state
+		cs.detachedLock.Unlock()
+		onExpire := func() {
+			cs.takeDetached(sess)
+			cs.sessions.remove(state)
+		}
+		if sess.Detach(onExpire) {
+			sess.Close()
+			return
+		}
+		cs.takeDetached(sess)
+	}
+	c.sess.Close()
+	cs.sessions.remove(c.state)
+}
+
+// takeDetached take the session of a detached connection
+func (cs *ClientService) takeDetached(sess *tunnel.FrontendSession) *Session {
+	cs.detachedLock.Lock()
+	defer cs.detachedLock.Unlock()
+	state := cs.detached[sess]
+	delete(cs.detached, sess)
+	return state
+}
+
+// serveBuffer handle the cmd in place and the others in the client's mailbox
+// or the worker pool, it returns false if the client should be closed.
+func (cs *ClientService) serveBuffer(c *clientConn, buffer common.IPacketBuffer) bool {
+	inPacket := packet.Packet(buffer.Bytes())
+	if !inPacket.IsValid() {
+		buffer.Free()
+		return false
+	}
+	// a cmd packet is never encrypted, and it's handled in the reading order
+	if inPacket.IsCmd() {
+		err := cs.handleClientCmd(c, inPacket)
+		buffer.Free()
+		return err == nil
+	}
+
+	// decrypt and reassemble the packets in the reading order
+	req, err := NewRequestFromClient(buffer,
+		OptionRequestCrypto(c.sess.GetCrypto()), OptionRequestReassembler(c.sess.GetReassembler()))
+	if err != nil {
+		//zaplog.S.Errorf("client@%s: invalid request: %v", c.sess.ClientAddr(), err)
+		buffer.Free()
+		return false
+	}
+	if req == nil {
+		buffer.Free()
+		return true
+	}
+	req.session = c.state
+
+	c.waitRequest.Add(1)
+	task := func() { cs.handleClientRequest(c, req) }
+	switch {
+	case c.boxes != nil:
+		if !c.boxes.Post(0, task) {
+			err = pool.ErrPoolBusy
+		}
+	case cs.workers != nil:
+		err = cs.workers.Submit(task)
+	default:
+		go task()
+	}
+	if err != nil {
+		//zaplog.S.Errorf("client@%s: drop request: %v", c.sess.ClientAddr(), err)
+		if cs.busyResp != nil {
+			cs.writeResponse(req, cs.busyResp)
+		}
+		req.Free()
+		c.waitRequest.Done()
+	}
+	return true
+}
+
+// handleClientCmd reply a ping, negotiate the session keys and the
+// compression algorithm, and resume a session
+func (cs *ClientService) handleClientCmd(c *clientConn, pack packet.Packet) error {
+	var err error
+	switch cmd := pack.GetCmd(); cmd {
+	case packet.CmdPing, packet.CmdPong:
+		// reply the ping so that the client can detect a dead server
+		err = c.sess.HandleHeartbeat(pack)
+	case packet.CmdHandshake:
+		_, err = c.sess.Handshake(pack)
+	case packet.CmdCompress:
+		_, err = c.sess.NegotiateCompress(pack, cs.compressAlgs...)
+	case packet.CmdResume:
+		err = cs.resume(c, pack)
+	case packet.CmdAck:
+		err = c.sess.Ack(pack)
+	default:
+		//zaplog.S.Errorf("client@%s: invalid cmd(%d)", c.sess.ClientAddr(), cmd)
+	}
+	return err
+}
+
+// resume make the client's session resumable, or resume the session of a
+// detached connection, then the connection's own session is dropped.
+func (cs *ClientService) resume(c *clientConn, pack packet.Packet) error {
+	if cs.resumer == nil {
+		// a zero token tells the client resuming is unsupported
+		_, err := c.sess.Write(packet.NewResumeCmd(0, 0, nil, nil))
+		return err
+	}
+	old, err := c.sess.Resume(pack, cs.resumer)
+	if err != nil || old == nil {
+		return err
+	}
+	state := cs.takeDetached(old)
+	if state == nil {
+		// it's never served by the service
+		c.sess.Expire()
+		return tunnel.ErrResumeRejected
+	}
+	c.state.attach(nil, nil)
+	cs.sessions.remove(c.state)
+	c.state = state
+	c.state.attach(c.sess.Expire, cs.newWriter(c.sess))
+	c.state.setRTT(c.sess.RTT)
+	return nil
+}
+
+func (cs *ClientService) handleClientRequest(c *clientConn, req *Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			//zaplog.S.Error(err)
+			//zaplog.S.Error(zap.Stack("").String)
+		}
+		req.Free()
+		c.waitRequest.Done()
+	}()
+
+	result, err := dispatch(cs.router, cs.auth, req)
+	if err != nil {
+		//zaplog.S.Errorf(
+		//	"client@%s dispatch: mid: %d, aid: %d, err: %v",
+		//	c.sess.ClientAddr(), req.MID, req.AID, err)
+		if err == common.ErrRouteBusy && cs.busyResp != nil {
+			result = cs.busyResp
+		}
+	}
+	if result == nil {
+		return
+	}
+	cs.writeResponse(req, result)
+}
+
+// writeResponse write the result of a request by the writer of its session
+func (cs *ClientService) writeResponse(req *Request, result common.IOutProtocol) {
+	if err := req.session.write(NewResponse(req, result)); err != nil {
+		//zaplog.S.Errorf(
+		//	"write client@%s response: mid: %d, aid: %d, err: %v",
+		//	req.session.RemoteAddr(), req.MID, req.AID, err)
+	}
+}
+
+// newWriter create a writer of the responses to a connection, they are
+// encrypted by the connection's crypto, see tunnel.FrontendSession.Send.
+func (cs *ClientService) newWriter(sess *tunnel.FrontendSession) func(*Response) error {
+	return func(rsp *Response) error {
+		if cs.compressPolicy != nil {
+			rsp.Compresser = cs.compressPolicy.Compresser(rsp.MID, rsp.AID)
+		} else {
+			rsp.Compresser = sess.NewCompresser(cs.compressMin)
+		}
+		outPacket, err := rsp.Packet()
+		if err != nil {
+			return err
+		}
+		return sess.Send(outPacket)
+	}
+}
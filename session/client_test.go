@@ -0,0 +1,241 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/overtalk/qnet/client"
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/pool"
+	"github.com/overtalk/qnet/tunnel"
+)
+
+type echoAction struct{ aid uint8 }
+
+func (a *echoAction) GetAID() uint8 { return a.aid }
+func (a *echoAction) Handle(r common.IRequest) common.IOutProtocol {
+	return common.BytesOutProtocol(r.GetData())
+}
+
+var initFrontendPool sync.Once
+
+// serveClients serve the clients by a ClientService echoing the requests
+func serveClients(t *testing.T, opts ...ClientOptionFunc) string {
+	router := common.NewRouter()
+	router.Register(common.NewModule(1, &echoAction{1}))
+	addr, _ := serveRouter(t, router, opts...)
+	return addr
+}
+
+// serveRouter serve the clients by a ClientService of the router
+func serveRouter(t *testing.T, router *common.Router, opts ...ClientOptionFunc) (string, *ClientService) {
+	initFrontendPool.Do(tunnel.InitFrontendPool)
+	cs := NewClientService(router, opts...)
+	return serveService(t, cs, nil), cs
+}
+
+// serveService serve the clients by a ClientService, the connections are
+// framed by the framer if not nil
+func serveService(t *testing.T, cs *ClientService, framer common.IFramer) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the clients closed by the test
+	var serving sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		serving.Wait()
+	})
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			serving.Add(1)
+			if framer != nil {
+				nc = common.NewFramedConn(nc, framer)
+			}
+			go func() {
+				defer serving.Done()
+				cs.Serve(nc)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClientService(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	addr := serveClients(t, OptionClientCompress(64, packet.CompressLZ4), OptionClientOrderedRequest(16))
+	for _, opts := range [][]client.OptionFunc{
+		nil,
+		{client.OptionHandshake(), client.OptionCompress(64, packet.CompressLZ4)},
+	} {
+		cli, err := client.Dial("tcp", addr, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("0123456789"), 10000)} {
+			msg, err := cli.Request(1, 1, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg.Data, data) {
+				t.Errorf("response %d bytes, expected %d", len(msg.Data), len(data))
+			}
+		}
+		if _, err := cli.RequestTimeout(2, 1, nil, 50*time.Millisecond); err != client.ErrTimeout {
+			t.Errorf("unknown module: got %v, expected %v", err, client.ErrTimeout)
+		}
+		cli.Close()
+	}
+}
+
+func TestClientServiceFramer(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	initFrontendPool.Do(tunnel.InitFrontendPool)
+	router := common.NewRouter()
+	router.Register(common.NewModule(1, &echoAction{1}))
+	for name, framer := range map[string]common.IFramer{
+		"varint":     common.VarintFramer,
+		"length4-le": common.NewLengthFramer(4, binary.LittleEndian),
+	} {
+		addr := serveService(t, NewClientService(router, OptionClientCompress(64, packet.CompressLZ4)), framer)
+		cli, err := client.Dial("tcp", addr, client.OptionFramer(framer),
+			client.OptionHandshake(), client.OptionCompress(64, packet.CompressLZ4))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// a large request is written by fragments
+		for _, data := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("0123456789"), 10000)} {
+			msg, err := cli.Request(1, 1, data)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(msg.Data, data) {
+				t.Errorf("%s: response %d bytes, expected %d", name, len(msg.Data), len(data))
+			}
+		}
+		cli.Close()
+	}
+}
+
+func TestClientServiceEncryptedMID(t *testing.T) {
+	// the MID equals the secret of a small packet, it was encrypted to 0
+	packet.SetCryptoSecret([]byte{0x21, 0x43})
+	pack, _ := packet.NewBuilder(0x21, 0x05).Data([]byte("hello")).Build()
+	if encrypted, _ := pack.Encrypt(packet.XORCrypto); encrypted.IsCmd() {
+		t.Fatalf("encrypted as a cmd: %v", encrypted)
+	}
+
+	router := common.NewRouter()
+	router.Register(common.NewModule(0x21, &echoAction{0x05}))
+	addr, _ := serveRouter(t, router)
+	cli, err := client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if msg, err := cli.RequestTimeout(0x21, 0x05, []byte("hello"), time.Second); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("response: %v %v", msg, err)
+	}
+}
+
+func TestClientServiceIdle(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	addr := serveClients(t, OptionClientIdleTimeout(100*time.Millisecond))
+
+	idle, err := client.Dial("tcp", addr, client.OptionPing(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	alive, err := client.Dial("tcp", addr, client.OptionPing(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	if idle.IsConnected() {
+		t.Error("the idle client is still connected")
+	}
+	if !alive.IsConnected() {
+		t.Error("the pinging client is disconnected")
+	}
+	if msg, err := alive.Request(1, 1, []byte("hello")); err != nil || string(msg.Data) != "hello" {
+		t.Errorf("response: %v %v", msg, err)
+	}
+}
+
+func TestClientServiceHeartbeat(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	router := common.NewRouter()
+	router.Register(common.NewModule(1, &echoAction{1}))
+	addr, cs := serveRouter(t, router, OptionClientHeartbeat(common.Heartbeat{
+		PingInterval: 20 * time.Millisecond,
+		DeadTimeout:  time.Second,
+		IdleTimeout:  300 * time.Millisecond,
+	}))
+
+	cli, err := client.Dial("tcp", addr, client.OptionHeartbeat(common.Heartbeat{
+		PingInterval: 20 * time.Millisecond,
+		DeadTimeout:  time.Second,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// both ends measure the RTT by the pongs
+	time.Sleep(100 * time.Millisecond)
+	if msg, err := cli.Request(1, 1, []byte("hello")); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("response: %v %v", msg, err)
+	}
+	var s *Session
+	cs.Sessions().Range(func(state *Session) bool { s = state; return false })
+	if s == nil || s.RTT() <= 0 || cli.RTT() <= 0 {
+		t.Fatalf("session: %v, rtt: %v", s, cli.RTT())
+	}
+
+	// the pings don't keep an idle client
+	time.Sleep(500 * time.Millisecond)
+	if cli.IsConnected() {
+		t.Error("the idle client is still connected")
+	}
+}
+
+func TestSharedWorkerPool(t *testing.T) {
+	blocking := pool.NewWorkerPool(1, 1, pool.OverflowBlock)
+	defer blocking.Close()
+	dropping := pool.NewWorkerPool(1, 1, pool.OverflowDrop)
+	defer dropping.Close()
+
+	NewClientService(common.NewRouter(common.OptionWorkerPool(dropping)), OptionClientWorkerPool(dropping))
+	for _, newService := range []func(){
+		func() {
+			NewClientService(common.NewRouter(common.OptionWorkerPool(blocking)), OptionClientWorkerPool(blocking))
+		},
+		func() {
+			NewAgentService(common.NewRouter(common.OptionWorkerPool(blocking)), OptionWorkerPool(blocking))
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("the blocking pool is shared with the router")
+				}
+			}()
+			newService()
+		}()
+	}
+}
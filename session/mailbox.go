@@ -0,0 +1,89 @@
+package session
+
+import (
+	"sync"
+
+	"github.com/overtalk/qnet/pool"
+)
+
+// mailbox the queued tasks of a client connection
+type mailbox struct {
+	tasks chan func()
+}
+
+// mailboxes run the tasks of each client connection one by one, and the
+// tasks of different connections in parallel. A mailbox is drained by a task
+// of the worker pool, or its own goroutine without a pool, which exits once
+// the mailbox is empty.
+// NOTE: the tasks are posted by the reading goroutine of a connection only.
+type mailboxes struct {
+	lock    sync.Mutex
+	boxes   map[uint32]*mailbox
+	size    int
+	workers *pool.WorkerPool
+}
+
+func newMailboxes(size int, workers *pool.WorkerPool) *mailboxes {
+	return &mailboxes{boxes: map[uint32]*mailbox{}, size: size, workers: workers}
+}
+
+// Post put a task into the mailbox of a connection, it returns false if the
+// mailbox is full or the worker pool can't drain a new mailbox.
+func (mbs *mailboxes) Post(connID uint32, task func()) bool {
+	mbs.lock.Lock()
+	mb, ok := mbs.boxes[connID]
+	if ok {
+		defer mbs.lock.Unlock()
+		select {
+		case mb.tasks <- task:
+			return true
+		default:
+			return false
+		}
+	}
+	mb = &mailbox{tasks: make(chan func(), mbs.size)}
+	mb.tasks <- task
+	mbs.boxes[connID] = mb
+	mbs.lock.Unlock()
+
+	// a blocking pool waits for a worker without the lock held, so the
+	// draining workers can exit
+	drain := func() { mbs.run(connID, mb) }
+	if mbs.workers == nil {
+		go drain()
+		return true
+	}
+	if err := mbs.workers.Submit(drain); err != nil {
+		// only the task is queued, the mailbox is never drained
+		mbs.lock.Lock()
+		delete(mbs.boxes, connID)
+		mbs.lock.Unlock()
+		return false
+	}
+	return true
+}
+
+// Len get the number of the active mailboxes
+func (mbs *mailboxes) Len() int {
+	mbs.lock.Lock()
+	defer mbs.lock.Unlock()
+	return len(mbs.boxes)
+}
+
+func (mbs *mailboxes) run(connID uint32, mb *mailbox) {
+	for {
+		select {
+		case task := <-mb.tasks:
+			task()
+		default:
+			// a task is posted with the lock held, so it's empty indeed
+			mbs.lock.Lock()
+			if len(mb.tasks) == 0 {
+				delete(mbs.boxes, connID)
+				mbs.lock.Unlock()
+				return
+			}
+			mbs.lock.Unlock()
+		}
+	}
+}
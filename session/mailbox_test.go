@@ -0,0 +1,111 @@
+package session
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/overtalk/qnet/pool"
+)
+
+func TestMailboxesOrder(t *testing.T) {
+	boxes := newMailboxes(1000, nil)
+	var wg sync.WaitGroup
+	results := make([][]int, 4)
+	for i := 0; i < 1000; i++ {
+		for connID := range results {
+			connID, seq := connID, i
+			wg.Add(1)
+			if !boxes.Post(uint32(connID), func() {
+				results[connID] = append(results[connID], seq)
+				wg.Done()
+			}) {
+				t.Fatal("mailbox is full")
+			}
+		}
+	}
+	wg.Wait()
+	for connID, seqs := range results {
+		for i, seq := range seqs {
+			if i != seq {
+				t.Fatalf("conn %d: request %d handled at %d", connID, seq, i)
+			}
+		}
+	}
+}
+
+func TestMailboxesFull(t *testing.T) {
+	boxes := newMailboxes(1, nil)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	boxes.Post(1, func() { close(started); <-release })
+	<-started
+	if !boxes.Post(1, func() {}) {
+		t.Fatal("mailbox is full too early")
+	}
+	if boxes.Post(1, func() {}) {
+		t.Fatal("mailbox is not limited")
+	}
+	if !boxes.Post(2, func() {}) {
+		t.Fatal("another client is blocked")
+	}
+	close(release)
+}
+
+func TestMailboxesWorkerPool(t *testing.T) {
+	workers := pool.NewWorkerPool(2, 0, pool.OverflowBlock)
+	defer workers.Close()
+	boxes := newMailboxes(100, workers)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	results := make([][]int, 8)
+	for i := 0; i < 100; i++ {
+		for connID := range results {
+			connID, seq := connID, i
+			wg.Add(1)
+			if !boxes.Post(uint32(connID), func() {
+				defer wg.Done()
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				results[connID] = append(results[connID], seq)
+				atomic.AddInt32(&running, -1)
+			}) {
+				t.Fatal("mailbox is full")
+			}
+		}
+	}
+	wg.Wait()
+	// the mailboxes of 8 clients are drained by 2 workers
+	if max := atomic.LoadInt32(&maxRunning); max > 2 {
+		t.Errorf("%d tasks running at once", max)
+	}
+	for connID, seqs := range results {
+		for i, seq := range seqs {
+			if i != seq {
+				t.Fatalf("conn %d: request %d handled at %d", connID, seq, i)
+			}
+		}
+	}
+
+	// a new mailbox is rejected by a busy pool
+	busy := pool.NewWorkerPool(1, 1, pool.OverflowDrop)
+	defer busy.Close()
+	boxes = newMailboxes(1, busy)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	boxes.Post(1, func() { close(started); <-release })
+	<-started
+	if !boxes.Post(2, func() {}) {
+		t.Fatal("the mailbox isn't queued")
+	}
+	if boxes.Post(3, func() {}) || boxes.Len() != 2 {
+		t.Errorf("a new mailbox of a busy pool: %d mailboxes", boxes.Len())
+	}
+	close(release)
+}
@@ -7,39 +7,116 @@ import (
 
 // Request a game request
 type Request struct {
+	ConnID uint32
 	PVer   uint8
 	MID    uint8
 	AID    uint8
 	Data   []byte
 	Sign   []byte
+	// the algorithm of the signature, see packet.SignAlg
+	SignAlg packet.SignAlg
+	// the sequence number should be echoed in the response if HasSeq
+	Seq    uint32
+	HasSeq bool
 	buffer common.IPacketBuffer
+	// the session of the client, see FromRequest
+	session *Session
 }
 
-// NewRequestFromClient create a Request from a client's packet buffer
-func NewRequestFromClient(buffer common.IPacketBuffer) *Request {
+// requestOptions the options to create a client's Request
+type requestOptions struct {
+	crypto      packet.ICrypto
+	reassembler *packet.Reassembler
+}
+
+// RequestOptionFunc set the option to create a client's Request
+type RequestOptionFunc func(*requestOptions)
+
+// OptionRequestCrypto set the crypto to decrypt a client's packet,
+// it's packet.XORCrypto by default.
+func OptionRequestCrypto(crypto packet.ICrypto) RequestOptionFunc {
+	return func(o *requestOptions) {
+		if crypto != nil {
+			o.crypto = crypto
+		}
+	}
+}
+
+// OptionRequestReassembler set the reassembler of a client's fragments, they
+// are grouped as a connection whatever their connID is, and they are rejected
+// if not set.
+func OptionRequestReassembler(reassembler *packet.Reassembler) RequestOptionFunc {
+	return func(o *requestOptions) {
+		o.reassembler = reassembler
+	}
+}
+
+// NewRequestFromClient create a Request from a client's packet buffer, the
+// request is nil if it's a cmd packet or an incomplete fragment. The packet is
+// decrypted by the crypto of OptionRequestCrypto, a fragment is reassembled by
+// the reassembler of OptionRequestReassembler, and the compressed data is
+// decompressed.
+func NewRequestFromClient(buffer common.IPacketBuffer, opts ...RequestOptionFunc) (*Request, error) {
+	o := requestOptions{crypto: packet.XORCrypto}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	gamePacket := packet.Packet(buffer.Bytes())
 	if !gamePacket.IsValid() {
-		return nil
+		return nil, packet.ErrInvalidSize
+	}
+	// a cmd packet is never encrypted
+	if gamePacket.IsCmd() {
+		return nil, nil
+	}
+	gamePacket, err := gamePacket.Decrypt(o.crypto)
+	if err != nil {
+		return nil, err
 	}
-	// try to decrypt a game packet using the XORCrypto
-	gamePacket.Decrypt(packet.XORCrypto)
-	if gamePacket.IsCmdSize() || gamePacket.IsCmdProto() {
-		return nil
+	if gamePacket.IsFragment() {
+		if o.reassembler == nil {
+			return nil, packet.ErrInvalidFragment
+		}
+		if gamePacket, err = o.reassembler.AddFrom(0, gamePacket); err != nil || gamePacket == nil {
+			return nil, err
+		}
 	}
-	var signature []byte
-	if gamePacket.HasDataSign() {
-		signature = gamePacket.GetDataSign()
+	// the packet is validated before reading its fields
+	header, _, err := packet.Parse(gamePacket)
+	if err != nil {
+		return nil, err
 	}
+	// a cmd is never encrypted, so it's a broken data packet
+	if header.IsCmd() {
+		return nil, packet.ErrBadFlags
+	}
+	data, err := packet.Decompress(gamePacket)
+	if err != nil {
+		return nil, err
+	}
+	req := newRequest(header, data)
+	req.ConnID, req.buffer = 0, buffer
+	return req, nil
+}
+
+// newRequest create a Request from a parsed packet
+func newRequest(header *packet.Header, data []byte) *Request {
 	return &Request{
-		MID:    gamePacket.GetProtoMID(),
-		AID:    gamePacket.GetProtoAID(),
-		PVer:   gamePacket.GetProtoVer(),
-		Data:   gamePacket.GetDataLoad(),
-		Sign:   signature,
-		buffer: buffer,
+		ConnID:  header.ConnID,
+		MID:     header.MID,
+		AID:     header.AID,
+		PVer:    header.Ver,
+		Data:    data,
+		Sign:    header.Sign,
+		SignAlg: header.SignAlg,
+		Seq:     header.Seq,
+		HasSeq:  header.HasSeq,
 	}
 }
 
+// GetConnID get the connection id, it's 0 for a client's request
+func (r *Request) GetConnID() uint32 { return r.ConnID }
+
 // GetMID get the mid
 func (r *Request) GetMID() uint8 { return r.MID }
 
@@ -55,6 +132,18 @@ func (r *Request) GetData() []byte { return r.Data }
 // GetSign get the signature
 func (r *Request) GetSign() []byte { return r.Sign }
 
+// GetSignAlg get the algorithm of the signature
+func (r *Request) GetSignAlg() packet.SignAlg { return r.SignAlg }
+
+// GetSeq get the sequence number
+func (r *Request) GetSeq() uint32 { return r.Seq }
+
+// HasSequence check whether it has a sequence number
+func (r *Request) HasSequence() bool { return r.HasSeq }
+
+// GetSession get the session of the client
+func (r *Request) GetSession() *Session { return r.session }
+
 // Free free its underlying resource
 func (r *Request) Free() {
 	if r.buffer != nil {
@@ -62,17 +151,20 @@ func (r *Request) Free() {
 	}
 }
 
-// NewRequestFromAgent create a Request from a AgentPacket
-func NewRequestFromAgent(pack packet.Packet) *Request {
-	var signature []byte
-	if pack.HasDataSign() {
-		signature = pack.GetDataSign()
+// NewRequestFromAgent create a Request from a AgentPacket,
+// the compressed data is decompressed. A packet of MID 0 is a cmd,
+// it's rejected by packet.ErrBadFlags.
+func NewRequestFromAgent(pack packet.Packet) (*Request, error) {
+	header, _, err := packet.Parse(pack)
+	if err != nil {
+		return nil, err
 	}
-	return &Request{
-		MID:  pack.GetProtoMID(),
-		AID:  pack.GetProtoAID(),
-		PVer: pack.GetProtoVer(),
-		Data: pack.GetDataLoad(),
-		Sign: signature,
+	if header.IsCmd() {
+		return nil, packet.ErrBadFlags
+	}
+	data, err := packet.Decompress(pack)
+	if err != nil {
+		return nil, err
 	}
+	return newRequest(header, data), nil
 }
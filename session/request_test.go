@@ -0,0 +1,218 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/pool"
+	"github.com/overtalk/qnet/slab"
+)
+
+// readClientRequest read a packet written by a Response as a client's request
+func readClientRequest(t *testing.T, rsp *Response) *Request {
+	var buf bytes.Buffer
+	if _, err := rsp.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buffer := common.NewPacketBuffer(packet.MaxPacketSize, &slab.NoPool{})
+	if _, err := buffer.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	req, err := NewRequestFromClient(buffer, OptionRequestCrypto(rsp.Crypto),
+		OptionRequestReassembler(packet.NewReassembler(packet.DefaultMaxReassembledSize)))
+	if err != nil || req == nil {
+		t.Fatalf("invalid request: %v", err)
+	}
+	return req
+}
+
+func TestResponseSeq(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	for _, hasSeq := range []bool{false, true} {
+		req := readClientRequest(t, &Response{
+			MID: 3, AID: 4, PVer: 5, Seq: 0xABCDEF, HasSeq: hasSeq,
+			Result: common.BytesOutProtocol("hello"),
+		})
+		if req.MID != 3 || req.AID != 4 || req.PVer != 5 || string(req.Data) != "hello" {
+			t.Fatalf("request: %+v", req)
+		}
+		if req.HasSeq != hasSeq || (hasSeq && req.Seq != 0xABCDEF) {
+			t.Fatalf("request seq: %v, %d", req.HasSeq, req.Seq)
+		}
+		rsp := NewResponse(req, common.BytesOutProtocol("world"))
+		if rsp.HasSeq != req.HasSeq || rsp.Seq != req.Seq {
+			t.Fatalf("response seq: %v, %d", rsp.HasSeq, rsp.Seq)
+		}
+	}
+}
+
+func TestResponseAEAD(t *testing.T) {
+	crypto, err := packet.NewChaCha20Crypto(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := readClientRequest(t, &Response{
+		MID: 3, AID: 4, PVer: 5, Seq: 9, HasSeq: true,
+		Result: common.BytesOutProtocol("hello"), Crypto: crypto,
+	})
+	if req.MID != 3 || req.AID != 4 || req.Seq != 9 || string(req.Data) != "hello" {
+		t.Fatalf("request: %+v", req)
+	}
+
+	// a plain packet is rejected by an AEAD crypto
+	var buf bytes.Buffer
+	(&Response{MID: 3, AID: 4, Result: common.BytesOutProtocol("hello")}).WriteTo(&buf)
+	buffer := common.NewPacketBuffer(packet.MaxPacketSize, &slab.NoPool{})
+	buffer.ReadFrom(&buf)
+	if _, err = NewRequestFromClient(buffer, OptionRequestCrypto(crypto)); err != packet.ErrNotEncrypted {
+		t.Fatalf("plain packet: %v", err)
+	}
+}
+
+func TestResponseFragment(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	data := bytes.Repeat([]byte("0123456789"), 200*1024)
+	var buf bytes.Buffer
+	rsp := &Response{MID: 3, AID: 4, Seq: 5, HasSeq: true, Result: common.BytesOutProtocol(data)}
+	if _, err := rsp.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	reassembler := packet.NewReassembler(packet.DefaultMaxReassembledSize)
+	var req *Request
+	for n := 0; req == nil; n++ {
+		buffer := common.NewPacketBuffer(packet.MaxPacketSize, &slab.NoPool{})
+		if _, err := buffer.ReadFrom(&buf); err != nil {
+			t.Fatalf("fragment %d: %v", n, err)
+		}
+		var err error
+		if req, err = NewRequestFromClient(buffer, OptionRequestReassembler(reassembler)); err != nil {
+			t.Fatalf("fragment %d: %v", n, err)
+		}
+	}
+	if buf.Len() != 0 || req.MID != 3 || req.Seq != 5 || !bytes.Equal(req.Data, data) {
+		t.Fatalf("request: %d, %d, %d bytes", req.MID, req.Seq, len(req.Data))
+	}
+}
+
+func TestAgentPacketSeq(t *testing.T) {
+	pack := packet.NewFromDataSeq(7, []byte("data"), []byte("sign"), packet.NoneCompresser)
+	pack.SetConnID(101)
+	pack.SetProtoID(packet.MakeProtoID(1, 2))
+	req, err := NewRequestFromAgent(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ConnID != 101 || req.Seq != 7 || !req.HasSeq ||
+		string(req.Sign) != "sign" || string(req.Data) != "data" {
+		t.Fatalf("request: %+v", req)
+	}
+
+	// MID 0 is a cmd, its seq and sign are not read
+	pack.SetProtoID(packet.MakeProtoID(0, 2))
+	if _, err = NewRequestFromAgent(pack); err != packet.ErrBadFlags {
+		t.Fatalf("cmd packet: %v", err)
+	}
+}
+
+func TestAgentPacketZlib(t *testing.T) {
+	packet.InitZlibPool(10)
+	data := bytes.Repeat([]byte("hello"), 1000)
+	pack := packet.NewFromData(data, nil, packet.NewZlibCompresser(100))
+	pack.SetProtoID(packet.MakeProtoID(1, 2))
+	if !pack.IsZlibCompressed() || len(pack) >= len(data) {
+		t.Fatalf("packet not compressed: %d", len(pack))
+	}
+	req, err := NewRequestFromAgent(pack)
+	if err != nil || !bytes.Equal(req.Data, data) {
+		t.Fatalf("decompress: %v", err)
+	}
+
+	packet.SetMaxDecompressedSize(len(data) - 1)
+	defer packet.SetMaxDecompressedSize(packet.DefaultMaxReassembledSize)
+	if _, err = NewRequestFromAgent(pack); err != pool.ErrDecompressTooLarge {
+		t.Fatalf("zip bomb: %v", err)
+	}
+}
+
+// plainCrypto a crypto doing nothing
+type plainCrypto struct{}
+
+func (plainCrypto) Encrypt(p packet.Packet) (packet.Packet, error) { return p, nil }
+func (plainCrypto) Decrypt(p packet.Packet) (packet.Packet, error) { return p, nil }
+
+func TestRequestCrypto(t *testing.T) {
+	pack := packet.NewFromData([]byte("hello"), nil, packet.NoneCompresser)
+	pack.SetProtoID(packet.MakeProtoID(3, 4))
+	buffer := common.NewPacketBuffer(packet.MaxPacketSize, &slab.NoPool{})
+	if _, err := buffer.ReadFrom(bytes.NewReader(pack)); err != nil {
+		t.Fatal(err)
+	}
+	req, err := NewRequestFromClient(buffer, OptionRequestCrypto(plainCrypto{}))
+	if err != nil || req == nil || req.MID != 3 || req.AID != 4 || string(req.Data) != "hello" {
+		t.Fatalf("request: %+v, %v", req, err)
+	}
+}
+
+func FuzzNewRequestFromClient(f *testing.F) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	aead, err := packet.NewChaCha20Crypto(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		f.Fatal(err)
+	}
+	// the fuzzed packet is decrypted by one of them
+	cryptos := []packet.ICrypto{packet.XORCrypto, aead}
+	for i, crypto := range cryptos {
+		for _, hasSeq := range []bool{false, true} {
+			var buf bytes.Buffer
+			(&Response{
+				MID: 1, AID: 2, Seq: 3, HasSeq: hasSeq,
+				Result: common.BytesOutProtocol("hello"), Crypto: crypto,
+			}).WriteTo(&buf)
+			f.Add(buf.Bytes(), uint8(i))
+		}
+		signed, err := packet.NewBuilder(1, 2).Seq(3).Sign(packet.SignHMACSha1, []byte("sign")).
+			Data([]byte("hello")).Build()
+		if err != nil {
+			f.Fatal(err)
+		}
+		if signed, err = signed.Encrypt(crypto); err != nil {
+			f.Fatal(err)
+		}
+		f.Add([]byte(signed), uint8(i))
+	}
+	f.Add([]byte(packet.NewCompressCmd(0, 1)), uint8(0))
+	f.Fuzz(func(t *testing.T, b []byte, i uint8) {
+		crypto := cryptos[int(i)%len(cryptos)]
+		buffer := common.NewPacketBuffer(packet.MaxPacketSize, &slab.NoPool{})
+		if _, err := buffer.ReadFrom(bytes.NewReader(b)); err != nil {
+			return
+		}
+		pack := append(packet.Packet(nil), buffer.Bytes()...)
+		req, err := NewRequestFromClient(buffer,
+			OptionRequestCrypto(crypto), OptionRequestReassembler(packet.NewReassembler(64*1024)))
+		if err != nil || req == nil {
+			return
+		}
+
+		// the request is the parsed fields of the decrypted packet
+		plain, err := pack.Decrypt(crypto)
+		if err != nil {
+			t.Fatalf("decrypt an accepted packet: %v", err)
+		}
+		header, _, err := packet.Parse(plain)
+		if err != nil {
+			t.Fatalf("parse an accepted packet: %v", err)
+		}
+		data, err := packet.Decompress(plain)
+		if err != nil {
+			t.Fatalf("decompress an accepted packet: %v", err)
+		}
+		if req.ConnID != 0 || req.MID != header.MID || req.AID != header.AID || req.PVer != header.Ver ||
+			req.HasSeq != header.HasSeq || req.Seq != header.Seq || req.SignAlg != header.SignAlg ||
+			!bytes.Equal(req.Sign, header.Sign) || !bytes.Equal(req.Data, data) {
+			t.Fatalf("request %+v, header %+v", req, header)
+		}
+	})
+}
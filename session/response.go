@@ -13,22 +13,74 @@ type Response struct {
 	AID    uint8
 	PVer   uint8
 	PFlag  uint8
+	Seq    uint32
+	HasSeq bool
 	Result common.IOutProtocol
+	// Compresser compress the result, it's not compressed if nil
+	Compresser packet.ICompresser
+	// Crypto encrypt the packet, it's packet.XORCrypto if nil
+	Crypto packet.ICrypto
 }
 
-// WriteTo write some data to a writer
-func (rsp *Response) WriteTo(w io.Writer) (int, error) {
+// NewResponse create a Response for a request, the sequence number is echoed
+func NewResponse(req *Request, result common.IOutProtocol) *Response {
+	return &Response{
+		MID:    req.MID,
+		AID:    req.AID,
+		PVer:   req.PVer,
+		Seq:    req.Seq,
+		HasSeq: req.HasSeq,
+		Result: result,
+	}
+}
+
+// Packet build the packet of the response, it's not encrypted, and it's
+// oversized if the result is too large, see packet.Fragment.
+func (rsp *Response) Packet() (packet.Packet, error) {
 	out, err := rsp.Result.Marshal()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	// zaplog.S.Debugf("mid: %d, aid: %d, data: %v", rsp.MID, rsp.AID, out)
-	outPacket := packet.NewFromData(out, nil, packet.NoneCompresser)
+	compressor := rsp.Compresser
+	if compressor == nil {
+		compressor = packet.NoneCompresser
+	}
+	var outPacket packet.Packet
+	if rsp.HasSeq {
+		outPacket = packet.NewFromDataSeq(rsp.Seq, out, nil, compressor)
+	} else {
+		outPacket = packet.NewFromData(out, nil, compressor)
+	}
 	outPacket.SetConnID(0)
 	outPacket.SetProtoMID(rsp.MID)
 	outPacket.SetProtoAID(rsp.AID)
 	outPacket.SetProtoVer(rsp.PVer)
 	outPacket.SetDataFlag(rsp.PFlag)
-	outPacket.Encrypt(packet.XORCrypto)
-	return w.Write(outPacket)
+	return outPacket, nil
+}
+
+// WriteTo write some data to a writer
+func (rsp *Response) WriteTo(w io.Writer) (int, error) {
+	outPacket, err := rsp.Packet()
+	if err != nil {
+		return 0, err
+	}
+	crypto := rsp.Crypto
+	if crypto == nil {
+		crypto = packet.XORCrypto
+	}
+	// an oversized packet is written by fragments
+	var written int
+	for _, fragment := range packet.Fragment(outPacket) {
+		if fragment, err = fragment.Encrypt(crypto); err != nil {
+			return written, err
+		}
+		n, err := w.Write(fragment)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
 }
@@ -1,26 +1,136 @@
 package session
 
 import (
+	"net"
+	"time"
+
 	"github.com/overtalk/qnet/common"
 	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/pool"
 	"github.com/overtalk/qnet/tunnel"
-	"net"
-	"time"
 )
 
 // AgentService an agent service
 type AgentService struct {
-	router *common.Router
+	router   *common.Router
+	workers  *pool.WorkerPool
+	busyResp common.IOutProtocol
+	// mailbox size of each client, 0 means the requests are not ordered
+	mailboxSize int
+	// compress the responses larger than compressMin
+	compressAlg    packet.CompressAlg
+	compressMin    int
+	compressPolicy *packet.CompressPolicy
+	// the sessions of the clients
+	sessions *Manager
+	// authenticate the sessions before routing
+	auth *Authenticator
+	// detect a dead agent server, and ping it if configured
+	heartbeat common.Heartbeat
+}
+
+// the default heartbeat of an agent server, the agent server pings the game
+// server, so it's only checked whether the agent server is dead, in 20
+// seconds as before.
+var defaultAgentHeartbeat = common.Heartbeat{
+	DeadTimeout:  20 * time.Second,
+	WriteTimeout: 10 * time.Second,
+}
+
+// AgentOptionFunc set the AgentService's option
+type AgentOptionFunc func(*AgentService)
+
+// OptionWorkerPool set AgentService's worker pool, each request is handled
+// in its own goroutine if not set. A pool of OverflowBlock mustn't be shared
+// with the router, see common.OptionWorkerPool.
+func OptionWorkerPool(workers *pool.WorkerPool) AgentOptionFunc {
+	return func(as *AgentService) {
+		as.workers = workers
+	}
+}
+
+// OptionOrderedRequest handle the requests of the same client(conn id) one by
+// one in the arriving order, and at most mailboxSize requests are queued for
+// each client. The requests of a client are handled by a task of the worker
+// pool if set, so the pool still bounds the concurrency.
+func OptionOrderedRequest(mailboxSize int) AgentOptionFunc {
+	return func(as *AgentService) {
+		if mailboxSize <= 0 {
+			mailboxSize = 1
+		}
+		as.mailboxSize = mailboxSize
+	}
+}
+
+// OptionCompresser compress the responses larger than minSize by the algorithm,
+// the responses are not compressed by default.
+func OptionCompresser(alg packet.CompressAlg, minSize int) AgentOptionFunc {
+	return func(as *AgentService) {
+		as.compressAlg = alg
+		as.compressMin = minSize
+	}
+}
+
+// OptionCompressPolicy compress the responses by a policy learning whether the
+// compression pays off for each route, it overrides OptionCompresser.
+func OptionCompressPolicy(policy *packet.CompressPolicy) AgentOptionFunc {
+	return func(as *AgentService) {
+		as.compressPolicy = policy
+	}
+}
+
+// OptionBusyResponse set AgentService's response for the requests dropped
+// by a busy worker pool or a full mailbox, no response is sent if not set.
+func OptionBusyResponse(resp common.IOutProtocol) AgentOptionFunc {
+	return func(as *AgentService) {
+		as.busyResp = resp
+	}
+}
+
+// OptionSessionManager set the manager of the clients' sessions, eg: to share
+// it with a ClientService, a new one is created if not set.
+func OptionSessionManager(sessions *Manager) AgentOptionFunc {
+	return func(as *AgentService) {
+		as.sessions = sessions
+	}
+}
+
+// OptionAuthenticator authenticate the clients before routing their requests,
+// the requests are rejected until the clients log in. The auth timeout has no
+// effect, see Authenticator.Timeout.
+func OptionAuthenticator(auth *Authenticator) AgentOptionFunc {
+	return func(as *AgentService) {
+		as.auth = auth
+	}
+}
+
+// OptionHeartbeat set the heartbeat policy of the agent servers, an agent
+// server is never pinged by default, so its RTT is unknown, see Session.RTT.
+func OptionHeartbeat(heartbeat common.Heartbeat) AgentOptionFunc {
+	return func(as *AgentService) {
+		as.heartbeat = heartbeat
+	}
 }
 
 // NewAgentService create a AgentSession struct
-func NewAgentService(router *common.Router) *AgentService {
-	return &AgentService{router: router}
+func NewAgentService(router *common.Router, opts ...AgentOptionFunc) *AgentService {
+	as := &AgentService{router: router, heartbeat: defaultAgentHeartbeat}
+	for _, opt := range opts {
+		opt(as)
+	}
+	if as.sessions == nil {
+		as.sessions = NewManager()
+	}
+	checkWorkerPool(router, as.workers)
+	return as
 }
 
+// Sessions get the manager of the clients' sessions
+func (as *AgentService) Sessions() *Manager { return as.sessions }
+
 // Serve serve a tcp session from the agent server
 func (as *AgentService) Serve(nc net.Conn) {
-	backendSess := tunnel.NewBackendSession(0, nc)
+	backendSess := tunnel.NewBackendSession(0, nc, tunnel.OptionHeartbeat(as.heartbeat))
 	defer func() {
 		if err := recover(); err != nil {
 			//zaplog.S.Error(err)
@@ -30,19 +140,39 @@ func (as *AgentService) Serve(nc net.Conn) {
 	}()
 
 	// it's a long session
-	backendSess.CheckPing()
+	backendSess.StartHeartbeat()
+
+	// the conn id is unique in an agent session
+	var boxes *mailboxes
+	if as.mailboxSize > 0 {
+		boxes = newMailboxes(as.mailboxSize, as.workers)
+	}
+	// the sessions of the clients are only accessed by the reading goroutine
+	states := map[uint32]*Session{}
+	defer func() {
+		for _, state := range states {
+			as.sessions.remove(state)
+		}
+	}()
 
 	// all requests must be handled after breaking the for loop
 	for {
 		inRequest, err := backendSess.ReadRequest()
+		if err == nil && inRequest.GetPacket().IsFragment() {
+			// an oversized request is served after reassembled
+			if inRequest, err = backendSess.Reassemble(inRequest); err != nil || inRequest == nil {
+				//zaplog.S.Errorf("agent@%s: reassemble request: %v", backendSess.ClientAddr(), err)
+				continue
+			}
+		}
 		if err == nil {
-			go as.handleAgentRequest(backendSess, inRequest)
+			as.serveRequest(backendSess, states, boxes, inRequest)
 		} else {
 			inRequest.Free()
-			if IsNetTimeout(err) {
-				//zaplog.S.Errorf("read agent@%s request: %v", backendSess.ClientAddr(), err)
-				break
-			}
+			// the stream is broken, eg: EOF or timeout, or the connection
+			// is closed by the heartbeat if the agent server is dead
+			//zaplog.S.Errorf("read agent@%s request: %v", backendSess.ClientAddr(), err)
+			break
 		}
 	}
 
@@ -50,19 +180,71 @@ func (as *AgentService) Serve(nc net.Conn) {
 	WaitAction(func() { backendSess.WaitRequestDone() }, 5*time.Second)
 }
 
-func (as *AgentService) handleAgentCmd(sess *tunnel.BackendSession, pack packet.Packet) {
+// serveRequest handle the cmd in place and the others in the client's mailbox
+// or the worker pool
+func (as *AgentService) serveRequest(sess *tunnel.BackendSession,
+	states map[uint32]*Session, boxes *mailboxes, req *tunnel.BackendRequest) {
+	inPacket := req.GetPacket()
+	if inPacket.IsCmd() {
+		// a ping must not be dropped by a busy worker pool
+		as.handleAgentCmd(sess, states, inPacket)
+		req.Free()
+		return
+	}
+	connID := inPacket.GetConnID()
+	state, ok := states[connID]
+	if !ok {
+		state = as.sessions.newSession(connID, sess.ClientAddr(), nil, as.newWriter(sess, connID))
+		state.setRTT(sess.RTT)
+		states[connID] = state
+	}
+
+	sess.AddRequest()
+	task := func() { as.handleAgentRequest(sess, state, req) }
+	var err error
+	switch {
+	case boxes != nil:
+		if !boxes.Post(inPacket.GetConnID(), task) {
+			err = pool.ErrPoolBusy
+		}
+	case as.workers != nil:
+		err = as.workers.Submit(task)
+	default:
+		go task()
+	}
+	if err != nil {
+		//zaplog.S.Errorf("agent@%s: cid: %d, drop request: %v", sess.ClientAddr(), inPacket.GetConnID(), err)
+		if as.busyResp != nil {
+			as.writeResponse(sess, inPacket, as.busyResp)
+		}
+		req.Free()
+		sess.DoneRequest()
+	}
+}
+
+func (as *AgentService) handleAgentCmd(
+	sess *tunnel.BackendSession, states map[uint32]*Session, pack packet.Packet) {
 	cmd := pack.GetCmd()
 	switch cmd {
-	case packet.CmdPing:
-		sess.UpdatePing()
+	case packet.CmdPing, packet.CmdPong:
+		if err := sess.HandleHeartbeat(pack); err != nil {
+			//zaplog.S.Errorf("agent@%s: heartbeat: %v", sess.ClientAddr(), err)
+		}
+	case packet.CmdClose:
+		// the conn id may be reused by a new client of the agent
+		connID := pack.GetConnID()
+		if state, ok := states[connID]; ok {
+			delete(states, connID)
+			as.sessions.remove(state)
+		}
+		sess.DelFrontendSession(connID)
 	default:
 		//zaplog.S.Errorf("agent@%s: packet: %v, invalid cmd(%d)", sess.ClientAddr(), cmd)
 	}
 }
 
 func (as *AgentService) handleAgentRequest(
-	sess *tunnel.BackendSession, req *tunnel.BackendRequest) {
-	sess.AddRequest()
+	sess *tunnel.BackendSession, state *Session, req *tunnel.BackendRequest) {
 	defer func() {
 		if err := recover(); err != nil {
 			//zaplog.S.Error(err)
@@ -74,37 +256,60 @@ func (as *AgentService) handleAgentRequest(
 
 	// no need to decrypt the data from an agent server
 	inPacket := req.GetPacket()
-	if inPacket.IsCmdSize() || inPacket.IsCmdProto() {
-		as.handleAgentCmd(sess, inPacket)
-		return
-	}
 
-	connID := inPacket.GetConnID()
 	// show packet content
 	//zaplog.S.Debugf("agent@%s: cid: %d, packet: %v, size: %d", sess.ClientAddr(), connID, inPacket, len(inPacket))
-	clientRequest := NewRequestFromAgent(inPacket)
+	clientRequest, err := NewRequestFromAgent(inPacket)
+	if err != nil {
+		//zaplog.S.Errorf("agent@%s: cid: %d, invalid request: %v", sess.ClientAddr(), inPacket.GetConnID(), err)
+		return
+	}
+	clientRequest.session = state
 
-	result, isTimeout := as.router.Dispatch(clientRequest)
-	if isTimeout {
+	result, err := dispatch(as.router, as.auth, clientRequest)
+	if err != nil {
 		//zaplog.S.Errorf(
-		//	"agent@%s response timeout: cid: %d, mid: %d, aid: %d",
-		//	sess.ClientAddr(), connID, clientRequest.MID, clientRequest.AID)
+		//	"agent@%s dispatch: cid: %d, mid: %d, aid: %d, err: %v",
+		//	sess.ClientAddr(), connID, clientRequest.MID, clientRequest.AID, err)
+		if err == common.ErrRouteBusy && as.busyResp != nil {
+			result = as.busyResp
+		}
+	}
+	if result == nil {
+		return
 	}
 	//zaplog.S.Debugf(
 	//	"agent@%s response: cid: %d, mid: %d, aid: %d, out: [%v]",
 	//	sess.ClientAddr(), connID, clientRequest.MID, clientRequest.AID, result,
 	//)
+	as.writeResponse(sess, inPacket, result)
+}
 
+// writeResponse write the result of a request to the agent server
+func (as *AgentService) writeResponse(
+	sess *tunnel.BackendSession, inPacket packet.Packet, result common.IOutProtocol) {
+	connID := inPacket.GetConnID()
 	dataload, err := result.Marshal()
 	if err != nil {
 		//zaplog.S.Errorf(
 		//	"agent@%s marshal error: cid: %d, mid: %d, aid: %d, err: %v",
-		//	sess.ClientAddr(), connID, clientRequest.MID, clientRequest.AID, err)
+		//	sess.ClientAddr(), connID, inPacket.GetProtoMID(), inPacket.GetProtoAID(), err)
 		return
 	}
 
 	// don't encrypt the data, an agent server will do this
-	outPacket := packet.NewFromData(dataload, nil, packet.NoneCompresser)
+	var compressor packet.ICompresser
+	if as.compressPolicy != nil {
+		compressor = as.compressPolicy.Compresser(inPacket.GetProtoMID(), inPacket.GetProtoAID())
+	} else {
+		compressor = packet.NewCompresser(as.compressAlg, as.compressMin)
+	}
+	var outPacket packet.Packet
+	if inPacket.HasSeq() {
+		outPacket = packet.NewFromDataSeq(inPacket.GetSeq(), dataload, nil, compressor)
+	} else {
+		outPacket = packet.NewFromData(dataload, nil, compressor)
+	}
 	outPacket.SetConnID(connID)
 	outPacket.SetProtoMID(inPacket.GetProtoMID())
 	outPacket.SetProtoAID(inPacket.GetProtoAID())
@@ -115,11 +320,39 @@ func (as *AgentService) handleAgentRequest(
 	//	as.sess.ClientAddr(), connID, clientRequest.MID, clientRequest.AID, outPacket,
 	// )
 
-	_, err = sess.Write(outPacket)
+	// an oversized packet is written by fragments
+	for _, fragment := range packet.Fragment(outPacket) {
+		if _, err = sess.Write(fragment); err != nil {
+			break
+		}
+	}
 	if err != nil {
 		//zaplog.S.Errorf(
 		//	"write agent@%s response: cid: %d, mid: %d, aid: %d, err: %v",
-		//	sess.ClientAddr(), connID, clientRequest.MID,
-		//	clientRequest.AID, zeroutil.ParseNetError(err))
+		//	sess.ClientAddr(), connID, inPacket.GetProtoMID(),
+		//	inPacket.GetProtoAID(), zeroutil.ParseNetError(err))
+	}
+}
+
+// newWriter create a writer of the pushed messages to a client of the agent
+// server, the agent server will encrypt them, see tunnel.FrontendSession.Send.
+func (as *AgentService) newWriter(sess *tunnel.BackendSession, connID uint32) func(*Response) error {
+	return func(rsp *Response) error {
+		if as.compressPolicy != nil {
+			rsp.Compresser = as.compressPolicy.Compresser(rsp.MID, rsp.AID)
+		} else {
+			rsp.Compresser = packet.NewCompresser(as.compressAlg, as.compressMin)
+		}
+		outPacket, err := rsp.Packet()
+		if err != nil {
+			return err
+		}
+		outPacket.SetConnID(connID)
+		for _, fragment := range packet.Fragment(outPacket) {
+			if _, err = sess.Write(fragment); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 }
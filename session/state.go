@@ -0,0 +1,288 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/overtalk/qnet/common"
+)
+
+// ErrPushUnsupported the session can't push a message, eg: it's created by
+// a Manager out of a service
+var ErrPushUnsupported = errors.New("session: push unsupported")
+
+// Session the state of a client across its requests, a handler gets it by
+// FromRequest. A client connecting directly has a session per connection,
+// and a client of an agent server has a session per conn id, which lives
+// until the agent tells the client is closed by a packet.CmdClose, or the
+// agent's connection is closed.
+type Session struct {
+	id         uint64
+	connID     uint32
+	remoteAddr string
+	createTime time.Time
+	manager    *Manager
+
+	lock   sync.RWMutex
+	userID uint64
+	attrs  map[string]interface{}
+	// close the connection, and write a message to the client
+	closer func()
+	writer func(*Response) error
+	// measure the RTT of the connection
+	rtt func() time.Duration
+}
+
+// ID get the session id, it's unique in a Manager
+func (s *Session) ID() uint64 { return s.id }
+
+// ConnID get the connection id, it's 0 for a client connecting directly
+func (s *Session) ConnID() uint32 { return s.connID }
+
+// RemoteAddr get the remote address of the connection,
+// it's the agent server's address for a client of an agent server.
+func (s *Session) RemoteAddr() string { return s.remoteAddr }
+
+// CreateTime get the time when the session is created
+func (s *Session) CreateTime() time.Time { return s.createTime }
+
+// UserID get the logged-in user id, it's 0 if not logged in
+func (s *Session) UserID() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.userID
+}
+
+// IsLoggedIn check whether a user is logged in the session
+func (s *Session) IsLoggedIn() bool { return s.UserID() != 0 }
+
+// Login bind a user to the session, the previous session of the user is
+// unbound and returned, eg: to kick it by Close. Login(0) is Logout.
+// A session can't log in after its connection is closed.
+func (s *Session) Login(userID uint64) *Session {
+	if userID == 0 {
+		s.Logout()
+		return nil
+	}
+	return s.manager.login(s, userID)
+}
+
+// Logout unbind the logged-in user
+func (s *Session) Logout() {
+	s.manager.logout(s)
+}
+
+// Get get the value of an attribute
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	value, ok := s.attrs[key]
+	return value, ok
+}
+
+// Set set the value of an attribute
+func (s *Session) Set(key string, value interface{}) {
+	s.lock.Lock()
+	if s.attrs == nil {
+		s.attrs = map[string]interface{}{}
+	}
+	s.attrs[key] = value
+	s.lock.Unlock()
+}
+
+// Delete delete an attribute
+func (s *Session) Delete(key string) {
+	s.lock.Lock()
+	delete(s.attrs, key)
+	s.lock.Unlock()
+}
+
+// Push push a message to the client, it's resent after the session is
+// resumed if the client misses it, see OptionClientResumer.
+func (s *Session) Push(mid, aid uint8, result common.IOutProtocol) error {
+	return s.write(&Response{MID: mid, AID: aid, Result: result})
+}
+
+// write write a response or a pushed message to the client
+func (s *Session) write(rsp *Response) error {
+	s.lock.RLock()
+	writer := s.writer
+	s.lock.RUnlock()
+	if writer == nil {
+		return ErrPushUnsupported
+	}
+	return writer(rsp)
+}
+
+// Close close the client's connection, it does nothing for a client of
+// an agent server. A resumable session can't be resumed after closed.
+func (s *Session) Close() {
+	s.lock.RLock()
+	closer := s.closer
+	s.lock.RUnlock()
+	if closer != nil {
+		closer()
+	}
+}
+
+// attach set the closer and the writer of the client's connection
+func (s *Session) attach(closer func(), writer func(*Response) error) {
+	s.lock.Lock()
+	s.closer, s.writer = closer, writer
+	s.lock.Unlock()
+}
+
+// RTT get the measured round-trip time of the client's connection, it's the
+// agent server's one for a client of an agent server, and 0 if unknown.
+func (s *Session) RTT() time.Duration {
+	s.lock.RLock()
+	rtt := s.rtt
+	s.lock.RUnlock()
+	if rtt == nil {
+		return 0
+	}
+	return rtt()
+}
+
+// setRTT set the RTT func of the client's connection
+func (s *Session) setRTT(rtt func() time.Duration) {
+	s.lock.Lock()
+	s.rtt = rtt
+	s.lock.Unlock()
+}
+
+// ISessionRequest a request telling its session
+type ISessionRequest interface {
+	GetSession() *Session
+}
+
+// FromRequest get the session of a request, it's nil if the request
+// doesn't tell it.
+func FromRequest(r common.IRequest) *Session {
+	if sr, ok := r.(ISessionRequest); ok {
+		return sr.GetSession()
+	}
+	return nil
+}
+
+// Manager manage the sessions of a service, and look up them by the
+// logged-in user ids. It can be shared by several services.
+type Manager struct {
+	lastID uint64
+
+	lock     sync.RWMutex
+	sessions map[uint64]*Session
+	users    map[uint64]*Session
+}
+
+// NewManager create a Manager struct
+func NewManager() *Manager {
+	return &Manager{
+		sessions: map[uint64]*Session{},
+		users:    map[uint64]*Session{},
+	}
+}
+
+// newSession create a session of a connection, closer closes the connection,
+// and writer writes a message to the client.
+func (m *Manager) newSession(connID uint32, remoteAddr string,
+	closer func(), writer func(*Response) error) *Session {
+	s := &Session{
+		id:         atomic.AddUint64(&m.lastID, 1),
+		connID:     connID,
+		remoteAddr: remoteAddr,
+		createTime: time.Now(),
+		manager:    m,
+		closer:     closer,
+		writer:     writer,
+	}
+	m.lock.Lock()
+	m.sessions[s.id] = s
+	m.lock.Unlock()
+	return s
+}
+
+// remove remove a session after its connection is closed
+func (m *Manager) remove(s *Session) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sessions, s.id)
+	if userID := s.UserID(); userID != 0 && m.users[userID] == s {
+		delete(m.users, userID)
+	}
+}
+
+func (m *Manager) login(s *Session, userID uint64) *Session {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// a removed session mustn't be found by the user
+	if m.sessions[s.id] != s {
+		return nil
+	}
+	s.lock.Lock()
+	oldUserID := s.userID
+	s.userID = userID
+	s.lock.Unlock()
+	if oldUserID != 0 && m.users[oldUserID] == s {
+		delete(m.users, oldUserID)
+	}
+	prev := m.users[userID]
+	m.users[userID] = s
+	if prev == nil || prev == s {
+		return nil
+	}
+	prev.lock.Lock()
+	prev.userID = 0
+	prev.lock.Unlock()
+	return prev
+}
+
+func (m *Manager) logout(s *Session) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s.lock.Lock()
+	userID := s.userID
+	s.userID = 0
+	s.lock.Unlock()
+	if userID != 0 && m.users[userID] == s {
+		delete(m.users, userID)
+	}
+}
+
+// Get get a session by its id
+func (m *Manager) Get(id uint64) *Session {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.sessions[id]
+}
+
+// GetByUser get the session of a logged-in user
+func (m *Manager) GetByUser(userID uint64) *Session {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.users[userID]
+}
+
+// Len get the number of the sessions
+func (m *Manager) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.sessions)
+}
+
+// Range call fn for each session until it returns false
+func (m *Manager) Range(fn func(*Session) bool) {
+	m.lock.RLock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.lock.RUnlock()
+	for _, s := range sessions {
+		if !fn(s) {
+			return
+		}
+	}
+}
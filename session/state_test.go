@@ -0,0 +1,175 @@
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/overtalk/qnet/client"
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/tunnel"
+)
+
+func TestSessionLogin(t *testing.T) {
+	m := NewManager()
+	var closed int
+	s1 := m.newSession(1, "addr1", func() { closed++ }, nil)
+	s2 := m.newSession(2, "addr2", nil, nil)
+	if s1.ID() == s2.ID() || m.Len() != 2 || m.Get(s2.ID()) != s2 {
+		t.Fatalf("sessions: %d, %d, %d", s1.ID(), s2.ID(), m.Len())
+	}
+
+	if prev := s1.Login(100); prev != nil || m.GetByUser(100) != s1 || s1.UserID() != 100 {
+		t.Fatalf("login: %v, %v", prev, m.GetByUser(100))
+	}
+	// the user logs in another session, the previous one is kicked
+	if prev := s2.Login(100); prev != s1 || m.GetByUser(100) != s2 || s1.IsLoggedIn() {
+		t.Fatalf("login again: %v, %v", prev, m.GetByUser(100))
+	}
+	prev := s2.Login(200)
+	if prev != nil || m.GetByUser(100) != nil || m.GetByUser(200) != s2 {
+		t.Fatalf("switch user: %v, %v", prev, m.GetByUser(100))
+	}
+	s1.Close()
+	if closed != 1 {
+		t.Errorf("closed %d times", closed)
+	}
+
+	s2.Logout()
+	if m.GetByUser(200) != nil || s2.IsLoggedIn() {
+		t.Errorf("logout: %v", m.GetByUser(200))
+	}
+	s1.Login(300)
+	m.remove(s1)
+	if m.GetByUser(300) != nil || m.Get(s1.ID()) != nil || m.Len() != 1 {
+		t.Errorf("remove: %v, %d", m.GetByUser(300), m.Len())
+	}
+	// eg: a request in flight after the connection is closed
+	if prev := s1.Login(400); prev != nil || m.GetByUser(400) != nil {
+		t.Errorf("login a removed session: %v, %v", prev, m.GetByUser(400))
+	}
+}
+
+func TestSessionAttrs(t *testing.T) {
+	s := NewManager().newSession(1, "addr", nil, nil)
+	if _, ok := s.Get("k"); ok {
+		t.Fatal("got an unset attribute")
+	}
+	s.Set("k", 1)
+	if v, ok := s.Get("k"); !ok || v != 1 {
+		t.Fatalf("attribute: %v, %v", v, ok)
+	}
+	s.Delete("k")
+	if _, ok := s.Get("k"); ok {
+		t.Fatal("got a deleted attribute")
+	}
+	if err := s.Push(1, 1, common.BytesOutProtocol("push")); err != ErrPushUnsupported {
+		t.Errorf("got %v, expected %v", err, ErrPushUnsupported)
+	}
+}
+
+// loginAction log in the user of the data, and respond the session id
+type loginAction struct{}
+
+func (loginAction) GetAID() uint8 { return 2 }
+func (loginAction) Handle(r common.IRequest) common.IOutProtocol {
+	s := FromRequest(r)
+	if s == nil {
+		return common.BytesOutProtocol("no session")
+	}
+	if prev := s.Login(uint64(r.GetData()[0])); prev != nil {
+		prev.Close()
+	}
+	count, _ := s.Get("count")
+	n, _ := count.(int)
+	s.Set("count", n+1)
+	return common.BytesOutProtocol{byte(n + 1)}
+}
+
+func TestClientServiceSession(t *testing.T) {
+	packet.SetCryptoSecret([]byte{0x12, 0x34})
+	router := common.NewRouter()
+	router.Register(common.NewModule(1, loginAction{}))
+	addr, cs := serveRouter(t, router)
+
+	cli1, err := client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli1.Close()
+	for i := 1; i <= 2; i++ {
+		if msg, err := cli1.Request(1, 2, []byte{7}); err != nil || len(msg.Data) != 1 || msg.Data[0] != byte(i) {
+			t.Fatalf("request %d: %v %v", i, msg, err)
+		}
+	}
+	if s := cs.Sessions().GetByUser(7); s == nil || cs.Sessions().Len() != 1 {
+		t.Fatalf("user session: %v, %d", s, cs.Sessions().Len())
+	}
+
+	// the second client logs in the same user and kicks the first one
+	cli2, err := client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+	if msg, err := cli2.Request(1, 2, []byte{7}); err != nil || msg.Data[0] != 1 {
+		t.Fatalf("request: %v %v", msg, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if cli1.IsConnected() || cs.Sessions().Len() != 1 {
+		t.Errorf("kicked: %v, %d sessions", cli1.IsConnected(), cs.Sessions().Len())
+	}
+}
+
+func TestAgentServiceSession(t *testing.T) {
+	tunnel.InitBackendPool()
+	router := common.NewRouter()
+	router.Register(common.NewModule(1, loginAction{}))
+	as := NewAgentService(router)
+	agent, game := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		as.Serve(game)
+	}()
+	defer func() {
+		agent.Close()
+		<-done
+	}()
+
+	login := func(connID uint32, userID byte) {
+		pack := packet.NewFromDataSeq(1, []byte{userID}, nil, packet.NoneCompresser)
+		pack.SetConnID(connID)
+		pack.SetProtoID(packet.MakeProtoID(1, 2))
+		if _, err := agent.Write(pack); err != nil {
+			t.Fatal(err)
+		}
+		buffer := common.NewPacketBuffer(packet.MaxPacketSize, nil)
+		if _, err := buffer.ReadFrom(agent); err != nil {
+			t.Fatal(err)
+		}
+		if rsp := packet.Packet(buffer.Bytes()); rsp.GetConnID() != connID {
+			t.Fatalf("response of conn %d", rsp.GetConnID())
+		}
+	}
+	login(101, 7)
+	login(102, 8)
+	if s := as.Sessions().GetByUser(7); s == nil || s.ConnID() != 101 || as.Sessions().Len() != 2 {
+		t.Fatalf("user session: %v, %d", s, as.Sessions().Len())
+	}
+
+	// the agent tells the client of conn 101 is closed
+	if _, err := agent.Write(packet.NewClose(101)); err != nil {
+		t.Fatal(err)
+	}
+	login(102, 8)
+	if as.Sessions().GetByUser(7) != nil || as.Sessions().Len() != 1 {
+		t.Errorf("closed session: %v, %d", as.Sessions().GetByUser(7), as.Sessions().Len())
+	}
+	// a new client reuses the conn id
+	login(101, 9)
+	if s := as.Sessions().GetByUser(9); s == nil || s.ConnID() != 101 || as.Sessions().Len() != 2 {
+		t.Errorf("new session: %v, %d", s, as.Sessions().Len())
+	}
+}
@@ -3,6 +3,9 @@ package session
 import (
 	"net"
 	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/pool"
 )
 
 // WaitAction wait some action done or several seconds
@@ -26,3 +29,13 @@ func IsNetTimeout(err error) bool {
 	neterr, ok := err.(net.Error)
 	return ok && neterr.Timeout()
 }
+
+// checkWorkerPool panic if a service handles the requests in the blocking
+// worker pool of its router, a task waiting for another task queued in the
+// same pool may block all workers.
+func checkWorkerPool(router *common.Router, workers *pool.WorkerPool) {
+	if workers != nil && router != nil && router.WorkerPool() == workers &&
+		workers.Policy() == pool.OverflowBlock {
+		panic("session: the blocking worker pool is shared with the router")
+	}
+}
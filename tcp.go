@@ -4,6 +4,8 @@ import (
 	"net"
 	"os"
 	"time"
+
+	"github.com/overtalk/qnet/common"
 )
 
 // HandlerFunc a Handler wrapper
@@ -19,6 +21,8 @@ type TcpServer struct {
 	// will not read any data. But it may be removed as a default option
 	// that it's always stop reading data.
 	readSynced bool
+	// split the stream of its connections, see common.ConnFramer
+	framer common.IFramer
 
 	connHandler HandlerFunc
 }
@@ -37,6 +41,10 @@ func NewService(name, addr string, handler HandlerFunc) *TcpServer {
 // GetName get the service name
 func (ts *TcpServer) GetName() string { return ts.name }
 
+// SetFramer set the framer of its connections, the handler gets a connection
+// telling the framer, and the sessions created by it read the frames.
+func (ts *TcpServer) SetFramer(framer common.IFramer) { ts.framer = framer }
+
 // NewListener create a service listener
 func (ts *TcpServer) NewListener() (net.Listener, error) {
 	if ts.network == "unix" {
@@ -82,6 +90,9 @@ func (ts *TcpServer) Serve(l net.Listener) {
 			break
 		}
 		tempDelay = 0
+		if ts.framer != nil {
+			conn = common.NewFramedConn(conn, ts.framer)
+		}
 		// handle every client in its own goroutine
 		go ts.connHandler(conn)
 	}
@@ -25,14 +25,21 @@ func InitBackendPool() {
 // BackendRequest a request for backend
 type BackendRequest struct {
 	buffer common.IPacketBuffer
+	// the reassembled packet, it's not in the buffer
+	packet packet.Packet
 }
 
 // NewBackendRequest create a BackendRequest
 func NewBackendRequest() *BackendRequest {
+	return newBackendRequest(common.DefaultFramer)
+}
+
+func newBackendRequest(framer common.IFramer) *BackendRequest {
 	return &BackendRequest{
-		buffer: common.NewPacketBuffer(
+		buffer: common.NewFramedPacketBuffer(
 			packet.MaxPacketSize,
 			backendPool.GetRdrBufPool(),
+			framer,
 		),
 	}
 }
@@ -44,11 +51,16 @@ func (req *BackendRequest) Read(r common.IPacketReader) error {
 
 // Free free its underlying resource
 func (req *BackendRequest) Free() {
-	req.buffer.Free()
+	if req.buffer != nil {
+		req.buffer.Free()
+	}
 }
 
 // GetPacket get the packet
 func (req *BackendRequest) GetPacket() packet.Packet {
+	if req.packet != nil {
+		return req.packet
+	}
 	return packet.Packet(req.buffer.Bytes())
 }
 
@@ -96,9 +108,11 @@ func (bcs *backendConnState) tryAgain() bool {
 type BackendSession struct {
 	id       uint32
 	conn     *common.BaseConn
+	writer   *common.BatchWriter
 	closed   int32
 	sigClose chan struct{} // notify the session closed
-	pingtime int64         // timestamp for ping
+	// ping the peer, measure the RTT and detect a dead peer
+	heartbeat *common.HeartbeatState
 
 	// TODO: use sync.Map to reduce the lock contention
 	// manage all FrontendSession attached to it
@@ -111,27 +125,33 @@ type BackendSession struct {
 
 	// wait all reqeusts being done
 	waitRequest *sync.WaitGroup
-}
 
-const (
-	minPingTime = 20
-)
+	// reassemble the fragments of all frontend sessions
+	reassembler *packet.Reassembler
+	framer      common.IFramer
+}
 
 // NewBackendSession create a BackendSession struct
-func NewBackendSession(id uint32, nc net.Conn) *BackendSession {
+func NewBackendSession(id uint32, nc net.Conn, opts ...SessionOptionFunc) *BackendSession {
+	o := newSessionOptions(defaultBackendWriteQueue, opts)
 	baseConn := common.NewBaseConn(nc, backendPool.GetBufReader(nc))
-	baseConn.SetTimeout(10 * time.Second)
+	heartbeat := common.NewHeartbeatState(o.heartbeat)
+	heartbeat.Apply(baseConn)
+	framer := o.getFramer(nc)
 	nowTime := time.Now()
 	return &BackendSession{
 		id:          id,
 		conn:        baseConn,
+		writer:      common.NewFramedBatchWriter(baseConn, o.writeQueue, o.flushDelay, framer),
 		closed:      0,
 		sigClose:    make(chan struct{}),
-		pingtime:    nowTime.Unix(),
+		heartbeat:   heartbeat,
 		frontends:   map[uint32]*FrontendSession{},
 		idCounter:   0,
 		timeStart:   nowTime,
 		waitRequest: new(sync.WaitGroup),
+		reassembler: packet.NewReassembler(o.reassembleSize),
+		framer:      framer,
 	}
 }
 
@@ -166,80 +186,108 @@ func (s *BackendSession) WaitRequestDone() {
 	s.waitRequest.Wait()
 }
 
-// UpdatePing update the ping time
+// UpdatePing update the ping time, a read packet updates it already
 func (s *BackendSession) UpdatePing() {
-	atomic.StoreInt64(&s.pingtime, time.Now().Unix())
+	s.heartbeat.Touch(packet.PingPacket)
 }
 
 // Ping send a PingPacket to another endpoint
+//
+// Deprecated: use StartHeartbeat, the session pings by its heartbeat policy.
 func (s *BackendSession) Ping() {
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				//zaplog.S.Error(err)
-				//zaplog.S.Error(zap.Stack("").String)
-			}
-		}()
-
-		ticker := time.NewTicker((minPingTime - 2) * time.Second)
-		for {
-			select {
-			case <-ticker.C:
-				//zaplog.S.Infof("ping: agent@%s ---> backend-%d@%s", s.conn.LocalAddr(), s.id, s.ClientAddr())
-				_, err := s.conn.Write(packet.PingPacket)
-				if err != nil {
-					//zaplog.S.Errorf("ping: agent@%s ---> backend-%d@%s, %v", s.conn.LocalAddr(), s.id, s.ClientAddr(), err)
-					s.conn.Close()
-					ticker.Stop()
-					return
-				}
-			case <-s.sigClose:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+	s.StartHeartbeat()
 }
 
 // CheckPing check whether the underlying is ok
+//
+// Deprecated: use StartHeartbeat, the session checks the timeouts by its
+// heartbeat policy.
 func (s *BackendSession) CheckPing() {
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				//zaplog.S.Error(err)
-				//zaplog.S.Error(zap.Stack("").String)
-			}
-		}()
-
-		ticker := time.NewTicker(minPingTime * time.Second)
-		for {
-			select {
-			case now := <-ticker.C:
-				lastPingTime := atomic.LoadInt64(&s.pingtime)
-				if now.Unix()-lastPingTime > minPingTime {
-					// ping timeout
-					//zaplog.S.Errorf("ping timeout: agent@%s -> backend-%d@%s", s.ClientAddr(), s.id, s.conn.LocalAddr())
-					s.conn.Close()
-					ticker.Stop()
-					return
-				}
-			case <-s.sigClose:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+	s.StartHeartbeat()
+}
+
+// StartHeartbeat ping the peer and check the timeouts by the heartbeat
+// policy until closed, the session is closed if the peer is dead or idle.
+func (s *BackendSession) StartHeartbeat() {
+	s.heartbeat.Run(func(ping packet.Packet) error {
+		//zaplog.S.Infof("ping: agent@%s ---> backend-%d@%s", s.conn.LocalAddr(), s.id, s.ClientAddr())
+		_, err := s.Write(ping)
+		return err
+	}, s.closeConn, s.sigClose)
+}
+
+// closeConn close the connection only, the reading goroutine gets an error
+// and closes the session.
+func (s *BackendSession) closeConn() {
+	s.conn.Close()
 }
 
-// ReadRequest read a request
+// HandleHeartbeat handle a ping or a pong from the peer, a ping carrying the
+// sending time is replied by a pong, and a pong updates the RTT. A PingPacket
+// is echoed so that an agent can detect a dead backend as before, so the
+// peer mustn't echo it back.
+func (s *BackendSession) HandleHeartbeat(pack packet.Packet) error {
+	pong := s.heartbeat.Handle(pack)
+	if pong == nil && pack.GetCmd() == packet.CmdPing {
+		pong = packet.PingPacket
+	}
+	if pong == nil {
+		return nil
+	}
+	_, err := s.Write(pong)
+	return err
+}
+
+// RTT get the measured round-trip time to the peer, it's 0 if the session
+// never pings or the peer never replies.
+func (s *BackendSession) RTT() time.Duration {
+	return s.heartbeat.RTT()
+}
+
+// ReadRequest read a request, the in-flight request of a response is done,
+// see DoneResponse.
 func (s *BackendSession) ReadRequest() (*BackendRequest, error) {
-	req := NewBackendRequest()
+	req := newBackendRequest(s.framer)
 	err := req.Read(s.conn)
+	if err == nil {
+		s.heartbeat.Touch(req.GetPacket())
+		s.DoneResponse(req.GetPacket())
+	}
 	return req, err
 }
 
+// DoneResponse complete the in-flight request of a response from the backend
+// by its sequence number, see FrontendSession.Forward, so the responses
+// may arrive out of order. It returns the frontend session of the response's
+// connID, or nil if it's gone.
+func (s *BackendSession) DoneResponse(pack packet.Packet) *FrontendSession {
+	if !pack.IsValid() {
+		return nil
+	}
+	sess := s.GetFrontendSession(pack.GetConnID())
+	if sess != nil && !pack.IsCmdProto() && !pack.IsFragment() && pack.HasSeq() {
+		sess.DoneResponseSeq(pack.GetSeq())
+	}
+	return sess
+}
+
+// Reassemble add a fragment request to the reassembler and free it, it
+// returns the request of the reassembled packet when all fragments are
+// received, otherwise nil. The in-flight request of a reassembled response
+// is done, see DoneResponse.
+func (s *BackendSession) Reassemble(req *BackendRequest) (*BackendRequest, error) {
+	pack, err := s.reassembler.Add(req.GetPacket())
+	req.Free()
+	if err != nil || pack == nil {
+		return nil, err
+	}
+	s.DoneResponse(pack)
+	return &BackendRequest{packet: pack}, nil
+}
+
+// Write queue a packet to the session's writer, it's concurrent safely
 func (s *BackendSession) Write(b []byte) (int, error) {
-	return s.conn.Write(b)
+	return s.writer.Write(b)
 }
 
 // NewFrontendSessionID create a tunnel session id
@@ -263,11 +311,12 @@ func (s *BackendSession) AddFrontendSession(sess *FrontendSession) {
 	s.lock.Unlock()
 }
 
-// DelFrontendSession add a FrontendSession
+// DelFrontendSession delete a FrontendSession and the fragments of its id
 func (s *BackendSession) DelFrontendSession(id uint32) {
 	s.lock.Lock()
 	delete(s.frontends, id)
 	s.lock.Unlock()
+	s.reassembler.Remove(id)
 }
 
 // closeAllFrontendSessions close all frontend sessions(not concurrent safely)
@@ -281,11 +330,17 @@ func (s *BackendSession) closeAllFrontendSessions() {
 	s.frontends = map[uint32]*FrontendSession{}
 }
 
+// IsClosed check whether the session is closed
+func (s *BackendSession) IsClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
 // Close close the underlying tcp session and release the resource
 func (s *BackendSession) Close() {
 	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
 		close(s.sigClose)
 		s.closeAllFrontendSessions()
+		s.writer.Close()
 		s.conn.Close()
 	}
 }
@@ -0,0 +1,202 @@
+package tunnel_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/tunnel"
+)
+
+var initPools sync.Once
+
+func newPacket(connID, seq uint32, data []byte) packet.Packet {
+	pack := packet.NewFromDataSeq(seq, data, nil, packet.NewZlibCompresser(1024))
+	pack.SetConnID(connID)
+	pack.SetProtoID(packet.MakeProtoID(1, 1))
+	return pack
+}
+
+func TestDoneResponseOutOfOrder(t *testing.T) {
+	initPools.Do(func() {
+		tunnel.InitBackendPool()
+		tunnel.InitFrontendPool()
+	})
+	agentConn, backendConn := net.Pipe()
+	defer backendConn.Close()
+	backend := tunnel.NewBackendSession(1, agentConn)
+	defer backend.Close()
+	clientConn, frontConn := net.Pipe()
+	defer clientConn.Close()
+	frontend := tunnel.NewFrontendSession(frontConn)
+	defer frontend.Close()
+	frontend.BindBackendSession(backend)
+
+	// the backend replies the second request first
+	go func() {
+		var seqs []uint32
+		for len(seqs) < 2 {
+			head := make([]byte, 2)
+			if _, err := io.ReadFull(backendConn, head); err != nil {
+				return
+			}
+			req := make([]byte, 2+binary.BigEndian.Uint16(head))
+			copy(req, head)
+			if _, err := io.ReadFull(backendConn, req[2:]); err != nil {
+				return
+			}
+			if packet.Packet(req).GetConnID() == frontend.GetID() {
+				seqs = append(seqs, packet.Packet(req).GetSeq())
+			}
+		}
+		for i := len(seqs) - 1; i >= 0; i-- {
+			rsp := newPacket(frontend.GetID(), seqs[i], []byte("ok"))
+			if _, err := backendConn.Write(rsp); err != nil {
+				return
+			}
+		}
+	}()
+
+	for seq := uint32(1); seq <= 2; seq++ {
+		req := newPacket(12345, seq, []byte("req"))
+		if _, err := frontend.Forward(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frontend.PendingNum() != 2 {
+		t.Fatalf("pending: %d", frontend.PendingNum())
+	}
+	waits := make([]chan bool, 3)
+	for seq := 1; seq <= 2; seq++ {
+		waits[seq] = make(chan bool, 1)
+		go func(seq int) {
+			waits[seq] <- frontend.WaitResponseSeq(uint32(seq), time.Second)
+		}(seq)
+	}
+	for _, seq := range []int{2, 1} {
+		req, err := backend.ReadRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp := req.GetPacket(); rsp.GetSeq() != uint32(seq) {
+			t.Fatalf("response %d: seq %d", seq, rsp.GetSeq())
+		}
+		req.Free()
+		if !<-waits[seq] {
+			t.Fatalf("response %d not done", seq)
+		}
+		if seq == 2 && len(waits[1]) != 0 {
+			t.Fatal("response 1 done by response 2")
+		}
+	}
+	if frontend.PendingNum() != 0 || frontend.WaitResponseSeq(1, time.Millisecond) {
+		t.Fatalf("pending after done: %d", frontend.PendingNum())
+	}
+
+	// a response to a gone session
+	rsp := newPacket(9999, 3, []byte("ok"))
+	if backend.DoneResponse(rsp) != nil {
+		t.Fatal("response to a gone session")
+	}
+}
+
+func TestForwardUnbound(t *testing.T) {
+	initPools.Do(func() {
+		tunnel.InitBackendPool()
+		tunnel.InitFrontendPool()
+	})
+	clientConn, frontConn := net.Pipe()
+	defer clientConn.Close()
+	frontend := tunnel.NewFrontendSession(frontConn)
+	defer frontend.Close()
+	req := newPacket(0, 1, []byte("req"))
+	if _, err := frontend.Forward(req); err != tunnel.ErrUnbound {
+		t.Fatalf("forward unbound: %v", err)
+	}
+	if frontend.PendingNum() != 0 {
+		t.Fatalf("pending: %d", frontend.PendingNum())
+	}
+}
+
+func TestUnBindClose(t *testing.T) {
+	initPools.Do(func() {
+		tunnel.InitBackendPool()
+		tunnel.InitFrontendPool()
+	})
+	agentConn, backendConn := net.Pipe()
+	defer backendConn.Close()
+	backend := tunnel.NewBackendSession(1, agentConn)
+	defer backend.Close()
+	clientConn, frontConn := net.Pipe()
+	defer clientConn.Close()
+	frontend := tunnel.NewFrontendSession(frontConn)
+	defer frontend.Close()
+	frontend.BindBackendSession(backend)
+	id := frontend.GetID()
+
+	// the backend is told the session is closed
+	frontend.UnBindBackendSession()
+	if backend.GetFrontendSession(id) != nil {
+		t.Fatal("unbound session found")
+	}
+	pack := make([]byte, 2+packet.OptSizeCmd)
+	if _, err := io.ReadFull(backendConn, pack); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := packet.Packet(pack); !cmd.IsCmd() || cmd.GetCmd() != packet.CmdClose || cmd.GetConnID() != id {
+		t.Fatalf("close cmd: %v", cmd)
+	}
+}
+
+func TestBackendHeartbeat(t *testing.T) {
+	initPools.Do(func() {
+		tunnel.InitBackendPool()
+		tunnel.InitFrontendPool()
+	})
+	agentConn, backendConn := net.Pipe()
+	defer backendConn.Close()
+	backend := tunnel.NewBackendSession(1, agentConn)
+	defer backend.Close()
+	read := func() packet.Packet {
+		t.Helper()
+		backendConn.SetReadDeadline(time.Now().Add(time.Second))
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(backendConn, head); err != nil {
+			t.Fatal(err)
+		}
+		pack := make(packet.Packet, 2+binary.BigEndian.Uint16(head))
+		copy(pack, head)
+		if _, err := io.ReadFull(backendConn, pack[2:]); err != nil {
+			t.Fatal(err)
+		}
+		return pack
+	}
+
+	// a PingPacket is echoed as before
+	if err := backend.HandleHeartbeat(packet.PingPacket); err != nil {
+		t.Fatal(err)
+	}
+	if pong := read(); pong.GetCmd() != packet.CmdPing || len(pong.GetCmdData()) != 0 {
+		t.Fatalf("echo: %v", pong)
+	}
+	// a ping carrying the time is replied by a pong
+	sent := time.Now().Add(-50 * time.Millisecond)
+	if err := backend.HandleHeartbeat(packet.NewPingCmd(0, sent)); err != nil {
+		t.Fatal(err)
+	}
+	pong := read()
+	if at, ok := packet.ParsePingTime(pong); pong.GetCmd() != packet.CmdPong || !ok || !at.Equal(sent) {
+		t.Fatalf("pong: %v", pong)
+	}
+	// a pong updates the RTT and is never replied
+	if err := backend.HandleHeartbeat(pong); err != nil {
+		t.Fatal(err)
+	}
+	if rtt := backend.RTT(); rtt < 50*time.Millisecond || rtt > time.Second {
+		t.Errorf("rtt: %v", rtt)
+	}
+}
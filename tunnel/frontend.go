@@ -1,7 +1,9 @@
 package tunnel
 
 import (
+	"errors"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -13,6 +15,9 @@ import (
 
 var frontendPool *SessionPool
 
+// ErrUnbound the frontend session isn't bound to a backend session
+var ErrUnbound = errors.New("tunnel: frontend session unbound")
+
 // InitFrontendPool init some pools for the frontend
 func InitFrontendPool() {
 	frontendPool = NewSessionPool(
@@ -25,26 +30,62 @@ func InitFrontendPool() {
 type FrontendSession struct {
 	id     uint32
 	conn   *common.BaseConn
+	writer *common.BatchWriter
 	buffer common.IPacketBuffer
+	framer common.IFramer
 	closed int32
 	done   chan struct{}
+	// notify the session closed
+	sigClose chan struct{}
+	// ping the peer, measure the RTT and detect a dead or idle peer
+	heartbeat *common.HeartbeatState
+
+	// the negotiated compression algorithm
+	compressAlg uint32
+
+	// the secrets derived by the handshake
+	keys      *packet.SessionKeys
+	crypto    packet.ICrypto
+	signature packet.ISignature
+	keysLock  sync.RWMutex
+
+	// reassemble the fragments from the client
+	reassembler *packet.Reassembler
+
+	// in-flight requests with a sequence number
+	pending     map[uint32]chan struct{}
+	pendingLock sync.Mutex
 
 	// connected backend
 	backend *BackendSession
+
+	// the state shared by the connections of a resumable session
+	resume     *resumeState
+	resumeLock sync.RWMutex
 }
 
 // NewFrontendSession create a FrontendSession struct
-func NewFrontendSession(nc net.Conn) *FrontendSession {
+func NewFrontendSession(nc net.Conn, opts ...SessionOptionFunc) *FrontendSession {
+	o := newSessionOptions(defaultFrontendWriteQueue, opts)
 	baseConn := common.NewBaseConn(nc, frontendPool.GetBufReader(nc))
-	baseConn.SetTimeout(10 * time.Second)
+	heartbeat := common.NewHeartbeatState(o.heartbeat)
+	heartbeat.Apply(baseConn)
+	framer := o.getFramer(nc)
 	return &FrontendSession{
-		id:   0,
-		conn: baseConn,
-		buffer: common.NewPacketBuffer(
+		id:     0,
+		conn:   baseConn,
+		writer: common.NewFramedBatchWriter(baseConn, o.writeQueue, o.flushDelay, framer),
+		buffer: common.NewFramedPacketBuffer(
 			packet.MaxPacketSize,
 			frontendPool.GetRdrBufPool(),
+			framer,
 		),
-		done: make(chan struct{}),
+		framer:      framer,
+		done:        make(chan struct{}),
+		sigClose:    make(chan struct{}),
+		heartbeat:   heartbeat,
+		pending:     map[uint32]chan struct{}{},
+		reassembler: packet.NewReassembler(o.reassembleSize),
 	}
 }
 
@@ -62,18 +103,77 @@ func (s *FrontendSession) GetID() uint32 {
 func (s *FrontendSession) ReadPacket() (packet.Packet, error) {
 	err := s.conn.ReadPacket(s.buffer)
 	if err == nil {
-		return packet.Packet(s.buffer.Bytes()), nil
+		pack := packet.Packet(s.buffer.Bytes())
+		s.heartbeat.Touch(pack)
+		return pack, nil
 	}
 	return nil, err
 }
 
+// ReadBuffer read a packet into a new buffer, the buffer is owned by the
+// caller and must be freed, eg: by a session.Request.
+func (s *FrontendSession) ReadBuffer() (common.IPacketBuffer, error) {
+	buffer := common.NewFramedPacketBuffer(packet.MaxPacketSize, frontendPool.GetRdrBufPool(), s.framer)
+	if err := s.conn.ReadPacket(buffer); err != nil {
+		buffer.Free()
+		return nil, err
+	}
+	s.heartbeat.Touch(buffer.Bytes())
+	return buffer, nil
+}
+
+// SetReadTimeout set the read timeout, the session is idle if no packet is
+// read in the timeout, it's the DeadTimeout of the heartbeat by default.
+func (s *FrontendSession) SetReadTimeout(timeout time.Duration) {
+	s.conn.SetReadTimeout(timeout)
+}
+
+// Write queue a packet to the session's writer, it's concurrent safely
 func (s *FrontendSession) Write(b []byte) (int, error) {
-	return s.conn.Write(b)
+	return s.writer.Write(b)
+}
+
+// StartHeartbeat ping the peer and check the timeouts by the heartbeat
+// policy until closed, the session is closed if the peer is dead or idle.
+func (s *FrontendSession) StartHeartbeat() {
+	s.heartbeat.Run(func(ping packet.Packet) error {
+		_, err := s.Write(ping)
+		return err
+	}, s.closeConn, s.sigClose)
+}
+
+// closeConn close the connection only, the reading goroutine gets an error
+// and closes the session.
+func (s *FrontendSession) closeConn() {
+	s.conn.Close()
+}
+
+// HandleHeartbeat handle a ping or a pong from the peer, a ping carrying the
+// sending time is replied by a pong, and a pong updates the RTT. A PingPacket
+// is echoed so that a client can detect a dead server.
+func (s *FrontendSession) HandleHeartbeat(pack packet.Packet) error {
+	pong := s.heartbeat.Handle(pack)
+	if pong == nil && pack.GetCmd() == packet.CmdPing {
+		pong = packet.PingPacket
+	}
+	if pong == nil {
+		return nil
+	}
+	_, err := s.Write(pong)
+	return err
+}
+
+// RTT get the measured round-trip time to the peer, it's 0 if the session
+// never pings or the peer never replies.
+func (s *FrontendSession) RTT() time.Duration {
+	return s.heartbeat.RTT()
 }
 
 // Close close the underlying tcp session and release the resource
 func (s *FrontendSession) Close() {
 	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		close(s.sigClose)
+		s.writer.Close()
 		s.conn.Close()
 		s.buffer.Free()
 	}
@@ -93,10 +193,12 @@ func (s *FrontendSession) BindBackendSession(backend *BackendSession) {
 	}
 }
 
-// UnBindBackendSession unbind it from a backend session
+// UnBindBackendSession unbind it from a backend session, and tell the
+// backend the session is closed by a ClosePacket
 func (s *FrontendSession) UnBindBackendSession() {
 	if s.backend != nil {
 		s.backend.DelFrontendSession(s.id)
+		s.backend.Write(packet.NewClose(s.id))
 		s.id, s.backend = 0, nil
 	}
 }
@@ -114,3 +216,289 @@ func (s *FrontendSession) WaitResponse() {
 func (s *FrontendSession) DoneResponse() {
 	close(s.done)
 }
+
+// Forward forward a request to the bound backend session with the session id
+// as its connID. A request with a sequence number is added as in-flight, it's
+// done when the backend session reads its response, see WaitResponseSeq.
+func (s *FrontendSession) Forward(pack packet.Packet) (int, error) {
+	backend := s.backend
+	if backend == nil {
+		return 0, ErrUnbound
+	}
+	pack.SetConnID(s.id)
+	if !pack.IsCmdProto() && pack.HasSeq() {
+		s.AddPending(pack.GetSeq())
+	}
+	return backend.Write(pack)
+}
+
+// AddPending add an in-flight request by its sequence number,
+// it must be called before forwarding the request, Forward does it.
+func (s *FrontendSession) AddPending(seq uint32) {
+	s.pendingLock.Lock()
+	if _, ok := s.pending[seq]; !ok {
+		s.pending[seq] = make(chan struct{})
+	}
+	s.pendingLock.Unlock()
+}
+
+// PendingNum get the number of the in-flight requests not waited yet
+func (s *FrontendSession) PendingNum() int {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	return len(s.pending)
+}
+
+// WaitResponseSeq wait the response of an in-flight request arriving, the
+// request is removed after waiting. It returns false if timeout or the
+// request is not pending.
+func (s *FrontendSession) WaitResponseSeq(seq uint32, timeout time.Duration) bool {
+	s.pendingLock.Lock()
+	done, ok := s.pending[seq]
+	s.pendingLock.Unlock()
+	if !ok {
+		return false
+	}
+	defer func() {
+		s.pendingLock.Lock()
+		delete(s.pending, seq)
+		s.pendingLock.Unlock()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		// zaplog.S.Errorf("client-%d@%s: response(%d) timeout", s.id, s.ClientAddr(), seq)
+		return false
+	}
+}
+
+// DoneResponseSeq set the completion of an in-flight request, it may be
+// done before waiting. It returns false if the request is not pending or
+// done already.
+func (s *FrontendSession) DoneResponseSeq(seq uint32) bool {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	done, ok := s.pending[seq]
+	if !ok {
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+		close(done)
+		return true
+	}
+}
+
+// NegotiateCompress handle a CmdCompress packet from the client, choose the
+// first preferred algorithm supported by the client and reply it.
+func (s *FrontendSession) NegotiateCompress(
+	pack packet.Packet, preferred ...packet.CompressAlg) (packet.CompressAlg, error) {
+	var mask uint8
+	if data := pack.GetCmdData(); len(data) > 0 {
+		mask = data[0]
+	}
+	alg := packet.ChooseCompressAlg(mask, preferred...)
+	atomic.StoreUint32(&s.compressAlg, uint32(alg))
+	_, err := s.Write(packet.NewCompressCmd(0, uint8(alg)))
+	return alg, err
+}
+
+// GetCompressAlg get the negotiated compression algorithm
+func (s *FrontendSession) GetCompressAlg() packet.CompressAlg {
+	return packet.CompressAlg(atomic.LoadUint32(&s.compressAlg))
+}
+
+// NewCompresser create a compresser of the negotiated algorithm
+func (s *FrontendSession) NewCompresser(minSize int) packet.ICompresser {
+	return packet.NewCompresser(s.GetCompressAlg(), minSize)
+}
+
+// Handshake handle a CmdHandshake packet from the client, derive the session
+// keys by the client's public key and reply the server's one. The handshake is
+// unauthenticated, see packet.KeyExchange.
+func (s *FrontendSession) Handshake(pack packet.Packet) (*packet.SessionKeys, error) {
+	kx, err := packet.NewKeyExchange(false)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := kx.SessionKeys(pack.GetCmdData())
+	if err != nil {
+		return nil, err
+	}
+	crypto, err := keys.NewCrypto()
+	if err != nil {
+		return nil, err
+	}
+	s.keysLock.Lock()
+	s.keys, s.crypto, s.signature = keys, crypto, keys.NewSignature()
+	s.keysLock.Unlock()
+	if _, err = s.Write(packet.NewHandshakeCmd(0, kx.PublicKey())); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetSessionKeys get the session keys, it's nil before the handshake
+func (s *FrontendSession) GetSessionKeys() *packet.SessionKeys {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	return s.keys
+}
+
+// GetCrypto get the crypto of the session keys,
+// it's packet.XORCrypto before the handshake.
+func (s *FrontendSession) GetCrypto() packet.ICrypto {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	if s.crypto == nil {
+		return packet.XORCrypto
+	}
+	return s.crypto
+}
+
+// GetSignature get the signature of the session keys,
+// it's packet.HMACSha1Signature before the handshake.
+func (s *FrontendSession) GetSignature() packet.ISignature {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	if s.signature == nil {
+		return packet.HMACSha1Signature
+	}
+	return s.signature
+}
+
+// GetReassembler get the reassembler of the fragments from the client
+func (s *FrontendSession) GetReassembler() *packet.Reassembler {
+	return s.reassembler
+}
+
+// Send write a message packet encrypted by the session's crypto, an oversized
+// one is written by fragments, and the packet isn't changed. A message of a
+// resumable session is kept until the client acknowledges it, it's resent
+// after resumed if missed, see Resume.
+func (s *FrontendSession) Send(pack packet.Packet) error {
+	if rs := s.getResume(); rs != nil {
+		return rs.send(pack)
+	}
+	return s.writePacket(pack)
+}
+
+// writePacket write a copy of a packet encrypted by the session's crypto
+func (s *FrontendSession) writePacket(pack packet.Packet) error {
+	crypto := s.GetCrypto()
+	for _, fragment := range packet.Fragment(append(packet.Packet(nil), pack...)) {
+		fragment, err := fragment.Encrypt(crypto)
+		if err != nil {
+			return err
+		}
+		if _, err = s.Write(fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resume handle a CmdResume packet from the client after the handshake, see
+// packet.NewResumeCmd. A client asks for a token by a zero token, then the
+// session becomes resumable by the resumer. A reconnected client presents its
+// token proved by the keys of the resumed session and the keys of s, then the
+// resumed session's conn id, backend and in-flight requests are taken over by
+// s, the missed messages are resent, and the resumed session is returned, a
+// token is used once. The connection of the resumed session is closed if
+// it's half-open, and the resume waits until it's detached.
+//
+// It returns ErrResumeRejected if the resume isn't proved, and the client
+// should be closed. Otherwise the client gets a new session if the presented
+// one is expired or some missed messages are evicted, and it returns nil.
+func (s *FrontendSession) Resume(pack packet.Packet, r *Resumer) (*FrontendSession, error) {
+	count, token, proof, err := packet.ParseResumeCmd(pack)
+	if err != nil {
+		return nil, err
+	}
+	// a resume is proved by the session keys
+	if s.GetSessionKeys() == nil || s.getResume() != nil {
+		return nil, ErrResumeRejected
+	}
+	if token != nil {
+		if rs := r.get(token); rs != nil {
+			old, err := rs.take(s, token, count, proof)
+			if old != nil || err != nil {
+				return old, err
+			}
+		}
+	}
+
+	rs := &resumeState{resumer: r}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if err = r.issue(rs); err != nil {
+		return nil, err
+	}
+	rs.attach(s)
+	_, err = s.Write(packet.NewResumeCmd(0, 0, rs.token, nil))
+	return nil, err
+}
+
+// takeOver take over the conn id, the backend and the in-flight requests of
+// a resumed session, s is unbound from its own backend first.
+func (s *FrontendSession) takeOver(old *FrontendSession) {
+	s.UnBindBackendSession()
+	old.pendingLock.Lock()
+	pending := old.pending
+	old.pending = map[uint32]chan struct{}{}
+	old.pendingLock.Unlock()
+	s.pendingLock.Lock()
+	for seq, done := range pending {
+		s.pending[seq] = done
+	}
+	s.pendingLock.Unlock()
+	s.id, s.backend = old.id, old.backend
+	if s.backend != nil {
+		s.backend.AddFrontendSession(s)
+	}
+}
+
+// Ack handle a CmdAck packet from the client, the acknowledged messages of
+// a resumable session are dropped.
+func (s *FrontendSession) Ack(pack packet.Packet) error {
+	count, err := packet.ParseAckCmd(pack)
+	if err != nil {
+		return err
+	}
+	if rs := s.getResume(); rs != nil {
+		rs.ack(count)
+	}
+	return nil
+}
+
+// Detach detach the closed connection from its resumable session, the session
+// is kept for the resumer's grace period, and then it expires: it's unbound
+// from the backend and onExpire is called. It returns false if the session
+// isn't resumable or it's expired, then the caller cleans it up as usual.
+func (s *FrontendSession) Detach(onExpire func()) bool {
+	rs := s.getResume()
+	return rs != nil && rs.detach(s, onExpire)
+}
+
+// Expire make a resumable session expire at once, eg: to kick the client, and
+// close the connection. It's Close if the session isn't resumable.
+func (s *FrontendSession) Expire() {
+	if rs := s.getResume(); rs != nil {
+		rs.expire()
+	}
+	s.Close()
+}
+
+// IsResumable check whether the session is resumable, see Resume
+func (s *FrontendSession) IsResumable() bool {
+	return s.getResume() != nil
+}
+
+func (s *FrontendSession) getResume() *resumeState {
+	s.resumeLock.RLock()
+	defer s.resumeLock.RUnlock()
+	return s.resume
+}
@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"net"
+	"time"
+
+	"github.com/overtalk/qnet/common"
+	"github.com/overtalk/qnet/packet"
+)
+
+const (
+	defaultBackendWriteQueue  = 1024
+	defaultFrontendWriteQueue = 64
+)
+
+// sessionOptions the options for a BackendSession or a FrontendSession
+type sessionOptions struct {
+	writeQueue int           // the outbound packets queue size
+	flushDelay time.Duration // wait for more packets before writing
+	// the maximum size of a packet reassembled from the fragments
+	reassembleSize int
+	// split the stream into packets, it's the connection's framer if nil
+	framer common.IFramer
+	// the heartbeat policy and the timeouts of the connection
+	heartbeat common.Heartbeat
+}
+
+// SessionOptionFunc set the session's option
+type SessionOptionFunc func(*sessionOptions)
+
+// OptionWriteQueue set the session's outbound queue size, the writer waits
+// flushDelay for more packets to write them by a syscall, and a Write blocks
+// until the write timeout if the queue is full.
+func OptionWriteQueue(size int, flushDelay time.Duration) SessionOptionFunc {
+	return func(o *sessionOptions) {
+		o.writeQueue = size
+		o.flushDelay = flushDelay
+	}
+}
+
+// OptionReassembleSize set the maximum size of a packet reassembled from the
+// fragments, it's packet.DefaultMaxReassembledSize by default.
+func OptionReassembleSize(maxSize int) SessionOptionFunc {
+	return func(o *sessionOptions) {
+		o.reassembleSize = maxSize
+	}
+}
+
+// OptionFramer set the session's framer, it's common.ConnFramer by default
+func OptionFramer(framer common.IFramer) SessionOptionFunc {
+	return func(o *sessionOptions) {
+		o.framer = framer
+	}
+}
+
+// OptionHeartbeat set the session's heartbeat policy, it's
+// common.DefaultHeartbeat by default.
+func OptionHeartbeat(heartbeat common.Heartbeat) SessionOptionFunc {
+	return func(o *sessionOptions) {
+		o.heartbeat = heartbeat
+	}
+}
+
+func newSessionOptions(writeQueue int, opts []SessionOptionFunc) *sessionOptions {
+	o := &sessionOptions{
+		writeQueue:     writeQueue,
+		flushDelay:     0,
+		reassembleSize: packet.DefaultMaxReassembledSize,
+		heartbeat:      common.DefaultHeartbeat,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// getFramer get the framer of the session, it's the connection's by default
+func (o *sessionOptions) getFramer(nc net.Conn) common.IFramer {
+	if o.framer != nil {
+		return o.framer
+	}
+	return common.ConnFramer(nc)
+}
@@ -0,0 +1,250 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/overtalk/qnet/packet"
+)
+
+// error definitions
+var (
+	// ErrResumeRejected the resume cmd isn't proved by the resumed session's
+	// keys, or the session is being resumed by another connection
+	ErrResumeRejected = errors.New("tunnel: resume rejected")
+	// ErrSessionExpired the resumable session is expired
+	ErrSessionExpired = errors.New("tunnel: session expired")
+)
+
+// Resumer keep the resumable frontend sessions of the disconnected clients for
+// a grace period, see FrontendSession.Resume. It can be shared by the services.
+type Resumer struct {
+	grace      time.Duration
+	bufferSize int
+
+	lock     sync.Mutex
+	sessions map[string]*resumeState
+}
+
+// NewResumer create a Resumer struct, a disconnected session is kept for the
+// grace period, and at most bufferSize unacknowledged messages are kept for
+// each session, a session can't be resumed if more ones are missed.
+func NewResumer(grace time.Duration, bufferSize int) *Resumer {
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	return &Resumer{grace: grace, bufferSize: bufferSize, sessions: map[string]*resumeState{}}
+}
+
+// Len get the number of the resumable sessions, connected or not
+func (r *Resumer) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.sessions)
+}
+
+func (r *Resumer) get(token []byte) *resumeState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sessions[string(token)]
+}
+
+// issue issue a new token to a session, its old token is revoked
+func (r *Resumer) issue(rs *resumeState) error {
+	token, err := packet.NewResumeToken()
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	if rs.token != nil {
+		delete(r.sessions, string(rs.token))
+	}
+	rs.token = token
+	r.sessions[string(token)] = rs
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *Resumer) remove(rs *resumeState) {
+	r.lock.Lock()
+	if r.sessions[string(rs.token)] == rs {
+		delete(r.sessions, string(rs.token))
+	}
+	r.lock.Unlock()
+}
+
+// resumeState the state of a resumable session shared by its connections, the
+// messages sent to the client are numbered from 1, and the unacknowledged ones
+// are kept unencrypted. It's guarded by the lock, except the token is
+// written with the resumer's lock held too.
+type resumeState struct {
+	resumer *Resumer
+
+	lock  sync.Mutex
+	token []byte
+	// the session of the last connection, it's detached after the
+	// connection is closed, and detached is closed then
+	sess     *FrontendSession
+	attached bool
+	detached chan struct{}
+	onExpire func()
+	timer    *time.Timer
+	expired  bool
+	// the number of the sent messages, and the acknowledged or evicted ones
+	sent   uint32
+	acked  uint32
+	buffer []packet.Packet
+}
+
+// send keep a message until acknowledged, and write it if attached
+func (rs *resumeState) send(pack packet.Packet) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if rs.expired {
+		return ErrSessionExpired
+	}
+	pack = append(packet.Packet(nil), pack...)
+	rs.sent++
+	rs.buffer = append(rs.buffer, pack)
+	if len(rs.buffer) > rs.resumer.bufferSize {
+		rs.buffer[0] = nil
+		rs.buffer = rs.buffer[1:]
+		rs.acked++
+	}
+	if !rs.attached {
+		return nil
+	}
+	return rs.sess.writePacket(pack)
+}
+
+// ack drop the messages received by the client
+func (rs *resumeState) ack(count uint32) {
+	rs.lock.Lock()
+	rs.trim(count)
+	rs.lock.Unlock()
+}
+
+func (rs *resumeState) trim(count uint32) {
+	if count > rs.sent {
+		count = rs.sent
+	}
+	for rs.acked < count && len(rs.buffer) > 0 {
+		rs.buffer[0] = nil
+		rs.buffer = rs.buffer[1:]
+		rs.acked++
+	}
+}
+
+// attach attach the connection of a session
+func (rs *resumeState) attach(sess *FrontendSession) {
+	rs.sess, rs.attached = sess, true
+	rs.detached = make(chan struct{})
+	sess.resumeLock.Lock()
+	sess.resume = rs
+	sess.resumeLock.Unlock()
+}
+
+// detach detach the closed connection of a session, the session expires
+// after the grace period unless it's resumed.
+func (rs *resumeState) detach(sess *FrontendSession, onExpire func()) bool {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if rs.expired || rs.sess != sess || !rs.attached {
+		return false
+	}
+	rs.attached = false
+	close(rs.detached)
+	rs.onExpire = onExpire
+	rs.timer = time.AfterFunc(rs.resumer.grace, rs.expire)
+	return true
+}
+
+// take take the session for a reconnected client's session which has
+// received count messages, the connection of the session is closed if it's
+// attached, and it waits for the detachment. It returns nil if the session
+// can't be resumed and the client should start over.
+func (rs *resumeState) take(sess *FrontendSession, token []byte, count uint32, proof []byte) (*FrontendSession, error) {
+	rs.lock.Lock()
+	if rs.expired || !bytes.Equal(rs.token, token) {
+		rs.lock.Unlock()
+		return nil, nil
+	}
+	old, attached, detached := rs.sess, rs.attached, rs.detached
+	err := packet.VerifyResumeProof(old.GetSessionKeys(), sess.GetSessionKeys(), token, count, proof)
+	if err != nil || count > rs.sent {
+		rs.lock.Unlock()
+		return nil, ErrResumeRejected
+	}
+	if count < rs.acked {
+		// the missed messages are evicted
+		rs.lock.Unlock()
+		rs.expire()
+		return nil, nil
+	}
+	rs.lock.Unlock()
+
+	// a half-open connection isn't detached yet
+	if attached {
+		old.conn.Close()
+		select {
+		case <-detached:
+		case <-time.After(rs.resumer.grace):
+			return nil, ErrResumeRejected
+		}
+	}
+
+	rs.lock.Lock()
+	// it may be resumed by another connection in the meantime
+	if rs.expired || rs.sess != old || rs.attached || !bytes.Equal(rs.token, token) {
+		rs.lock.Unlock()
+		return nil, ErrResumeRejected
+	}
+	rs.timer.Stop()
+	if err = rs.resumer.issue(rs); err != nil {
+		rs.lock.Unlock()
+		return nil, err
+	}
+	sess.takeOver(old)
+	rs.attach(sess)
+	rs.trim(count)
+	reply := packet.NewResumeCmd(0, count, rs.token,
+		packet.NewResumeProof(old.GetSessionKeys(), sess.GetSessionKeys(), rs.token, count))
+	if _, err = sess.Write(reply); err == nil {
+		for _, pack := range rs.buffer {
+			if err = sess.writePacket(pack); err != nil {
+				break
+			}
+		}
+	}
+	rs.lock.Unlock()
+	return old, err
+}
+
+// expire expire the session, the connection is closed if it's attached,
+// otherwise the session is unbound from the backend.
+func (rs *resumeState) expire() {
+	rs.lock.Lock()
+	if rs.expired {
+		rs.lock.Unlock()
+		return
+	}
+	rs.expired = true
+	if rs.timer != nil {
+		rs.timer.Stop()
+	}
+	sess, attached, onExpire := rs.sess, rs.attached, rs.onExpire
+	rs.buffer = nil
+	rs.lock.Unlock()
+
+	rs.resumer.remove(rs)
+	if attached {
+		sess.conn.Close()
+		return
+	}
+	sess.UnBindBackendSession()
+	if onExpire != nil {
+		onExpire()
+	}
+}
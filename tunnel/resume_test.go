@@ -0,0 +1,165 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/overtalk/qnet/packet"
+	"github.com/overtalk/qnet/tunnel"
+)
+
+// testClient the client end of a frontend session
+type testClient struct {
+	t      *testing.T
+	nc     net.Conn
+	keys   *packet.SessionKeys
+	crypto packet.ICrypto
+}
+
+// connect create a frontend session, and derive the keys by a handshake
+func connect(t *testing.T) (*tunnel.FrontendSession, *testClient) {
+	clientConn, frontConn := net.Pipe()
+	frontend := tunnel.NewFrontendSession(frontConn)
+	t.Cleanup(func() {
+		clientConn.Close()
+		frontend.Close()
+	})
+	kx, err := packet.NewKeyExchange(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = frontend.Handshake(packet.NewHandshakeCmd(0, kx.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, nc: clientConn}
+	if c.keys, err = kx.SessionKeys(c.read().GetCmdData()); err != nil {
+		t.Fatal(err)
+	}
+	if c.crypto, err = c.keys.NewCrypto(); err != nil {
+		t.Fatal(err)
+	}
+	return frontend, c
+}
+
+func (c *testClient) read() packet.Packet {
+	c.t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(time.Second))
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.nc, head); err != nil {
+		c.t.Fatal(err)
+	}
+	pack := make(packet.Packet, 2+binary.BigEndian.Uint16(head))
+	copy(pack, head)
+	if _, err := io.ReadFull(c.nc, pack[2:]); err != nil {
+		c.t.Fatal(err)
+	}
+	return pack
+}
+
+// readResume read the reply of a resume cmd
+func (c *testClient) readResume() (uint32, []byte, []byte) {
+	c.t.Helper()
+	count, token, proof, err := packet.ParseResumeCmd(c.read())
+	if err != nil || token == nil {
+		c.t.Fatalf("resume reply: %x %v", token, err)
+	}
+	return count, token, proof
+}
+
+// readMessage read a message and check its data
+func (c *testClient) readMessage(expected string) {
+	c.t.Helper()
+	pack, err := c.read().Decrypt(c.crypto)
+	if err != nil || string(pack.GetDataLoad()) != expected {
+		c.t.Fatalf("message: %q %v, expected %q", pack.GetDataLoad(), err, expected)
+	}
+}
+
+func TestFrontendResume(t *testing.T) {
+	initPools.Do(func() {
+		tunnel.InitBackendPool()
+		tunnel.InitFrontendPool()
+	})
+	agentConn, backendConn := net.Pipe()
+	defer backendConn.Close()
+	go io.Copy(io.Discard, backendConn)
+	backend := tunnel.NewBackendSession(1, agentConn)
+	defer backend.Close()
+	resumer := tunnel.NewResumer(time.Second, 4)
+
+	first, c1 := connect(t)
+	first.BindBackendSession(backend)
+	id := first.GetID()
+	if old, err := first.Resume(packet.NewResumeCmd(0, 0, nil, nil), resumer); old != nil || err != nil {
+		t.Fatalf("new session: %v %v", old, err)
+	}
+	_, token, proof := c1.readResume()
+	if proof != nil || !first.IsResumable() || resumer.Len() != 1 {
+		t.Fatalf("proof: %x, resumable: %v", proof, first.IsResumable())
+	}
+	// the client receives the first message only, the third one is sent
+	// after the connection is closed
+	for _, data := range []string{"1", "2"} {
+		if err := first.Send(newPacket(0, 0, []byte(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c1.readMessage("1")
+	c1.readMessage("2")
+	c1.nc.Close()
+	if !first.Detach(nil) {
+		t.Fatal("the session isn't kept")
+	}
+	first.Close()
+	if err := first.Send(newPacket(0, 0, []byte("3"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a resume must be proved by the keys of the resumed session
+	second, c2 := connect(t)
+	forged := packet.NewResumeCmd(0, 1, token, packet.NewResumeProof(c2.keys, c2.keys, token, 1))
+	if _, err := second.Resume(forged, resumer); err != tunnel.ErrResumeRejected {
+		t.Fatalf("got %v, expected %v", err, tunnel.ErrResumeRejected)
+	}
+	cmd := packet.NewResumeCmd(0, 1, token, packet.NewResumeProof(c1.keys, c2.keys, token, 1))
+	if old, err := second.Resume(cmd, resumer); old != first || err != nil {
+		t.Fatalf("resumed: %v %v", old, err)
+	}
+	count, newToken, proof := c2.readResume()
+	if count != 1 || bytes.Equal(newToken, token) ||
+		packet.VerifyResumeProof(c1.keys, c2.keys, newToken, count, proof) != nil {
+		t.Fatalf("resume reply: %d %x %x", count, newToken, proof)
+	}
+	c2.readMessage("2")
+	c2.readMessage("3")
+	if second.GetID() != id || backend.GetFrontendSession(id) != second {
+		t.Fatalf("conn id: %d, expected %d", second.GetID(), id)
+	}
+
+	// a token is used once
+	third, c3 := connect(t)
+	if old, err := third.Resume(cmd, resumer); old != nil || err != nil {
+		t.Fatalf("resumed by a used token: %v %v", old, err)
+	}
+	if _, _, proof = c3.readResume(); proof != nil || resumer.Len() != 2 {
+		t.Fatalf("proof: %x, %d resumable", proof, resumer.Len())
+	}
+
+	// the resumed session is unbound after it expires
+	expired := make(chan struct{})
+	if !second.Detach(func() { close(expired) }) {
+		t.Fatal("the resumed session isn't kept")
+	}
+	select {
+	case <-expired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the session never expires")
+	}
+	if backend.GetFrontendSession(id) != nil || resumer.Len() != 1 {
+		t.Errorf("the expired session is bound, %d resumable", resumer.Len())
+	}
+}